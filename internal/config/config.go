@@ -1,7 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/goccy/go-yaml"
 )
@@ -11,8 +14,91 @@ const (
 	DefaultModelName = "moonshotai/kimi-k2-0905"
 	DefaultPort      = "12377"
 	DefaultBaseURL   = "https://openrouter.ai/api"
+	// DefaultBatchConcurrency is how many Message Batches requests are sent upstream at once
+	DefaultBatchConcurrency = 4
+	// DefaultMaxSSELineBytes caps a single upstream SSE line, and the data of a single event
+	DefaultMaxSSELineBytes = 16 << 20
 )
 
+// DefaultCacheControlModels lists upstream model patterns that support prompt caching breakpoints
+var DefaultCacheControlModels = []string{"anthropic/", "claude", "google/gemini"}
+
+// Tool call repair modes for tool calls and results without a counterpart
+const (
+	ToolCallRepairRepair = "repair"
+	ToolCallRepairDrop   = "drop"
+)
+
+// Web search modes for Anthropic web_search server tools
+const (
+	WebSearchPlugin = "plugin"
+	WebSearchOnline = "online"
+	WebSearchOff    = "off"
+)
+
+// Upstream API formats
+const (
+	UpstreamFormatOpenAI    = "openai"
+	UpstreamFormatAnthropic = "anthropic"
+)
+
+// Token counting modes for the count_tokens endpoint
+const (
+	TokenCountingLocal    = "local"
+	TokenCountingUpstream = "upstream"
+)
+
+// DefaultStrictToolIDModels lists upstream model patterns that require 9-character alphanumeric tool call IDs
+var DefaultStrictToolIDModels = []string{"mistral", "devstral", "codestral"}
+
+// DefaultSchemaProfiles selects built-in tool schema profiles for model families that reject common JSON schema keywords
+var DefaultSchemaProfiles = []SchemaProfile{
+	{Models: []string{"google/gemini", "gemini-"}, Profile: "gemini"},
+}
+
+// SchemaProfile selects how tool input schemas are sanitized for upstream models matching
+// Models (by substring). Profile names a built-in profile, Sanitizers are applied after it,
+// and MaxDepth and MaxEnumValues cap nesting depth and enum size when non-zero.
+type SchemaProfile struct {
+	Models        []string `yaml:"models"`
+	Profile       string   `yaml:"profile,omitempty"`
+	Sanitizers    []string `yaml:"sanitizers,omitempty"`
+	MaxDepth      int      `yaml:"max_depth,omitempty"`
+	MaxEnumValues int      `yaml:"max_enum_values,omitempty"`
+}
+
+// TokenizerTable selects a tokenizer for upstream models matching Models (by substring):
+// a BPE rank table in tiktoken format at Path, or a plain CharsPerToken ratio
+type TokenizerTable struct {
+	Models        []string `yaml:"models"`
+	Path          string   `yaml:"path,omitempty"`
+	CharsPerToken float64  `yaml:"chars_per_token,omitempty"`
+}
+
+// Upstream is a named backend that models can be routed to. APIKey is sent as a bearer
+// token to OpenAI-format upstreams and as x-api-key to Anthropic-format ones, and Headers
+// are added to every request, overriding the defaults. Path replaces the default endpoint
+// path, /v1/chat/completions or /v1/messages depending on Format. OpenRouterExtensions
+// controls whether OpenRouter-only request fields are sent, and defaults to whether
+// BaseURL is OpenRouter's. Environment variables in APIKey and header values are expanded.
+type Upstream struct {
+	BaseURL              string            `yaml:"base_url"`
+	APIKey               string            `yaml:"api_key,omitempty"`
+	Format               string            `yaml:"format,omitempty"`
+	Headers              map[string]string `yaml:"headers,omitempty"`
+	Path                 string            `yaml:"path,omitempty"`
+	OpenRouterExtensions *bool             `yaml:"openrouter_extensions,omitempty"`
+}
+
+// UsesOpenRouterExtensions reports whether the upstream accepts OpenRouter's request
+// extensions: usage accounting, provider routing, reasoning, top_k and plugins
+func (u Upstream) UsesOpenRouterExtensions() bool {
+	if u.OpenRouterExtensions != nil {
+		return *u.OpenRouterExtensions
+	}
+	return strings.Contains(u.BaseURL, "openrouter.ai")
+}
+
 // ProviderConfig holds provider routing configuration
 type ProviderConfig struct {
 	Order          []string `yaml:"order" json:"order"`
@@ -21,31 +107,61 @@ type ProviderConfig struct {
 
 // Config holds the application configuration
 type Config struct {
-	Port            string          `yaml:"port"`
-	APIKey          string          `yaml:"api_key"`
-	BaseURL         string          `yaml:"base_url"`
-	Model           string          `yaml:"model"`
-	OpusModel       string          `yaml:"opus_model,omitempty"`
-	SonnetModel     string          `yaml:"sonnet_model,omitempty"`
-	HaikuModel      string          `yaml:"haiku_model,omitempty"`
-	DefaultProvider *ProviderConfig `yaml:"default_provider,omitempty"`
-	OpusProvider    *ProviderConfig `yaml:"opus_provider,omitempty"`
-	SonnetProvider  *ProviderConfig `yaml:"sonnet_provider,omitempty"`
-	HaikuProvider   *ProviderConfig `yaml:"haiku_provider,omitempty"`
-	LogFormat       string          `yaml:"log_format"`
-	LogLevel        string          `yaml:"log_level,omitempty"`
-	LogFile         string          `yaml:"log_file,omitempty"`
+	Port                  string              `yaml:"port"`
+	APIKey                string              `yaml:"api_key"`
+	BaseURL               string              `yaml:"base_url"`
+	UpstreamFormat        string              `yaml:"upstream_format,omitempty"`
+	OpenRouterExtensions  *bool               `yaml:"openrouter_extensions,omitempty"`
+	Upstreams             map[string]Upstream `yaml:"upstreams,omitempty"`
+	DefaultUpstream       string              `yaml:"default_upstream,omitempty"`
+	OpusUpstream          string              `yaml:"opus_upstream,omitempty"`
+	SonnetUpstream        string              `yaml:"sonnet_upstream,omitempty"`
+	HaikuUpstream         string              `yaml:"haiku_upstream,omitempty"`
+	ModelUpstreams        map[string]string   `yaml:"model_upstreams,omitempty"`
+	Model                 string              `yaml:"model"`
+	OpusModel             string              `yaml:"opus_model,omitempty"`
+	SonnetModel           string              `yaml:"sonnet_model,omitempty"`
+	HaikuModel            string              `yaml:"haiku_model,omitempty"`
+	ModelAliases          map[string]string   `yaml:"model_aliases,omitempty"`
+	ModelCatalog          bool                `yaml:"model_catalog,omitempty"`
+	DefaultProvider       *ProviderConfig     `yaml:"default_provider,omitempty"`
+	OpusProvider          *ProviderConfig     `yaml:"opus_provider,omitempty"`
+	SonnetProvider        *ProviderConfig     `yaml:"sonnet_provider,omitempty"`
+	HaikuProvider         *ProviderConfig     `yaml:"haiku_provider,omitempty"`
+	ToolResultImageModels []string            `yaml:"tool_result_image_models,omitempty"`
+	CacheControlModels    []string            `yaml:"cache_control_models,omitempty"`
+	SchemaProfiles        []SchemaProfile     `yaml:"schema_profiles,omitempty"`
+	StrictToolIDModels    []string            `yaml:"strict_tool_id_models,omitempty"`
+	ToolCallRepair        string              `yaml:"tool_call_repair,omitempty"`
+	WebSearchMode         string              `yaml:"web_search_mode,omitempty"`
+	WebSearchMaxResults   int                 `yaml:"web_search_max_results,omitempty"`
+	TokenCounting         string              `yaml:"token_counting,omitempty"`
+	TokenizerTables       []TokenizerTable    `yaml:"tokenizer_tables,omitempty"`
+	BatchConcurrency      int                 `yaml:"batch_concurrency,omitempty"`
+	MaxSSELineBytes       int                 `yaml:"max_sse_line_bytes,omitempty"`
+	LogFormat             string              `yaml:"log_format"`
+	LogLevel              string              `yaml:"log_level,omitempty"`
+	LogFile               string              `yaml:"log_file,omitempty"`
 }
 
 // New creates a new Config with precedence: env vars > ./athena.yml > ~/.config/athena/athena.yml > defaults
 func New(configPath string) (*Config, error) {
 	// 1. Start with hard-coded defaults
 	cfg := &Config{
-		Port:      DefaultPort,
-		BaseURL:   DefaultBaseURL,
-		Model:     DefaultModelName,
-		LogFormat: "text",
-		LogLevel:  "info",
+		Port:               DefaultPort,
+		BaseURL:            DefaultBaseURL,
+		UpstreamFormat:     UpstreamFormatOpenAI,
+		Model:              DefaultModelName,
+		CacheControlModels: append([]string(nil), DefaultCacheControlModels...),
+		SchemaProfiles:     append([]SchemaProfile(nil), DefaultSchemaProfiles...),
+		StrictToolIDModels: append([]string(nil), DefaultStrictToolIDModels...),
+		ToolCallRepair:     ToolCallRepairRepair,
+		WebSearchMode:      WebSearchPlugin,
+		TokenCounting:      TokenCountingLocal,
+		BatchConcurrency:   DefaultBatchConcurrency,
+		MaxSSELineBytes:    DefaultMaxSSELineBytes,
+		LogFormat:          "text",
+		LogLevel:           "info",
 	}
 
 	// 2. Discover and load config files (if not explicitly provided)
@@ -93,6 +209,13 @@ func New(configPath string) (*Config, error) {
 	if v := os.Getenv("ATHENA_HAIKU_MODEL"); v != "" {
 		cfg.HaikuModel = v
 	}
+	if v := os.Getenv("ATHENA_MAX_SSE_LINE_BYTES"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ATHENA_MAX_SSE_LINE_BYTES %q: %w", v, err)
+		}
+		cfg.MaxSSELineBytes = size
+	}
 	if v := os.Getenv("ATHENA_LOG_FORMAT"); v != "" {
 		cfg.LogFormat = v
 	}
@@ -103,9 +226,102 @@ func New(configPath string) (*Config, error) {
 		cfg.LogFile = v
 	}
 
+	if err := cfg.validateModes(); err != nil {
+		return nil, err
+	}
+	if err := cfg.prepareUpstreams(); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+// validateModes checks that the settings taking a fixed set of values name one of them,
+// and that max_sse_line_bytes is usable
+func (c *Config) validateModes() error {
+	switch c.ToolCallRepair {
+	case "", ToolCallRepairRepair, ToolCallRepairDrop:
+	default:
+		return fmt.Errorf("unknown tool_call_repair %q", c.ToolCallRepair)
+	}
+	switch c.WebSearchMode {
+	case "", WebSearchPlugin, WebSearchOnline, WebSearchOff:
+	default:
+		return fmt.Errorf("unknown web_search_mode %q", c.WebSearchMode)
+	}
+	switch c.TokenCounting {
+	case "", TokenCountingLocal, TokenCountingUpstream:
+	default:
+		return fmt.Errorf("unknown token_counting %q", c.TokenCounting)
+	}
+	if c.MaxSSELineBytes < 0 {
+		return fmt.Errorf("max_sse_line_bytes must not be negative, got %d", c.MaxSSELineBytes)
+	}
+	return nil
+}
+
+// prepareUpstreams expands environment variables in upstream credentials and checks that
+// every upstream is usable and every upstream reference names one
+func (c *Config) prepareUpstreams() error {
+	switch c.UpstreamFormat {
+	case "", UpstreamFormatOpenAI, UpstreamFormatAnthropic:
+	default:
+		return fmt.Errorf("unknown upstream_format %q", c.UpstreamFormat)
+	}
+
+	for name, upstream := range c.Upstreams {
+		if upstream.BaseURL == "" {
+			return fmt.Errorf("upstream %q has no base_url", name)
+		}
+		switch upstream.Format {
+		case "", UpstreamFormatOpenAI, UpstreamFormatAnthropic:
+		default:
+			return fmt.Errorf("upstream %q has unknown format %q", name, upstream.Format)
+		}
+
+		upstream.APIKey = os.ExpandEnv(upstream.APIKey)
+		headers := make(map[string]string, len(upstream.Headers))
+		for key, value := range upstream.Headers {
+			headers[key] = os.ExpandEnv(value)
+		}
+		upstream.Headers = headers
+		c.Upstreams[name] = upstream
+	}
+
+	references := map[string]string{
+		"default_upstream": c.DefaultUpstream,
+		"opus_upstream":    c.OpusUpstream,
+		"sonnet_upstream":  c.SonnetUpstream,
+		"haiku_upstream":   c.HaikuUpstream,
+	}
+	for model, name := range c.ModelUpstreams {
+		references["model_upstreams."+model] = name
+	}
+	for field, name := range references {
+		if _, ok := c.Upstreams[name]; name != "" && !ok {
+			return fmt.Errorf("%s refers to unknown upstream %q", field, name)
+		}
+	}
+	return nil
+}
+
+// ResolveUpstream returns the named upstream, or the top-level base_url, api_key and
+// upstream_format when name is empty. The top-level upstream sends OpenRouter's
+// extensions unless openrouter_extensions is false.
+func (c *Config) ResolveUpstream(name string) (Upstream, bool) {
+	if name == "" {
+		extensions := c.OpenRouterExtensions == nil || *c.OpenRouterExtensions
+		return Upstream{
+			BaseURL:              c.BaseURL,
+			APIKey:               c.APIKey,
+			Format:               c.UpstreamFormat,
+			OpenRouterExtensions: &extensions,
+		}, true
+	}
+	upstream, ok := c.Upstreams[name]
+	return upstream, ok
+}
+
 // discoverConfigFiles returns a list of config file paths in priority order
 // Priority: ~/.config/athena/athena.yml (global) → ./athena.yml (local)
 func discoverConfigFiles() []string {
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -48,6 +49,33 @@ func TestNew_Defaults(t *testing.T) {
 	if cfg.HaikuModel != "" {
 		t.Errorf("Default haiku model should be empty, got %q", cfg.HaikuModel)
 	}
+	if len(cfg.CacheControlModels) != len(DefaultCacheControlModels) {
+		t.Errorf("Default cache control models = %v, expected %v", cfg.CacheControlModels, DefaultCacheControlModels)
+	}
+	if len(cfg.SchemaProfiles) != len(DefaultSchemaProfiles) {
+		t.Errorf("Default schema profiles = %v, expected %v", cfg.SchemaProfiles, DefaultSchemaProfiles)
+	}
+	if cfg.ToolCallRepair != ToolCallRepairRepair {
+		t.Errorf("Default tool call repair = %q, expected %q", cfg.ToolCallRepair, ToolCallRepairRepair)
+	}
+	if cfg.WebSearchMode != WebSearchPlugin {
+		t.Errorf("Default web search mode = %q, expected %q", cfg.WebSearchMode, WebSearchPlugin)
+	}
+	if cfg.TokenCounting != TokenCountingLocal {
+		t.Errorf("Default token counting = %q, expected %q", cfg.TokenCounting, TokenCountingLocal)
+	}
+	if cfg.UpstreamFormat != UpstreamFormatOpenAI {
+		t.Errorf("Default upstream format = %q, expected %q", cfg.UpstreamFormat, UpstreamFormatOpenAI)
+	}
+	if cfg.BatchConcurrency != DefaultBatchConcurrency {
+		t.Errorf("Default batch concurrency = %d, expected %d", cfg.BatchConcurrency, DefaultBatchConcurrency)
+	}
+	if cfg.MaxSSELineBytes != DefaultMaxSSELineBytes {
+		t.Errorf("Default max SSE line bytes = %d, expected %d", cfg.MaxSSELineBytes, DefaultMaxSSELineBytes)
+	}
+	if len(cfg.StrictToolIDModels) != len(DefaultStrictToolIDModels) {
+		t.Errorf("Default strict tool ID models = %v, expected %v", cfg.StrictToolIDModels, DefaultStrictToolIDModels)
+	}
 }
 
 func TestNew_EnvVars(t *testing.T) {
@@ -59,6 +87,7 @@ func TestNew_EnvVars(t *testing.T) {
 	os.Setenv("ATHENA_OPUS_MODEL", "custom/opus")
 	os.Setenv("ATHENA_SONNET_MODEL", "custom/sonnet")
 	os.Setenv("ATHENA_HAIKU_MODEL", "custom/haiku")
+	os.Setenv("ATHENA_MAX_SSE_LINE_BYTES", "1048576")
 
 	defer func() {
 		os.Unsetenv("ATHENA_PORT")
@@ -68,6 +97,7 @@ func TestNew_EnvVars(t *testing.T) {
 		os.Unsetenv("ATHENA_OPUS_MODEL")
 		os.Unsetenv("ATHENA_SONNET_MODEL")
 		os.Unsetenv("ATHENA_HAIKU_MODEL")
+		os.Unsetenv("ATHENA_MAX_SSE_LINE_BYTES")
 	}()
 
 	cfg, err := New("")
@@ -96,6 +126,9 @@ func TestNew_EnvVars(t *testing.T) {
 	if cfg.HaikuModel != "custom/haiku" {
 		t.Errorf("Env haiku model = %q, expected %q", cfg.HaikuModel, "custom/haiku")
 	}
+	if cfg.MaxSSELineBytes != 1048576 {
+		t.Errorf("Env max SSE line bytes = %d, expected %d", cfg.MaxSSELineBytes, 1048576)
+	}
 }
 
 func TestNew_YAMLFile(t *testing.T) {
@@ -518,3 +551,131 @@ model: "file/model"
 		t.Errorf("Model = %q, expected file value %q", cfg.Model, "file/model")
 	}
 }
+
+func TestNew_YAMLWithUpstreams(t *testing.T) {
+	tmpDir := t.TempDir()
+	yamlPath := filepath.Join(tmpDir, "upstreams.yml")
+
+	yamlContent := `model: "moonshotai/kimi-k2-0905"
+upstreams:
+  anthropic:
+    base_url: "https://api.anthropic.com"
+    api_key: "${TEST_ATHENA_ANTHROPIC_KEY}"
+    format: anthropic
+  vllm:
+    base_url: "http://vllm.internal:8000"
+    path: "/v1/chat/completions"
+    headers:
+      X-Team: "evals"
+opus_upstream: anthropic
+model_upstreams:
+  internal: vllm
+`
+	if err := os.WriteFile(yamlPath, []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("Failed to write test YAML file: %v", err)
+	}
+	t.Setenv("TEST_ATHENA_ANTHROPIC_KEY", "sk-ant-test")
+
+	cfg, err := New(yamlPath)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+
+	anthropic, ok := cfg.ResolveUpstream("anthropic")
+	if !ok || anthropic.APIKey != "sk-ant-test" || anthropic.Format != UpstreamFormatAnthropic {
+		t.Errorf("anthropic upstream = %+v, expected the expanded API key", anthropic)
+	}
+	vllm, ok := cfg.ResolveUpstream("vllm")
+	if !ok || vllm.Headers["X-Team"] != "evals" || vllm.Path != "/v1/chat/completions" {
+		t.Errorf("vllm upstream = %+v", vllm)
+	}
+	if cfg.OpusUpstream != "anthropic" || cfg.ModelUpstreams["internal"] != "vllm" {
+		t.Errorf("Upstream selection = opus %q, internal %q", cfg.OpusUpstream, cfg.ModelUpstreams["internal"])
+	}
+
+	fallback, ok := cfg.ResolveUpstream("")
+	if !ok || fallback.BaseURL != DefaultBaseURL || fallback.Format != UpstreamFormatOpenAI {
+		t.Errorf("Top-level upstream = %+v", fallback)
+	}
+	if _, ok := cfg.ResolveUpstream("missing"); ok {
+		t.Error("Expected an unknown upstream not to resolve")
+	}
+}
+
+func TestUpstream_UsesOpenRouterExtensions(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name     string
+		upstream Upstream
+		expected bool
+	}{
+		{name: "openrouter base url", upstream: Upstream{BaseURL: "https://openrouter.ai/api"}, expected: true},
+		{name: "other base url", upstream: Upstream{BaseURL: "http://localhost:11434"}, expected: false},
+		{name: "opted in", upstream: Upstream{BaseURL: "http://proxy.internal", OpenRouterExtensions: &enabled}, expected: true},
+		{name: "opted out", upstream: Upstream{BaseURL: "https://openrouter.ai/api", OpenRouterExtensions: &disabled}, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.upstream.UsesOpenRouterExtensions(); got != tt.expected {
+				t.Errorf("UsesOpenRouterExtensions() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+
+	// The top-level upstream keeps them unless turned off
+	cfg := &Config{BaseURL: "http://localhost:8000"}
+	if top, _ := cfg.ResolveUpstream(""); !top.UsesOpenRouterExtensions() {
+		t.Error("Expected the top-level upstream to use OpenRouter extensions by default")
+	}
+	cfg.OpenRouterExtensions = &disabled
+	if top, _ := cfg.ResolveUpstream(""); top.UsesOpenRouterExtensions() {
+		t.Error("Expected openrouter_extensions: false to turn them off")
+	}
+}
+
+func TestNew_InvalidModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "unknown tool_call_repair", content: "tool_call_repair: fix\n"},
+		{name: "unknown web_search_mode", content: "web_search_mode: exa\n"},
+		{name: "unknown token_counting", content: "token_counting: exact\n"},
+		{name: "max_sse_line_bytes", content: "max_sse_line_bytes: -1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlPath := filepath.Join(t.TempDir(), "athena.yml")
+			if err := os.WriteFile(yamlPath, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write test YAML file: %v", err)
+			}
+			if _, err := New(yamlPath); err == nil || !strings.Contains(err.Error(), tt.name) {
+				t.Errorf("New() error = %v, expected %q", err, tt.name)
+			}
+		})
+	}
+}
+
+func TestNew_InvalidUpstreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "missing base_url", content: "upstreams:\n  local:\n    format: openai\n"},
+		{name: "unknown format", content: "upstreams:\n  local:\n    base_url: \"http://localhost\"\n    format: gemini\n"},
+		{name: "unknown top-level format", content: "upstream_format: gemini\n"},
+		{name: "unknown family upstream", content: "haiku_upstream: ollama\n"},
+		{name: "unknown model upstream", content: "model_upstreams:\n  internal: vllm\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlPath := filepath.Join(t.TempDir(), "athena.yml")
+			if err := os.WriteFile(yamlPath, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write test YAML file: %v", err)
+			}
+			if _, err := New(yamlPath); err == nil {
+				t.Error("Expected an error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,698 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"athena/internal/config"
+	"athena/internal/daemon"
+	"athena/internal/transform"
+	"athena/internal/util"
+)
+
+const (
+	// batchesDir holds one directory per batch in the data directory
+	batchesDir = "batches"
+	// batchFile, batchRequestsFile and batchResultsFile are the files in a batch directory
+	batchFile         = "batch.json"
+	batchRequestsFile = "requests.jsonl"
+	batchResultsFile  = "results.jsonl"
+	// batchExpiry is how long a batch may run before its remaining requests expire, as in the Anthropic API
+	batchExpiry = 24 * time.Hour
+	// maxBatchRequests is the largest batch the Anthropic API accepts
+	maxBatchRequests = 100000
+	// batchRequestTimeout bounds a single upstream request so a stalled one cannot hold a slot
+	batchRequestTimeout = 10 * time.Minute
+)
+
+// Batch processing statuses
+const (
+	BatchStatusInProgress = "in_progress"
+	BatchStatusCanceling  = "canceling"
+	BatchStatusEnded      = "ended"
+)
+
+// Batch result types
+const (
+	BatchResultSucceeded = "succeeded"
+	BatchResultErrored   = "errored"
+	BatchResultCanceled  = "canceled"
+	BatchResultExpired   = "expired"
+)
+
+// MessageBatch is an Anthropic message batch object
+type MessageBatch struct {
+	ID                string             `json:"id"`
+	Type              string             `json:"type"`
+	ProcessingStatus  string             `json:"processing_status"`
+	RequestCounts     BatchRequestCounts `json:"request_counts"`
+	CreatedAt         time.Time          `json:"created_at"`
+	ExpiresAt         time.Time          `json:"expires_at"`
+	EndedAt           *time.Time         `json:"ended_at"`
+	ArchivedAt        *time.Time         `json:"archived_at"`
+	CancelInitiatedAt *time.Time         `json:"cancel_initiated_at"`
+	ResultsURL        *string            `json:"results_url"`
+}
+
+// BatchRequestCounts tallies a batch's requests by state
+type BatchRequestCounts struct {
+	Processing int `json:"processing"`
+	Succeeded  int `json:"succeeded"`
+	Errored    int `json:"errored"`
+	Canceled   int `json:"canceled"`
+	Expired    int `json:"expired"`
+}
+
+// BatchRequest is one request of a batch, a Messages request body under a caller-chosen ID
+type BatchRequest struct {
+	CustomID string          `json:"custom_id"`
+	Params   json.RawMessage `json:"params"`
+}
+
+// BatchResult is one line of a batch's results
+type BatchResult struct {
+	CustomID string          `json:"custom_id"`
+	Result   BatchResultBody `json:"result"`
+}
+
+// BatchResultBody is the outcome of a batch request. Message is set when it succeeded
+// and Error holds the Anthropic error envelope when it errored.
+type BatchResultBody struct {
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Error   json.RawMessage `json:"error,omitempty"`
+}
+
+// batchManager persists Message Batches under the data directory and runs their requests
+// upstream, at most cap(sem) at a time across all batches
+type batchManager struct {
+	mu      sync.Mutex
+	dir     string
+	loaded  bool
+	batches map[string]*MessageBatch
+	sem     chan struct{}
+	send    func(ctx context.Context, params json.RawMessage) BatchResultBody
+	running sync.WaitGroup
+}
+
+// newBatchManager creates a batch manager that sends requests with send
+func newBatchManager(concurrency int, send func(context.Context, json.RawMessage) BatchResultBody) *batchManager {
+	if concurrency <= 0 {
+		concurrency = config.DefaultBatchConcurrency
+	}
+	return &batchManager{
+		batches: map[string]*MessageBatch{},
+		sem:     make(chan struct{}, concurrency),
+		send:    send,
+	}
+}
+
+// handleBatches serves the Message Batches API under /v1/messages/batches
+func (s *Server) handleBatches(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/messages/batches"), "/"), "/")
+
+	switch {
+	case parts[0] == "" && r.Method == "POST":
+		s.createBatch(w, r)
+	case parts[0] == "" && r.Method == "GET":
+		batches, err := s.batches.list()
+		if err != nil {
+			transform.WriteError(w, http.StatusInternalServerError, "Failed to load batches")
+			return
+		}
+		for i := range batches {
+			batches[i] = withResultsURL(r, batches[i])
+		}
+		page, err := paginate(batches, func(batch MessageBatch) string { return batch.ID }, r.URL.Query())
+		if err != nil {
+			transform.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, page)
+	case len(parts) == 1 && r.Method == "GET":
+		batch, ok := s.batches.get(parts[0])
+		if !ok {
+			transform.WriteError(w, http.StatusNotFound, "Batch not found: "+parts[0])
+			return
+		}
+		writeJSON(w, withResultsURL(r, batch))
+	case len(parts) == 2 && parts[1] == "cancel" && r.Method == "POST":
+		batch, ok := s.batches.cancel(parts[0])
+		if !ok {
+			transform.WriteError(w, http.StatusNotFound, "Batch not found: "+parts[0])
+			return
+		}
+		writeJSON(w, withResultsURL(r, batch))
+	case len(parts) == 2 && parts[1] == "results" && r.Method == "GET":
+		s.writeBatchResults(w, parts[0])
+	case len(parts) <= 2:
+		transform.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	default:
+		transform.WriteError(w, http.StatusNotFound, "Not found: "+r.URL.Path)
+	}
+}
+
+// createBatch validates a batch create body, persists the batch and starts running it
+func (s *Server) createBatch(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Requests []BatchRequest `json:"requests"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		transform.WriteError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	if len(body.Requests) == 0 || len(body.Requests) > maxBatchRequests {
+		transform.WriteError(w, http.StatusBadRequest, fmt.Sprintf("requests must contain between 1 and %d items", maxBatchRequests))
+		return
+	}
+	seen := map[string]bool{}
+	for i, item := range body.Requests {
+		if item.CustomID == "" || seen[item.CustomID] {
+			transform.WriteError(w, http.StatusBadRequest, fmt.Sprintf("requests.%d.custom_id must be a unique, non-empty string", i))
+			return
+		}
+		seen[item.CustomID] = true
+
+		var params transform.AnthropicRequest
+		if err := json.Unmarshal(item.Params, &params); err != nil {
+			transform.WriteError(w, http.StatusBadRequest, fmt.Sprintf("requests.%d.params: %v", i, err))
+			return
+		}
+	}
+
+	batch, err := s.batches.create(body.Requests)
+	if err != nil {
+		slog.Error("failed to create batch", "error", err)
+		transform.WriteError(w, http.StatusInternalServerError, "Failed to create batch")
+		return
+	}
+	writeJSON(w, withResultsURL(r, batch))
+}
+
+// writeBatchResults streams an ended batch's results as JSONL
+func (s *Server) writeBatchResults(w http.ResponseWriter, id string) {
+	batch, ok := s.batches.get(id)
+	if !ok {
+		transform.WriteError(w, http.StatusNotFound, "Batch not found: "+id)
+		return
+	}
+	if batch.ProcessingStatus != BatchStatusEnded {
+		transform.WriteError(w, http.StatusBadRequest, "Batch "+id+" is still processing; results are available once it has ended")
+		return
+	}
+
+	results, err := os.ReadFile(filepath.Join(s.batches.dir, id, batchResultsFile))
+	if err != nil && !os.IsNotExist(err) {
+		transform.WriteError(w, http.StatusInternalServerError, "Failed to read batch results")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-jsonl")
+	_, _ = w.Write(results)
+}
+
+// withResultsURL sets the results URL of an ended batch, relative to the host the client used
+func withResultsURL(r *http.Request, batch MessageBatch) MessageBatch {
+	if batch.ProcessingStatus == BatchStatusEnded {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		resultsURL := scheme + "://" + r.Host + "/v1/messages/batches/" + batch.ID + "/results"
+		batch.ResultsURL = &resultsURL
+	}
+	return batch
+}
+
+// sendBatchRequest runs one batch request through the Messages translation path and
+// captures its response as a batch result
+func (s *Server) sendBatchRequest(ctx context.Context, params json.RawMessage) BatchResultBody {
+	var req transform.AnthropicRequest
+	if err := json.Unmarshal(params, &req); err != nil {
+		return erroredResult(http.StatusBadRequest, "Invalid params: "+err.Error())
+	}
+	req.Stream = false
+	req.RequestID = newRequestID()
+	body, err := replaceJSONField(params, "stream", false)
+	if err != nil {
+		return erroredResult(http.StatusBadRequest, "Invalid params: "+err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, batchRequestTimeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, "POST", "/v1/messages", nil)
+	if err != nil {
+		return erroredResult(http.StatusInternalServerError, "Failed to create request")
+	}
+
+	resp := newResponseBuffer()
+	s.forwardMessage(resp, r, req, body)
+
+	result := bytes.TrimSpace(resp.body.Bytes())
+	if !json.Valid(result) {
+		return erroredResult(http.StatusBadGateway, "Invalid response from upstream")
+	}
+	if resp.status != http.StatusOK {
+		return BatchResultBody{Type: BatchResultErrored, Error: result}
+	}
+	return BatchResultBody{Type: BatchResultSucceeded, Message: result}
+}
+
+// erroredResult builds an errored batch result with an Anthropic error envelope
+func erroredResult(status int, message string) BatchResultBody {
+	resp := newResponseBuffer()
+	transform.WriteError(resp, status, message)
+	return BatchResultBody{Type: BatchResultErrored, Error: bytes.TrimSpace(resp.body.Bytes())}
+}
+
+// responseBuffer is an http.ResponseWriter that keeps the response in memory
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// newResponseBuffer creates an empty responseBuffer with a 200 status
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: http.Header{}, status: http.StatusOK}
+}
+
+// Header returns the response headers
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+// Write appends to the response body
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// WriteHeader records the response status
+func (b *responseBuffer) WriteHeader(status int) {
+	b.status = status
+}
+
+// load reads the persisted batches on first use. The caller must hold m.mu.
+func (m *batchManager) load() error {
+	if m.loaded {
+		return nil
+	}
+
+	dataDir, err := daemon.GetDataDir()
+	if err != nil {
+		return err
+	}
+	m.dir = filepath.Join(dataDir, batchesDir)
+
+	entries, err := os.ReadDir(m.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		var batch MessageBatch
+		if err := util.ReadJSONFile(filepath.Join(m.dir, entry.Name(), batchFile), &batch); err != nil {
+			slog.Warn("skipping unreadable batch", "batch_id", entry.Name(), "error", err)
+			continue
+		}
+		m.batches[batch.ID] = &batch
+	}
+	m.loaded = true
+	return nil
+}
+
+// save persists a batch's metadata. The caller must hold m.mu.
+func (m *batchManager) save(batch *MessageBatch) {
+	if err := util.WriteJSONFile(filepath.Join(m.dir, batch.ID, batchFile), batch); err != nil {
+		slog.Error("failed to save batch", "batch_id", batch.ID, "error", err)
+	}
+}
+
+// create persists a new batch and starts running it
+func (m *batchManager) create(requests []BatchRequest) (MessageBatch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.load(); err != nil {
+		return MessageBatch{}, err
+	}
+
+	now := time.Now().UTC()
+	batch := &MessageBatch{
+		ID:               newBatchID(),
+		Type:             "message_batch",
+		ProcessingStatus: BatchStatusInProgress,
+		RequestCounts:    BatchRequestCounts{Processing: len(requests)},
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(batchExpiry),
+	}
+
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, item := range requests {
+		if err := encoder.Encode(item); err != nil {
+			return MessageBatch{}, err
+		}
+	}
+	dir := filepath.Join(m.dir, batch.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return MessageBatch{}, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, batchRequestsFile), lines.Bytes(), 0600); err != nil {
+		return MessageBatch{}, err
+	}
+	if err := util.WriteJSONFile(filepath.Join(dir, batchFile), batch); err != nil {
+		return MessageBatch{}, err
+	}
+	m.batches[batch.ID] = batch
+
+	slog.Info("batch created", "batch_id", batch.ID, "requests", len(requests))
+
+	m.running.Add(1)
+	go m.run(batch.ID)
+	return *batch, nil
+}
+
+// resume restarts the batches that had not ended when the daemon last stopped
+func (m *batchManager) resume() {
+	m.mu.Lock()
+	if err := m.load(); err != nil {
+		m.mu.Unlock()
+		slog.Error("failed to load batches", "error", err)
+		return
+	}
+	var unfinished []string
+	for id, batch := range m.batches {
+		if batch.ProcessingStatus != BatchStatusEnded {
+			unfinished = append(unfinished, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range unfinished {
+		slog.Info("resuming batch", "batch_id", id)
+		m.running.Add(1)
+		go m.run(id)
+	}
+}
+
+// list returns all batches, newest first
+func (m *batchManager) list() ([]MessageBatch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	batches := make([]MessageBatch, 0, len(m.batches))
+	for _, batch := range m.batches {
+		batches = append(batches, *batch)
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		if batches[i].CreatedAt.Equal(batches[j].CreatedAt) {
+			return batches[i].ID > batches[j].ID
+		}
+		return batches[i].CreatedAt.After(batches[j].CreatedAt)
+	})
+	return batches, nil
+}
+
+// get returns a copy of a batch
+func (m *batchManager) get(id string) (MessageBatch, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.load(); err != nil {
+		slog.Error("failed to load batches", "error", err)
+		return MessageBatch{}, false
+	}
+	batch, ok := m.batches[id]
+	if !ok {
+		return MessageBatch{}, false
+	}
+	return *batch, true
+}
+
+// cancel stops a batch from sending further requests. Requests already sent upstream
+// finish, and the rest are recorded as canceled once they have.
+func (m *batchManager) cancel(id string) (MessageBatch, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.load(); err != nil {
+		slog.Error("failed to load batches", "error", err)
+		return MessageBatch{}, false
+	}
+	batch, ok := m.batches[id]
+	if !ok {
+		return MessageBatch{}, false
+	}
+	if batch.ProcessingStatus == BatchStatusInProgress {
+		now := time.Now().UTC()
+		batch.ProcessingStatus = BatchStatusCanceling
+		batch.CancelInitiatedAt = &now
+		m.save(batch)
+		slog.Info("batch canceling", "batch_id", id)
+	}
+	return *batch, true
+}
+
+// run sends a batch's outstanding requests and ends the batch once every request has a
+// result. Requests with a result from before a restart are not sent again.
+func (m *batchManager) run(id string) {
+	defer m.running.Done()
+
+	dir := filepath.Join(m.dir, id)
+	requests, err := readBatchRequests(filepath.Join(dir, batchRequestsFile))
+	if err != nil {
+		slog.Error("failed to read batch requests", "batch_id", id, "error", err)
+		m.finish(id)
+		return
+	}
+	results, err := readBatchResults(filepath.Join(dir, batchResultsFile))
+	if err != nil {
+		slog.Error("failed to read batch results", "batch_id", id, "error", err)
+		m.finish(id)
+		return
+	}
+
+	out, err := os.OpenFile(filepath.Join(dir, batchResultsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("failed to open batch results", "batch_id", id, "error", err)
+		m.finish(id)
+		return
+	}
+	defer out.Close()
+
+	// Counts are rebuilt from the results file, which is written before the metadata
+	done := map[string]bool{}
+	counts := BatchRequestCounts{}
+	for _, result := range results {
+		if !done[result.CustomID] {
+			done[result.CustomID] = true
+			countResult(&counts, result.Result.Type)
+		}
+	}
+	counts.Processing = len(requests) - len(done)
+	m.mu.Lock()
+	m.batches[id].RequestCounts = counts
+	m.save(m.batches[id])
+	m.mu.Unlock()
+
+	var sending sync.WaitGroup
+	sent := map[string]bool{}
+	for _, item := range requests {
+		if done[item.CustomID] {
+			continue
+		}
+		m.sem <- struct{}{}
+		if _, ok := m.stopReason(id); ok {
+			<-m.sem
+			break
+		}
+
+		sent[item.CustomID] = true
+		sending.Add(1)
+		go func(item BatchRequest) {
+			defer sending.Done()
+			result := m.sendRecovered(item)
+			<-m.sem
+			m.record(id, out, BatchResult{CustomID: item.CustomID, Result: result})
+		}(item)
+	}
+	sending.Wait()
+
+	// Requests never sent were canceled, or the batch ran out of time
+	if reason, ok := m.stopReason(id); ok {
+		for _, item := range requests {
+			if !done[item.CustomID] && !sent[item.CustomID] {
+				m.record(id, out, BatchResult{CustomID: item.CustomID, Result: BatchResultBody{Type: reason}})
+			}
+		}
+	}
+	m.finish(id)
+}
+
+// sendRecovered sends one batch request, recording a panic while handling it as an
+// errored result instead of taking down the daemon and every batch in flight
+func (m *batchManager) sendRecovered(item BatchRequest) (result BatchResultBody) {
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error("panic handling batch request",
+				"custom_id", item.CustomID,
+				"error", err,
+				"stack", string(debug.Stack()),
+			)
+			result = erroredResult(http.StatusInternalServerError, "Internal server error")
+		}
+	}()
+	return m.send(context.Background(), item.Params)
+}
+
+// stopReason reports whether a batch should send no more requests, and the result type
+// for the requests left unsent
+func (m *batchManager) stopReason(id string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	batch := m.batches[id]
+	if batch.ProcessingStatus == BatchStatusCanceling {
+		return BatchResultCanceled, true
+	}
+	if time.Now().After(batch.ExpiresAt) {
+		return BatchResultExpired, true
+	}
+	return "", false
+}
+
+// record appends a result to the batch's results file and updates its counts
+func (m *batchManager) record(id string, out *os.File, result BatchResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	line, err := json.Marshal(result)
+	if err == nil {
+		_, err = out.Write(append(line, '\n'))
+	}
+	if err != nil {
+		slog.Error("failed to write batch result", "batch_id", id, "custom_id", result.CustomID, "error", err)
+	}
+
+	batch := m.batches[id]
+	batch.RequestCounts.Processing--
+	countResult(&batch.RequestCounts, result.Result.Type)
+	m.save(batch)
+}
+
+// finish marks a batch as ended
+func (m *batchManager) finish(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	batch := m.batches[id]
+	now := time.Now().UTC()
+	batch.ProcessingStatus = BatchStatusEnded
+	batch.EndedAt = &now
+	m.save(batch)
+
+	slog.Info("batch ended",
+		"batch_id", id,
+		"succeeded", batch.RequestCounts.Succeeded,
+		"errored", batch.RequestCounts.Errored,
+		"canceled", batch.RequestCounts.Canceled,
+		"expired", batch.RequestCounts.Expired,
+	)
+}
+
+// countResult counts one result of the given type
+func countResult(counts *BatchRequestCounts, resultType string) {
+	switch resultType {
+	case BatchResultSucceeded:
+		counts.Succeeded++
+	case BatchResultErrored:
+		counts.Errored++
+	case BatchResultCanceled:
+		counts.Canceled++
+	case BatchResultExpired:
+		counts.Expired++
+	}
+}
+
+// readBatchRequests reads a batch's requests file
+func readBatchRequests(path string) ([]BatchRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requests []BatchRequest
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for decoder.More() {
+		var item BatchRequest
+		if err := decoder.Decode(&item); err != nil {
+			return nil, err
+		}
+		requests = append(requests, item)
+	}
+	return requests, nil
+}
+
+// readBatchResults reads a batch's results file. A line cut short by a crash is dropped
+// from the file so its request is sent again.
+func readBatchResults(path string) ([]BatchResult, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var results []BatchResult
+	var valid bytes.Buffer
+	truncated := false
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var result BatchResult
+		if err := json.Unmarshal(line, &result); err != nil || result.CustomID == "" {
+			truncated = true
+			continue
+		}
+		results = append(results, result)
+		valid.Write(line)
+		valid.WriteByte('\n')
+	}
+
+	if truncated {
+		if err := os.WriteFile(path, valid.Bytes(), 0600); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// newBatchID returns a unique message batch ID
+func newBatchID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "msgbatch_" + hex.EncodeToString(b)
+}
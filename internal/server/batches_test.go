@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"athena/internal/config"
+	"athena/internal/daemon"
+)
+
+// useTempDataDir points daemon.GetDataDir at a temporary directory for the test
+func useTempDataDir(t *testing.T) string {
+	t.Helper()
+	dataDir := t.TempDir()
+	original := daemon.GetDataDir
+	daemon.GetDataDir = func() (string, error) { return dataDir, nil }
+	t.Cleanup(func() { daemon.GetDataDir = original })
+	return dataDir
+}
+
+// chatCompletionServer answers chat completions with the request's last message echoed
+// back, or a 400 for the model "bad/model"
+func chatCompletionServer(t *testing.T, calls *int, mu *sync.Mutex) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model    string `json:"model"`
+			Messages []struct {
+				Content interface{} `json:"content"`
+			} `json:"messages"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		*calls++
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if req.Model == "bad/model" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"message":"unknown model","code":400}}`))
+			return
+		}
+		content, _ := json.Marshal(req.Messages[len(req.Messages)-1].Content)
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","model":"` + req.Model + `","choices":[{"index":0,
+			"message":{"role":"assistant","content":` + string(content) + `},"finish_reason":"stop"}],
+			"usage":{"prompt_tokens":5,"completion_tokens":2}}`))
+	}))
+}
+
+func doBatchRequest(t *testing.T, srv *Server, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.handleBatches(w, req)
+	return w
+}
+
+func decodeBatch(t *testing.T, w *httptest.ResponseRecorder) MessageBatch {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code = %d, body %s", w.Code, w.Body.String())
+	}
+	var batch MessageBatch
+	if err := json.NewDecoder(w.Body).Decode(&batch); err != nil {
+		t.Fatalf("Failed to decode batch: %v", err)
+	}
+	return batch
+}
+
+func readResults(t *testing.T, srv *Server, id string) map[string]BatchResultBody {
+	t.Helper()
+	w := doBatchRequest(t, srv, "GET", "/v1/messages/batches/"+id+"/results", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Results status code = %d, body %s", w.Code, w.Body.String())
+	}
+	results := map[string]BatchResultBody{}
+	for _, line := range bytes.Split(bytes.TrimSpace(w.Body.Bytes()), []byte("\n")) {
+		var result BatchResult
+		if err := json.Unmarshal(line, &result); err != nil {
+			t.Fatalf("Invalid results line %q: %v", line, err)
+		}
+		results[result.CustomID] = result.Result
+	}
+	return results
+}
+
+func TestHandleBatches_CreateAndResults(t *testing.T) {
+	useTempDataDir(t)
+	var mu sync.Mutex
+	calls := 0
+	openRouterServer := chatCompletionServer(t, &calls, &mu)
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "test/model", BatchConcurrency: 2})
+	w := doBatchRequest(t, srv, "POST", "/v1/messages/batches", `{"requests":[
+		{"custom_id":"first","params":{"model":"claude-sonnet-4","max_tokens":10,"messages":[{"role":"user","content":"one"}]}},
+		{"custom_id":"second","params":{"model":"claude-sonnet-4","max_tokens":10,"stream":true,"messages":[{"role":"user","content":"two"}]}},
+		{"custom_id":"third","params":{"model":"bad/model","max_tokens":10,"messages":[{"role":"user","content":"three"}]}}
+	]}`)
+	batch := decodeBatch(t, w)
+	if !strings.HasPrefix(batch.ID, "msgbatch_") || batch.Type != "message_batch" || batch.ProcessingStatus != BatchStatusInProgress {
+		t.Errorf("Created batch = %+v", batch)
+	}
+	if batch.RequestCounts.Processing != 3 || batch.ResultsURL != nil {
+		t.Errorf("Created batch counts = %+v, results URL %v", batch.RequestCounts, batch.ResultsURL)
+	}
+	if !batch.ExpiresAt.Equal(batch.CreatedAt.Add(batchExpiry)) {
+		t.Errorf("Expires at %v, expected a day after %v", batch.ExpiresAt, batch.CreatedAt)
+	}
+
+	srv.batches.running.Wait()
+
+	batch = decodeBatch(t, doBatchRequest(t, srv, "GET", "/v1/messages/batches/"+batch.ID, ""))
+	expectedCounts := BatchRequestCounts{Succeeded: 2, Errored: 1}
+	if batch.ProcessingStatus != BatchStatusEnded || batch.RequestCounts != expectedCounts || batch.EndedAt == nil {
+		t.Errorf("Ended batch = %+v", batch)
+	}
+	if batch.ResultsURL == nil || *batch.ResultsURL != "http://example.com/v1/messages/batches/"+batch.ID+"/results" {
+		t.Errorf("Results URL = %v", batch.ResultsURL)
+	}
+
+	results := readResults(t, srv, batch.ID)
+	var message map[string]interface{}
+	if err := json.Unmarshal(results["second"].Message, &message); err != nil || results["second"].Type != BatchResultSucceeded {
+		t.Fatalf("Second result = %+v (%v)", results["second"], err)
+	}
+	if message["type"] != "message" || !strings.Contains(string(results["second"].Message), `"text":"two"`) {
+		t.Errorf("Second message = %s", results["second"].Message)
+	}
+	if results["third"].Type != BatchResultErrored || !strings.Contains(string(results["third"].Error), `"invalid_request_error"`) {
+		t.Errorf("Third result = %+v, error %s", results["third"], results["third"].Error)
+	}
+	if calls != 3 {
+		t.Errorf("Upstream calls = %d, expected 3", calls)
+	}
+}
+
+func TestBatchManager_PanicIsErroredResult(t *testing.T) {
+	useTempDataDir(t)
+	srv := New(&config.Config{Model: "test/model"})
+	srv.batches.send = func(_ context.Context, params json.RawMessage) BatchResultBody {
+		if strings.Contains(string(params), "boom") {
+			panic("translation failed")
+		}
+		return BatchResultBody{Type: BatchResultSucceeded, Message: json.RawMessage(`{"type":"message"}`)}
+	}
+
+	batch := decodeBatch(t, doBatchRequest(t, srv, "POST", "/v1/messages/batches", `{"requests":[
+		{"custom_id":"ok","params":{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"fine"}]}},
+		{"custom_id":"bad","params":{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"boom"}]}}
+	]}`))
+	srv.batches.running.Wait()
+
+	results := readResults(t, srv, batch.ID)
+	if results["ok"].Type != BatchResultSucceeded {
+		t.Errorf("ok result = %+v, expected the other request unaffected", results["ok"])
+	}
+	if results["bad"].Type != BatchResultErrored || !strings.Contains(string(results["bad"].Error), `"api_error"`) {
+		t.Errorf("bad result = %+v, error %s, expected an api_error", results["bad"], results["bad"].Error)
+	}
+}
+
+func TestHandleBatches_Validation(t *testing.T) {
+	useTempDataDir(t)
+	srv := New(&config.Config{Model: "test/model"})
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "invalid JSON", body: `{`},
+		{name: "no requests", body: `{"requests":[]}`},
+		{name: "missing custom_id", body: `{"requests":[{"params":{"model":"m","messages":[]}}]}`},
+		{name: "duplicate custom_id", body: `{"requests":[{"custom_id":"a","params":{}},{"custom_id":"a","params":{}}]}`},
+		{name: "invalid params", body: `{"requests":[{"custom_id":"a","params":{"messages":"no"}}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := doBatchRequest(t, srv, "POST", "/v1/messages/batches", tt.body); w.Code != http.StatusBadRequest {
+				t.Errorf("Status code = %d, expected 400", w.Code)
+			}
+		})
+	}
+
+	for _, target := range []string{"/v1/messages/batches/msgbatch_missing", "/v1/messages/batches/msgbatch_missing/results"} {
+		if w := doBatchRequest(t, srv, "GET", target, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status code = %d, expected 404", target, w.Code)
+		}
+	}
+	if w := doBatchRequest(t, srv, "DELETE", "/v1/messages/batches", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE status code = %d, expected 405", w.Code)
+	}
+}
+
+func TestHandleBatches_Cancel(t *testing.T) {
+	useTempDataDir(t)
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"done"},"finish_reason":"stop"}]}`))
+	}))
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "test/model", BatchConcurrency: 1})
+	batch := decodeBatch(t, doBatchRequest(t, srv, "POST", "/v1/messages/batches", `{"requests":[
+		{"custom_id":"a","params":{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"a"}]}},
+		{"custom_id":"b","params":{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"b"}]}},
+		{"custom_id":"c","params":{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"c"}]}}
+	]}`))
+
+	// Cancel while the first request is in flight
+	<-started
+	canceled := decodeBatch(t, doBatchRequest(t, srv, "POST", "/v1/messages/batches/"+batch.ID+"/cancel", ""))
+	if canceled.ProcessingStatus != BatchStatusCanceling || canceled.CancelInitiatedAt == nil {
+		t.Errorf("Canceled batch = %+v", canceled)
+	}
+	if w := doBatchRequest(t, srv, "GET", "/v1/messages/batches/"+batch.ID+"/results", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Results before the batch ended: status code = %d, expected 400", w.Code)
+	}
+	close(release)
+	srv.batches.running.Wait()
+
+	ended := decodeBatch(t, doBatchRequest(t, srv, "GET", "/v1/messages/batches/"+batch.ID, ""))
+	if expected := (BatchRequestCounts{Succeeded: 1, Canceled: 2}); ended.ProcessingStatus != BatchStatusEnded || ended.RequestCounts != expected {
+		t.Errorf("Ended batch = %+v", ended)
+	}
+	results := readResults(t, srv, batch.ID)
+	if results["a"].Type != BatchResultSucceeded || results["b"].Type != BatchResultCanceled || results["c"].Type != BatchResultCanceled {
+		t.Errorf("Results = %+v", results)
+	}
+}
+
+func TestHandleBatches_List(t *testing.T) {
+	useTempDataDir(t)
+	var mu sync.Mutex
+	calls := 0
+	openRouterServer := chatCompletionServer(t, &calls, &mu)
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "test/model"})
+	var ids []string
+	for i := 0; i < 3; i++ {
+		batch := decodeBatch(t, doBatchRequest(t, srv, "POST", "/v1/messages/batches",
+			`{"requests":[{"custom_id":"a","params":{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"a"}]}}]}`))
+		ids = append(ids, batch.ID)
+		time.Sleep(time.Millisecond)
+	}
+	srv.batches.running.Wait()
+
+	w := doBatchRequest(t, srv, "GET", "/v1/messages/batches?limit=2", "")
+	var page ListPage[MessageBatch]
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("Failed to decode page: %v", err)
+	}
+	if len(page.Data) != 2 || page.Data[0].ID != ids[2] || page.Data[1].ID != ids[1] || !page.HasMore {
+		t.Errorf("Page = %+v, expected the newest two of %v", page, ids)
+	}
+
+	w = doBatchRequest(t, srv, "GET", "/v1/messages/batches?limit=2&after_id="+ids[1], "")
+	page = ListPage[MessageBatch]{}
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("Failed to decode page: %v", err)
+	}
+	if len(page.Data) != 1 || page.Data[0].ID != ids[0] || page.HasMore {
+		t.Errorf("Second page = %+v", page)
+	}
+}
+
+func TestBatchManager_Resume(t *testing.T) {
+	dataDir := useTempDataDir(t)
+	var mu sync.Mutex
+	calls := 0
+	openRouterServer := chatCompletionServer(t, &calls, &mu)
+	defer openRouterServer.Close()
+
+	// A batch interrupted with one result written and a second cut short
+	id := "msgbatch_resume"
+	dir := filepath.Join(dataDir, batchesDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	batch := MessageBatch{
+		ID:               id,
+		Type:             "message_batch",
+		ProcessingStatus: BatchStatusInProgress,
+		RequestCounts:    BatchRequestCounts{Processing: 3},
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(batchExpiry),
+	}
+	data, _ := json.Marshal(batch)
+	requests := `{"custom_id":"a","params":{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"a"}]}}
+{"custom_id":"b","params":{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"b"}]}}
+{"custom_id":"c","params":{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"c"}]}}
+`
+	results := `{"custom_id":"a","result":{"type":"succeeded","message":{"type":"message"}}}
+{"custom_id":"b","result":{"type":"succ`
+	for name, content := range map[string]string{batchFile: string(data), batchRequestsFile: requests, batchResultsFile: results} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "test/model"})
+	srv.batches.resume()
+	srv.batches.running.Wait()
+
+	if calls != 2 {
+		t.Errorf("Upstream calls = %d, expected only the two unfinished requests", calls)
+	}
+	ended := decodeBatch(t, doBatchRequest(t, srv, "GET", "/v1/messages/batches/"+id, ""))
+	if expected := (BatchRequestCounts{Succeeded: 3}); ended.ProcessingStatus != BatchStatusEnded || ended.RequestCounts != expected {
+		t.Errorf("Resumed batch = %+v", ended)
+	}
+	if got := readResults(t, srv, id); len(got) != 3 || got["b"].Type != BatchResultSucceeded {
+		t.Errorf("Results = %+v", got)
+	}
+
+	// The ended batch is persisted, so another restart does not send anything
+	srv = New(&config.Config{BaseURL: openRouterServer.URL, Model: "test/model"})
+	srv.batches.resume()
+	srv.batches.running.Wait()
+	if calls != 2 {
+		t.Errorf("Upstream calls = %d after restarting an ended batch", calls)
+	}
+}
+
+func TestBatchManager_ResumeExpired(t *testing.T) {
+	dataDir := useTempDataDir(t)
+	id := "msgbatch_expired"
+	dir := filepath.Join(dataDir, batchesDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().UTC().Add(-2 * batchExpiry)
+	data, _ := json.Marshal(MessageBatch{
+		ID:               id,
+		Type:             "message_batch",
+		ProcessingStatus: BatchStatusInProgress,
+		RequestCounts:    BatchRequestCounts{Processing: 1},
+		CreatedAt:        created,
+		ExpiresAt:        created.Add(batchExpiry),
+	})
+	_ = os.WriteFile(filepath.Join(dir, batchFile), data, 0600)
+	_ = os.WriteFile(filepath.Join(dir, batchRequestsFile), []byte(`{"custom_id":"a","params":{"model":"m","messages":[]}}`+"\n"), 0600)
+
+	manager := newBatchManager(1, func(_ context.Context, _ json.RawMessage) BatchResultBody {
+		t.Error("Expired requests should not be sent")
+		return BatchResultBody{}
+	})
+	manager.resume()
+	manager.running.Wait()
+
+	batch, _ := manager.get(id)
+	if expected := (BatchRequestCounts{Expired: 1}); batch.ProcessingStatus != BatchStatusEnded || batch.RequestCounts != expected {
+		t.Errorf("Expired batch = %+v", batch)
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"athena/internal/config"
+	"athena/internal/transform"
+)
+
+// handleChatCompletions accepts OpenAI chat completions requests and forwards them
+// unchanged to the upstream, apart from mapping the model and adding the configured
+// provider routing for OpenRouter upstreams. Responses, streamed or not, are relayed as
+// the upstream sends them.
+func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	requestID := newRequestID()
+	w.Header().Set("request-id", requestID)
+
+	if r.Method != "POST" {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+
+	slog.Debug("request body", "body", string(body))
+
+	// Unknown fields are kept so they reach the upstream as sent
+	var req map[string]json.RawMessage
+	if unmarshalErr := json.Unmarshal(body, &req); unmarshalErr != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "Invalid JSON: "+unmarshalErr.Error())
+		return
+	}
+	var model string
+	if err := json.Unmarshal(req["model"], &model); err != nil || model == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "model is required")
+		return
+	}
+	var stream bool
+	_ = json.Unmarshal(req["stream"], &stream)
+
+	slog.Info("request received",
+		"request_id", requestID,
+		"method", "POST",
+		"path", "/v1/chat/completions",
+		"model", model,
+		"stream", stream,
+	)
+
+	route, err := s.upstreamFor(model)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if route.Format == config.UpstreamFormatAnthropic {
+		writeOpenAIError(w, http.StatusBadRequest, "Model "+model+" is routed to an Anthropic-format upstream, which /v1/chat/completions does not support")
+		return
+	}
+
+	mappedModel := transform.MapModel(model, s.cfg)
+	req["model"], _ = json.Marshal(mappedModel)
+
+	// Provider routing set by the client takes precedence over the configured routing,
+	// which only OpenRouter upstreams understand
+	providerInfo := "default"
+	if _, ok := req["provider"]; ok {
+		providerInfo = "client"
+	} else if provider := transform.GetProviderForModel(model, s.cfg); provider != nil && route.UsesOpenRouterExtensions() {
+		req["provider"], _ = json.Marshal(provider)
+		if len(provider.Order) > 0 {
+			providerInfo = strings.Join(provider.Order, ",")
+		}
+	}
+
+	slog.Info("routing request",
+		"request_id", requestID,
+		"from_model", model,
+		"to_model", mappedModel,
+		"upstream", route.Name,
+		"provider", providerInfo,
+	)
+
+	upstreamBody, err := json.Marshal(req)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "Failed to marshal request")
+		return
+	}
+
+	upstreamReq, err := s.newUpstreamRequest(r, route, upstreamBody)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "Failed to create request")
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(upstreamReq)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadGateway, "Failed to connect to upstream")
+		return
+	}
+	defer resp.Body.Close()
+
+	actualProvider := resp.Header.Get("X-OpenRouter-Provider")
+	if actualProvider == "" {
+		actualProvider = "unknown"
+	}
+	if resp.StatusCode >= 400 {
+		slog.Error("error response from upstream",
+			"request_id", requestID,
+			"status", resp.StatusCode,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"actual_provider", actualProvider,
+		)
+	} else {
+		slog.Info("response received",
+			"request_id", requestID,
+			"status", resp.StatusCode,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"actual_provider", actualProvider,
+		)
+	}
+
+	relayResponse(w, resp)
+}
+
+// relayResponse copies an upstream response to the client, flushing as data arrives so
+// streamed events are not held back
+func relayResponse(w http.ResponseWriter, resp *http.Response) {
+	for _, header := range []string{"Content-Type", "Cache-Control", "Retry-After"} {
+		if v := resp.Header.Get(header); v != "" {
+			w.Header().Set(header, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				slog.Debug("client disconnected during relay", "error", writeErr)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				slog.Error("failed to read upstream response", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// writeOpenAIError writes an error in the OpenAI format, {"error":{"message","type","code"}}
+func writeOpenAIError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(openAIErrorBody(status, message)); err != nil {
+		slog.Error("failed to encode error response", "error", err)
+	}
+}
+
+// writeOpenAIErrorChunk ends a started stream with the OpenAI error object as a data chunk
+func writeOpenAIErrorChunk(w http.ResponseWriter, status int, message string) {
+	data, err := json.Marshal(openAIErrorBody(status, message))
+	if err != nil {
+		slog.Error("failed to encode error chunk", "error", err)
+		return
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// openAIErrorBody builds the OpenAI error object for a status and message
+func openAIErrorBody(status int, message string) map[string]interface{} {
+	errorType := "invalid_request_error"
+	if status >= 500 {
+		errorType = "server_error"
+	}
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errorType,
+			"code":    status,
+		},
+	}
+}
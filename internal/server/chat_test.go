@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"athena/internal/config"
+)
+
+func TestHandleChatCompletions_NonStreaming(t *testing.T) {
+	var received map[string]interface{}
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer test-key" {
+			t.Errorf("Upstream request = %s, auth %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		_ = json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}]}`))
+	}))
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{
+		APIKey:          "test-key",
+		BaseURL:         openRouterServer.URL,
+		Model:           "moonshotai/kimi-k2",
+		ModelAliases:    map[string]string{"gpt-4o": "openai/gpt-4o"},
+		DefaultProvider: &config.ProviderConfig{Order: []string{"openai"}},
+	})
+
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"Hello"}],"temperature":0.2,"logit_bias":{"42":-100}}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.handleChatCompletions(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code = %d, body %s", w.Code, w.Body.String())
+	}
+	if received["model"] != "openai/gpt-4o" {
+		t.Errorf("Upstream model = %v, expected the alias to be mapped", received["model"])
+	}
+	if received["temperature"] != 0.2 || received["logit_bias"] == nil {
+		t.Errorf("Upstream request = %v, expected fields to be forwarded unchanged", received)
+	}
+	provider, _ := received["provider"].(map[string]interface{})
+	if order, _ := provider["order"].([]interface{}); len(order) != 1 || order[0] != "openai" {
+		t.Errorf("Upstream provider = %v, expected the default provider", received["provider"])
+	}
+	if !strings.Contains(w.Body.String(), `"object":"chat.completion"`) || w.Header().Get("request-id") == "" {
+		t.Errorf("Response = %s", w.Body.String())
+	}
+}
+
+func TestHandleChatCompletions_ClientProviderKept(t *testing.T) {
+	var received map[string]interface{}
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&received)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "moonshotai/kimi-k2", DefaultProvider: &config.ProviderConfig{Order: []string{"openai"}}})
+	body := `{"model":"qwen/qwen3-coder","messages":[],"provider":{"order":["cerebras"]}}`
+	srv.handleChatCompletions(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+
+	provider, _ := received["provider"].(map[string]interface{})
+	if order, _ := provider["order"].([]interface{}); len(order) != 1 || order[0] != "cerebras" || received["model"] != "qwen/qwen3-coder" {
+		t.Errorf("Upstream request = %v, expected the client's provider and model", received)
+	}
+}
+
+func TestHandleChatCompletions_Streaming(t *testing.T) {
+	streamData := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n"
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req["stream"] != true {
+			t.Errorf("Upstream stream = %v, expected true", req["stream"])
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(streamData))
+	}))
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "moonshotai/kimi-k2"})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"sonnet","stream":true,"messages":[]}`))
+	w := httptest.NewRecorder()
+	srv.handleChatCompletions(w, req)
+
+	body, _ := io.ReadAll(w.Result().Body)
+	if string(body) != streamData || w.Header().Get("Content-Type") != "text/event-stream" || !w.Flushed {
+		t.Errorf("Relayed stream = %q, content type %q", body, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestHandleChatCompletions_Errors(t *testing.T) {
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error":{"message":"Rate limited","code":429}}`))
+	}))
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "moonshotai/kimi-k2"})
+
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		expected int
+		contains string
+	}{
+		{name: "wrong method", method: "GET", expected: http.StatusMethodNotAllowed, contains: `"type":"invalid_request_error"`},
+		{name: "invalid JSON", method: "POST", body: `{`, expected: http.StatusBadRequest, contains: "Invalid JSON"},
+		{name: "missing model", method: "POST", body: `{"messages":[]}`, expected: http.StatusBadRequest, contains: "model is required"},
+		{name: "upstream error relayed", method: "POST", body: `{"model":"opus","messages":[]}`, expected: http.StatusTooManyRequests, contains: "Rate limited"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/v1/chat/completions", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			srv.handleChatCompletions(w, req)
+			if w.Code != tt.expected || !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("Response = %d %s, expected %d containing %s", w.Code, w.Body.String(), tt.expected, tt.contains)
+			}
+		})
+	}
+}
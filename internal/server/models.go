@@ -0,0 +1,350 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"athena/internal/config"
+	"athena/internal/daemon"
+	"athena/internal/transform"
+	"athena/internal/util"
+)
+
+const (
+	// defaultPageLimit and maxPageLimit bound a list page, as in the Anthropic API
+	defaultPageLimit = 20
+	maxPageLimit     = 1000
+	// modelCatalogTTL is how long the cached upstream catalog is used before refreshing
+	modelCatalogTTL = 24 * time.Hour
+	// modelCatalogRetry is how long to wait after a failed refresh before fetching again
+	modelCatalogRetry = 5 * time.Minute
+	// modelCatalogFile is the catalog cache file in the data directory
+	modelCatalogFile = "models.json"
+)
+
+// ModelInfo is an Anthropic model object. UpstreamModel and Upstream are Athena
+// extensions naming the model requests are routed to and the upstream serving it.
+type ModelInfo struct {
+	Type          string `json:"type"`
+	ID            string `json:"id"`
+	DisplayName   string `json:"display_name"`
+	CreatedAt     string `json:"created_at"`
+	UpstreamModel string `json:"upstream_model"`
+	Upstream      string `json:"upstream,omitempty"`
+}
+
+// ListPage is a page of an Anthropic list endpoint
+type ListPage[T any] struct {
+	Data    []T     `json:"data"`
+	HasMore bool    `json:"has_more"`
+	FirstID *string `json:"first_id"`
+	LastID  *string `json:"last_id"`
+}
+
+// ModelList is a page of Anthropic model objects
+type ModelList = ListPage[ModelInfo]
+
+// upstreamModel is an entry in the upstream /v1/models catalog
+type upstreamModel struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Created int64  `json:"created"`
+}
+
+// modelCatalog is the cached upstream catalog, as stored on disk
+type modelCatalog struct {
+	FetchedAt time.Time       `json:"fetched_at"`
+	Models    []upstreamModel `json:"models"`
+}
+
+// catalogCache holds the upstream catalog in memory between refreshes
+type catalogCache struct {
+	mu          sync.Mutex
+	catalog     *modelCatalog
+	lastAttempt time.Time
+}
+
+// handleModels serves GET /v1/models and GET /v1/models/{id}
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		transform.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	models := s.listModels(r.Context())
+
+	// Upstream IDs contain slashes, so everything after the prefix is the ID
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/models"), "/"); id != "" {
+		if i := modelIndex(models, id); i >= 0 {
+			writeJSON(w, models[i])
+			return
+		}
+		transform.WriteError(w, http.StatusNotFound, "Model not found: "+id)
+		return
+	}
+
+	page, err := paginate(models, func(model ModelInfo) string { return model.ID }, r.URL.Query())
+	if err != nil {
+		transform.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, page)
+}
+
+// listModels returns the family aliases, configured aliases and, when enabled, the upstream catalog
+func (s *Server) listModels(ctx context.Context) []ModelInfo {
+	created := s.started.UTC().Format(time.RFC3339)
+	models := []ModelInfo{}
+	seen := map[string]bool{}
+	add := func(model ModelInfo) {
+		if !seen[model.ID] {
+			seen[model.ID] = true
+			models = append(models, model)
+		}
+	}
+
+	for _, family := range []string{"opus", "sonnet", "haiku"} {
+		upstream := transform.MapModel(family, s.cfg)
+		add(ModelInfo{
+			Type:          "model",
+			ID:            family,
+			DisplayName:   strings.ToUpper(family[:1]) + family[1:] + " (" + upstream + ")",
+			CreatedAt:     created,
+			UpstreamModel: upstream,
+			Upstream:      s.upstreamName(family),
+		})
+	}
+
+	aliases := make([]string, 0, len(s.cfg.ModelAliases))
+	for alias := range s.cfg.ModelAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		upstream := transform.MapModel(alias, s.cfg)
+		add(ModelInfo{
+			Type:          "model",
+			ID:            alias,
+			DisplayName:   alias + " (" + upstream + ")",
+			CreatedAt:     created,
+			UpstreamModel: upstream,
+			Upstream:      s.upstreamName(alias),
+		})
+	}
+
+	if s.cfg.ModelCatalog {
+		catalog := s.upstreamCatalog(ctx)
+		// Newest first, as the Anthropic API lists models
+		sort.SliceStable(catalog, func(i, j int) bool { return catalog[i].Created > catalog[j].Created })
+		for _, model := range catalog {
+			name := model.Name
+			if name == "" {
+				name = model.ID
+			}
+			add(ModelInfo{
+				Type:          "model",
+				ID:            model.ID,
+				DisplayName:   name,
+				CreatedAt:     time.Unix(model.Created, 0).UTC().Format(time.RFC3339),
+				UpstreamModel: model.ID,
+			})
+		}
+	}
+	return models
+}
+
+// upstreamName returns the name of the upstream a model is routed to
+func (s *Server) upstreamName(model string) string {
+	if name := transform.GetUpstreamForModel(model, s.cfg); name != "" {
+		return name
+	}
+	return "default"
+}
+
+// paginate applies the limit, after_id and before_id query parameters to items in list order
+func paginate[T any](items []T, id func(T) string, query url.Values) (ListPage[T], error) {
+	limit := defaultPageLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return ListPage[T]{}, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+
+	index := func(target string) int {
+		for i, item := range items {
+			if id(item) == target {
+				return i
+			}
+		}
+		return -1
+	}
+
+	lower, upper := 0, len(items)
+	if afterID := query.Get("after_id"); afterID != "" {
+		i := index(afterID)
+		if i < 0 {
+			return ListPage[T]{}, fmt.Errorf("unknown after_id: %s", afterID)
+		}
+		lower = i + 1
+	}
+	if beforeID := query.Get("before_id"); beforeID != "" {
+		i := index(beforeID)
+		if i < 0 {
+			return ListPage[T]{}, fmt.Errorf("unknown before_id: %s", beforeID)
+		}
+		upper = i
+	}
+
+	// Paging backwards returns the items immediately before the cursor
+	start, end := lower, min(upper, lower+limit)
+	hasMore := end < upper
+	if query.Get("before_id") != "" {
+		start, end = max(lower, upper-limit), upper
+		hasMore = start > lower
+	}
+
+	page := ListPage[T]{Data: []T{}, HasMore: hasMore}
+	if start < end {
+		page.Data = items[start:end]
+		firstID, lastID := id(page.Data[0]), id(page.Data[len(page.Data)-1])
+		page.FirstID = &firstID
+		page.LastID = &lastID
+	}
+	return page, nil
+}
+
+// modelIndex returns the position of a model ID, or -1
+func modelIndex(models []ModelInfo, id string) int {
+	for i, model := range models {
+		if model.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// upstreamCatalog returns the OpenRouter catalog, refreshing the on-disk cache when it is
+// older than modelCatalogTTL. The lock is not held during the fetch, so concurrent callers
+// are served the stale copy while one refresh is in flight, and after it fails.
+func (s *Server) upstreamCatalog(ctx context.Context) []upstreamModel {
+	s.catalog.mu.Lock()
+
+	path := ""
+	if dataDir, err := daemon.GetDataDir(); err == nil {
+		path = filepath.Join(dataDir, modelCatalogFile)
+	}
+
+	if s.catalog.catalog == nil && path != "" {
+		var cached modelCatalog
+		if err := util.ReadJSONFile(path, &cached); err == nil {
+			s.catalog.catalog = &cached
+		}
+	}
+	var stale []upstreamModel
+	if s.catalog.catalog != nil {
+		stale = append(stale, s.catalog.catalog.Models...)
+	}
+	fresh := s.catalog.catalog != nil && time.Since(s.catalog.catalog.FetchedAt) < modelCatalogTTL
+	if fresh || time.Since(s.catalog.lastAttempt) < modelCatalogRetry {
+		s.catalog.mu.Unlock()
+		return stale
+	}
+	// Recording the attempt first keeps other callers from starting a second fetch
+	s.catalog.lastAttempt = time.Now()
+	s.catalog.mu.Unlock()
+
+	models, err := s.fetchUpstreamCatalog(ctx)
+	if err != nil {
+		slog.Warn("failed to fetch upstream model catalog", "error", err)
+		return stale
+	}
+
+	catalog := &modelCatalog{FetchedAt: time.Now(), Models: models}
+	s.catalog.mu.Lock()
+	s.catalog.catalog = catalog
+	s.catalog.mu.Unlock()
+
+	if path != "" {
+		if err := util.WriteJSONFile(path, catalog); err != nil {
+			slog.Warn("failed to cache upstream model catalog", "path", path, "error", err)
+		}
+	}
+	return append([]upstreamModel(nil), models...)
+}
+
+// fetchUpstreamCatalog requests the model list from the default upstream's /v1/models
+func (s *Server) fetchUpstreamCatalog(ctx context.Context) ([]upstreamModel, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	route, err := s.upstreamFor("")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", route.modelsURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	anthropic := route.Format == config.UpstreamFormatAnthropic
+	if anthropic {
+		if route.APIKey != "" {
+			req.Header.Set("x-api-key", route.APIKey)
+		}
+		req.Header.Set("anthropic-version", defaultAnthropicVersion)
+	} else if route.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+route.APIKey)
+	}
+	route.setHeaders(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned status %d", resp.StatusCode)
+	}
+
+	// Anthropic lists display_name and an RFC 3339 created_at instead of name and created
+	var body struct {
+		Data []struct {
+			upstreamModel
+			DisplayName string    `json:"display_name"`
+			CreatedAt   time.Time `json:"created_at"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	models := make([]upstreamModel, 0, len(body.Data))
+	for _, entry := range body.Data {
+		model := entry.upstreamModel
+		if anthropic {
+			model.Name = entry.DisplayName
+			model.Created = entry.CreatedAt.Unix()
+		}
+		models = append(models, model)
+	}
+	return models, nil
+}
+
+// writeJSON writes a JSON response body
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		slog.Error("failed to encode response", "error", err)
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"athena/internal/config"
+	"athena/internal/daemon"
+)
+
+func getModels(t *testing.T, srv *Server, target string) (*httptest.ResponseRecorder, ModelList) {
+	t.Helper()
+	req := httptest.NewRequest("GET", target, nil)
+	w := httptest.NewRecorder()
+
+	srv.handleModels(w, req)
+
+	var list ModelList
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+	return w, list
+}
+
+func modelIDs(list ModelList) []string {
+	ids := []string{}
+	for _, model := range list.Data {
+		ids = append(ids, model.ID)
+	}
+	return ids
+}
+
+func TestHandleModels_List(t *testing.T) {
+	srv := New(&config.Config{
+		Model:        "moonshotai/kimi-k2",
+		OpusModel:    "anthropic/claude-opus-4",
+		ModelAliases: map[string]string{"fast": "openai/gpt-4o-mini", "coder": "qwen/qwen3-coder"},
+	})
+
+	w, list := getModels(t, srv, "/v1/models")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code = %d, body %s", w.Code, w.Body.String())
+	}
+
+	expected := []string{"opus", "sonnet", "haiku", "coder", "fast"}
+	if ids := modelIDs(list); len(ids) != len(expected) {
+		t.Fatalf("IDs = %v, expected %v", ids, expected)
+	}
+	for i, model := range list.Data {
+		if model.ID != expected[i] || model.Type != "model" || model.CreatedAt == "" {
+			t.Errorf("Model %d = %+v, expected %s", i, model, expected[i])
+		}
+	}
+	if list.Data[0].UpstreamModel != "anthropic/claude-opus-4" || list.Data[1].UpstreamModel != "moonshotai/kimi-k2" {
+		t.Errorf("Family upstreams = %s, %s", list.Data[0].UpstreamModel, list.Data[1].UpstreamModel)
+	}
+	if list.Data[4].UpstreamModel != "openai/gpt-4o-mini" {
+		t.Errorf("Alias upstream = %s, expected openai/gpt-4o-mini", list.Data[4].UpstreamModel)
+	}
+	if list.HasMore || *list.FirstID != "opus" || *list.LastID != "fast" {
+		t.Errorf("Page = has_more %v, first %s, last %s", list.HasMore, *list.FirstID, *list.LastID)
+	}
+}
+
+func TestHandleModels_Pagination(t *testing.T) {
+	srv := New(&config.Config{
+		Model:        "moonshotai/kimi-k2",
+		ModelAliases: map[string]string{"a": "x/a", "b": "x/b", "c": "x/c"},
+	})
+	// opus, sonnet, haiku, a, b, c
+
+	tests := []struct {
+		query    string
+		expected []string
+		hasMore  bool
+	}{
+		{query: "limit=2", expected: []string{"opus", "sonnet"}, hasMore: true},
+		{query: "limit=2&after_id=sonnet", expected: []string{"haiku", "a"}, hasMore: true},
+		{query: "limit=2&after_id=b", expected: []string{"c"}, hasMore: false},
+		{query: "limit=2&before_id=b", expected: []string{"haiku", "a"}, hasMore: true},
+		{query: "limit=2&before_id=sonnet", expected: []string{"opus"}, hasMore: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w, list := getModels(t, srv, "/v1/models?"+tt.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Status code = %d, body %s", w.Code, w.Body.String())
+			}
+			ids := modelIDs(list)
+			if len(ids) != len(tt.expected) {
+				t.Fatalf("IDs = %v, expected %v", ids, tt.expected)
+			}
+			for i := range ids {
+				if ids[i] != tt.expected[i] {
+					t.Errorf("IDs = %v, expected %v", ids, tt.expected)
+					break
+				}
+			}
+			if list.HasMore != tt.hasMore {
+				t.Errorf("has_more = %v, expected %v", list.HasMore, tt.hasMore)
+			}
+		})
+	}
+
+	for _, query := range []string{"limit=0", "limit=1001", "after_id=missing"} {
+		if w, _ := getModels(t, srv, "/v1/models?"+query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status code = %d, expected 400", query, w.Code)
+		}
+	}
+}
+
+func TestHandleModels_Get(t *testing.T) {
+	srv := New(&config.Config{Model: "moonshotai/kimi-k2", ModelAliases: map[string]string{"coder": "qwen/qwen3-coder"}})
+
+	req := httptest.NewRequest("GET", "/v1/models/coder", nil)
+	w := httptest.NewRecorder()
+	srv.handleModels(w, req)
+
+	var model ModelInfo
+	if err := json.NewDecoder(w.Body).Decode(&model); err != nil || model.ID != "coder" || model.UpstreamModel != "qwen/qwen3-coder" {
+		t.Errorf("Model = %+v (%v), expected coder", model, err)
+	}
+
+	req = httptest.NewRequest("GET", "/v1/models/missing", nil)
+	w = httptest.NewRecorder()
+	srv.handleModels(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Status code = %d, expected 404", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/v1/models", nil)
+	w = httptest.NewRecorder()
+	srv.handleModels(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Status code = %d, expected 405", w.Code)
+	}
+}
+
+func TestHandleModels_UpstreamCatalog(t *testing.T) {
+	dataDir := t.TempDir()
+	original := daemon.GetDataDir
+	daemon.GetDataDir = func() (string, error) { return dataDir, nil }
+	defer func() { daemon.GetDataDir = original }()
+
+	requests := 0
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v1/models" {
+			t.Errorf("Catalog path = %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":[
+			{"id":"openai/gpt-4o","name":"OpenAI: GPT-4o","created":1715367049},
+			{"id":"qwen/qwen3-coder","name":"Qwen: Qwen3 Coder","created":1753230546}
+		]}`))
+	}))
+	defer openRouterServer.Close()
+
+	cfg := &config.Config{BaseURL: openRouterServer.URL, Model: "moonshotai/kimi-k2", ModelCatalog: true}
+	srv := New(cfg)
+
+	_, list := getModels(t, srv, "/v1/models?"+url.Values{"after_id": {"haiku"}}.Encode())
+	ids := modelIDs(list)
+	if len(ids) != 2 || ids[0] != "qwen/qwen3-coder" || ids[1] != "openai/gpt-4o" {
+		t.Fatalf("Catalog IDs = %v, expected newest first", ids)
+	}
+	if list.Data[0].DisplayName != "Qwen: Qwen3 Coder" || list.Data[0].CreatedAt != time.Unix(1753230546, 0).UTC().Format(time.RFC3339) {
+		t.Errorf("Catalog model = %+v", list.Data[0])
+	}
+
+	if _, err := os.Stat(filepath.Join(dataDir, modelCatalogFile)); err != nil {
+		t.Errorf("Expected the catalog to be cached on disk: %v", err)
+	}
+
+	// A new server reads the fresh cache instead of fetching again
+	_, list = getModels(t, New(cfg), "/v1/models")
+	if requests != 1 || len(list.Data) != 5 {
+		t.Errorf("Requests = %d, models = %d, expected the cached catalog", requests, len(list.Data))
+	}
+}
+
+func TestHandleModels_AnthropicUpstreamCatalog(t *testing.T) {
+	dataDir := t.TempDir()
+	original := daemon.GetDataDir
+	daemon.GetDataDir = func() (string, error) { return dataDir, nil }
+	defer func() { daemon.GetDataDir = original }()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/anthropic/v1/models" {
+			t.Errorf("Catalog path = %s, expected it beside the configured path", r.URL.Path)
+		}
+		if r.Header.Get("x-api-key") != "sk-ant-test" || r.Header.Get("anthropic-version") == "" || r.Header.Get("Authorization") != "" {
+			t.Errorf("Catalog headers = %v, expected Anthropic auth", r.Header)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":[{"id":"claude-opus-4-1-20250805","display_name":"Claude Opus 4.1","created_at":"2025-08-05T00:00:00Z","type":"model"}]}`))
+	}))
+	defer upstream.Close()
+
+	srv := New(&config.Config{
+		Model:        "claude-sonnet-4-5",
+		ModelCatalog: true,
+		Upstreams: map[string]config.Upstream{"anthropic": {
+			BaseURL: upstream.URL,
+			APIKey:  "sk-ant-test",
+			Format:  config.UpstreamFormatAnthropic,
+			Path:    "/anthropic/v1/messages",
+		}},
+		DefaultUpstream: "anthropic",
+	})
+
+	_, list := getModels(t, srv, "/v1/models?"+url.Values{"after_id": {"haiku"}}.Encode())
+	if len(list.Data) != 1 || list.Data[0].DisplayName != "Claude Opus 4.1" || list.Data[0].CreatedAt != "2025-08-05T00:00:00Z" {
+		t.Errorf("Catalog = %+v", list.Data)
+	}
+}
+
+func TestHandleModels_AliasUpstream(t *testing.T) {
+	srv := New(&config.Config{
+		Model:          "moonshotai/kimi-k2",
+		SonnetModel:    "anthropic/claude-sonnet-4",
+		ModelAliases:   map[string]string{"claude-sonnet-fast": "openai/gpt-4o-mini"},
+		Upstreams:      map[string]config.Upstream{"anthropic": {BaseURL: "https://api.anthropic.com", Format: config.UpstreamFormatAnthropic}},
+		SonnetUpstream: "anthropic",
+	})
+
+	_, list := getModels(t, srv, "/v1/models")
+	for _, model := range list.Data {
+		switch model.ID {
+		case "sonnet":
+			if model.Upstream != "anthropic" {
+				t.Errorf("sonnet upstream = %q, expected anthropic", model.Upstream)
+			}
+		case "claude-sonnet-fast":
+			if model.Upstream != "default" {
+				t.Errorf("Alias upstream = %q, expected the default rather than the sonnet upstream", model.Upstream)
+			}
+		}
+	}
+}
+
+func TestHandleModels_StaleCatalogDuringRefresh(t *testing.T) {
+	dataDir := t.TempDir()
+	original := daemon.GetDataDir
+	daemon.GetDataDir = func() (string, error) { return dataDir, nil }
+	defer func() { daemon.GetDataDir = original }()
+
+	stale := modelCatalog{FetchedAt: time.Now().Add(-2 * modelCatalogTTL), Models: []upstreamModel{{ID: "old/model", Created: 1}}}
+	data, _ := json.Marshal(stale)
+	if err := os.WriteFile(filepath.Join(dataDir, modelCatalogFile), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(fetching)
+		<-release
+		_, _ = w.Write([]byte(`{"data":[{"id":"new/model","created":2}]}`))
+	}))
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "moonshotai/kimi-k2", ModelCatalog: true})
+
+	refreshed := make(chan ModelList)
+	go func() {
+		_, list := getModels(t, srv, "/v1/models?after_id=haiku")
+		refreshed <- list
+	}()
+	<-fetching
+
+	// A concurrent request is answered from the stale copy while the refresh is in flight
+	done := make(chan ModelList)
+	go func() {
+		_, list := getModels(t, srv, "/v1/models?after_id=haiku")
+		done <- list
+	}()
+	select {
+	case list := <-done:
+		if ids := modelIDs(list); len(ids) != 1 || ids[0] != "old/model" {
+			t.Errorf("Concurrent IDs = %v, expected the stale catalog", ids)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Concurrent request blocked behind the catalog refresh")
+	}
+
+	close(release)
+	if ids := modelIDs(<-refreshed); len(ids) != 1 || ids[0] != "new/model" {
+		t.Errorf("Refreshed IDs = %v, expected the new catalog", ids)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"athena/internal/transform"
+)
+
+// defaultAnthropicVersion is sent to Anthropic-format upstreams when the client sets none
+const defaultAnthropicVersion = "2023-06-01"
+
+// forwardAnthropic sends a Messages request body to an Anthropic-format upstream with
+// only the model rewritten, and relays the response, streamed or not, as received
+func (s *Server) forwardAnthropic(w http.ResponseWriter, r *http.Request, req transform.AnthropicRequest, body []byte, route upstreamRoute) {
+	start := time.Now()
+	requestID := req.RequestID
+
+	mappedModel := transform.MapModel(req.Model, s.cfg)
+	upstreamBody, err := replaceJSONField(body, "model", mappedModel)
+	if err != nil {
+		transform.WriteError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	slog.Info("routing request",
+		"request_id", requestID,
+		"from_model", req.Model,
+		"to_model", mappedModel,
+		"upstream", route.Name,
+		"format", "anthropic",
+	)
+
+	upstreamReq, err := s.newAnthropicUpstreamRequest(r, route, route.endpoint("/v1/messages"), upstreamBody)
+	if err != nil {
+		transform.WriteError(w, http.StatusInternalServerError, "Failed to create request")
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(upstreamReq)
+	if err != nil {
+		transform.WriteError(w, http.StatusBadGateway, "Failed to connect to upstream")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		slog.Error("error response from upstream",
+			"request_id", requestID,
+			"status", resp.StatusCode,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"upstream_request_id", resp.Header.Get("request-id"),
+			"body", string(bodyBytes),
+		)
+		resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	} else {
+		slog.Info("response received",
+			"request_id", requestID,
+			"status", resp.StatusCode,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"upstream_request_id", resp.Header.Get("request-id"),
+		)
+	}
+
+	relayResponse(w, resp)
+}
+
+// newAnthropicUpstreamRequest creates a request to an Anthropic-format upstream,
+// authenticating with x-api-key and forwarding the client's query string, such as
+// ?beta=true, and its version and beta headers
+func (s *Server) newAnthropicUpstreamRequest(r *http.Request, route upstreamRoute, url string, body []byte) (*http.Request, error) {
+	if r.URL.RawQuery != "" {
+		separator := "?"
+		if strings.Contains(url, "?") {
+			separator = "&"
+		}
+		url += separator + r.URL.RawQuery
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if route.APIKey != "" {
+		req.Header.Set("x-api-key", route.APIKey)
+	}
+
+	version := r.Header.Get("anthropic-version")
+	if version == "" {
+		version = defaultAnthropicVersion
+	}
+	req.Header.Set("anthropic-version", version)
+	if beta := r.Header.Get("anthropic-beta"); beta != "" {
+		req.Header.Set("anthropic-beta", beta)
+	}
+	if userAgent := r.Header.Get("User-Agent"); userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	route.setHeaders(req)
+	return req, nil
+}
+
+// countAnthropicTokens asks an Anthropic-format upstream's count_tokens endpoint for the
+// request's input tokens
+func (s *Server) countAnthropicTokens(r *http.Request, route upstreamRoute, req transform.AnthropicRequest) (int, error) {
+	req.Model = transform.MapModel(req.Model, s.cfg)
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	upstreamReq, err := s.newAnthropicUpstreamRequest(r, route, route.endpoint("/v1/messages")+"/count_tokens", body)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := http.DefaultClient.Do(upstreamReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("upstream returned status %d", resp.StatusCode)
+	}
+	var count struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&count); err != nil {
+		return 0, err
+	}
+	return count.InputTokens, nil
+}
+
+// replaceJSONField replaces the value of a top-level key in a JSON object, leaving every
+// other byte of the document as it was. The document is returned unchanged when the key
+// is absent.
+func replaceJSONField(doc []byte, key string, value interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keyEnd := dec.InputOffset()
+		var skipped json.RawMessage
+		if err := dec.Decode(&skipped); err != nil {
+			return nil, err
+		}
+		if tok != key {
+			continue
+		}
+
+		// The value follows the colon after the key and any whitespace
+		valueEnd := dec.InputOffset()
+		valueStart := valueEnd - int64(len(skipped))
+		if valueStart < keyEnd {
+			return nil, fmt.Errorf("unexpected layout around %q", key)
+		}
+		out := make([]byte, 0, len(doc)+len(encoded))
+		out = append(out, doc[:valueStart]...)
+		out = append(out, encoded...)
+		return append(out, doc[valueEnd:]...), nil
+	}
+	return doc, nil
+}
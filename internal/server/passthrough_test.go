@@ -0,0 +1,205 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"athena/internal/config"
+)
+
+func TestReplaceJSONField(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		key      string
+		value    interface{}
+		expected string
+	}{
+		{
+			name:     "formatting kept",
+			doc:      "{\n  \"model\" :  \"claude-sonnet-4\",\n  \"max_tokens\": 10\n}",
+			key:      "model",
+			value:    "anthropic/claude-sonnet-4",
+			expected: "{\n  \"model\" :  \"anthropic/claude-sonnet-4\",\n  \"max_tokens\": 10\n}",
+		},
+		{
+			name:     "nested keys untouched",
+			doc:      `{"metadata":{"model":"x"},"model":"a","tools":[{"model":"y"}]}`,
+			key:      "model",
+			value:    "b",
+			expected: `{"metadata":{"model":"x"},"model":"b","tools":[{"model":"y"}]}`,
+		},
+		{
+			name:     "non-string value",
+			doc:      `{"stream": true, "model":"a"}`,
+			key:      "stream",
+			value:    false,
+			expected: `{"stream": false, "model":"a"}`,
+		},
+		{
+			name:     "absent key",
+			doc:      `{"model":"a"}`,
+			key:      "stream",
+			value:    false,
+			expected: `{"model":"a"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := replaceJSONField([]byte(tt.doc), tt.key, tt.value)
+			if err != nil {
+				t.Fatalf("replaceJSONField() error: %v", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("replaceJSONField() = %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+
+	for _, doc := range []string{`[]`, `{"model":`, `"model"`} {
+		if _, err := replaceJSONField([]byte(doc), "model", "x"); err == nil {
+			t.Errorf("Expected an error for %s", doc)
+		}
+	}
+}
+
+func TestHandleMessages_AnthropicPassthrough(t *testing.T) {
+	requestBody := `{"model":"claude-sonnet-4-5","max_tokens":100,
+		"thinking":{"type":"enabled","budget_tokens":1024},
+		"system":[{"type":"text","text":"Be brief","cache_control":{"type":"ephemeral"}}],
+		"messages":[{"role":"user","content":"Hello"}]}`
+	responseBody := `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[{"type":"thinking","thinking":"Hmm","signature":"sig"},{"type":"text","text":"Hi"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":3,"cache_read_input_tokens":5}}`
+
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" || r.URL.RawQuery != "beta=true" {
+			t.Errorf("Upstream URL = %s, expected /v1/messages?beta=true", r.URL)
+		}
+		if r.Header.Get("x-api-key") != "sk-ant-test" || r.Header.Get("Authorization") != "" {
+			t.Errorf("Auth headers = x-api-key %q, Authorization %q", r.Header.Get("x-api-key"), r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("anthropic-version") != "2023-06-01" || r.Header.Get("anthropic-beta") != "interleaved-thinking-2025-05-14" {
+			t.Errorf("Anthropic headers = %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(responseBody))
+	}))
+	defer upstream.Close()
+
+	srv := New(&config.Config{
+		APIKey:         "sk-ant-test",
+		BaseURL:        upstream.URL,
+		UpstreamFormat: config.UpstreamFormatAnthropic,
+		SonnetModel:    "claude-sonnet-4-5-20250929",
+	})
+
+	req := httptest.NewRequest("POST", "/v1/messages?beta=true", strings.NewReader(requestBody))
+	req.Header.Set("x-api-key", "client-key")
+	req.Header.Set("anthropic-version", "2023-06-01")
+	req.Header.Set("anthropic-beta", "interleaved-thinking-2025-05-14")
+	w := httptest.NewRecorder()
+	srv.handleMessages(w, req)
+
+	expected := strings.Replace(requestBody, `"claude-sonnet-4-5"`, `"claude-sonnet-4-5-20250929"`, 1)
+	if received != expected {
+		t.Errorf("Upstream body = %s\nexpected %s", received, expected)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != responseBody {
+		t.Errorf("Response = %d %s, expected the upstream body unchanged", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleMessages_AnthropicPassthroughStreaming(t *testing.T) {
+	streamData := "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\"}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"citations_delta\"}}\n\n" +
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(streamData))
+	}))
+	defer upstream.Close()
+
+	srv := New(&config.Config{BaseURL: upstream.URL, UpstreamFormat: config.UpstreamFormatAnthropic, OpusModel: "claude-opus-4-1"})
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model":"opus","stream":true,"max_tokens":10,"messages":[]}`))
+	w := httptest.NewRecorder()
+	srv.handleMessages(w, req)
+
+	if w.Body.String() != streamData || w.Header().Get("Content-Type") != "text/event-stream" || !w.Flushed {
+		t.Errorf("Relayed stream = %q", w.Body.String())
+	}
+}
+
+func TestHandleMessages_AnthropicPassthroughError(t *testing.T) {
+	errorBody := `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(529)
+		_, _ = w.Write([]byte(errorBody))
+	}))
+	defer upstream.Close()
+
+	srv := New(&config.Config{BaseURL: upstream.URL, UpstreamFormat: config.UpstreamFormatAnthropic, HaikuModel: "claude-haiku-4-5"})
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model":"haiku","max_tokens":10,"messages":[]}`))
+	w := httptest.NewRecorder()
+	srv.handleMessages(w, req)
+
+	if w.Code != 529 || w.Body.String() != errorBody || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("Response = %d %s, expected the upstream error unchanged", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleCountTokens_AnthropicUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/v1/messages/count_tokens" || !strings.Contains(string(body), `"model":"claude-sonnet-4-5"`) {
+			t.Errorf("Upstream request = %s %s", r.URL.Path, body)
+		}
+		_, _ = w.Write([]byte(`{"input_tokens":17}`))
+	}))
+	defer upstream.Close()
+
+	srv := New(&config.Config{
+		BaseURL:        upstream.URL,
+		UpstreamFormat: config.UpstreamFormatAnthropic,
+		TokenCounting:  config.TokenCountingUpstream,
+		SonnetModel:    "claude-sonnet-4-5",
+	})
+	req := httptest.NewRequest("POST", "/v1/messages/count_tokens", strings.NewReader(`{"model":"sonnet","messages":[{"role":"user","content":"Hi"}]}`))
+	w := httptest.NewRecorder()
+	srv.handleCountTokens(w, req)
+
+	if !strings.Contains(w.Body.String(), `"input_tokens":17`) {
+		t.Errorf("Response = %s, expected the upstream count", w.Body.String())
+	}
+}
+
+func TestHandleCountTokens_AnthropicUpstreamPath(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/anthropic/v1/messages/count_tokens" {
+			t.Errorf("Upstream path = %s, expected count_tokens beside the configured path", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"input_tokens":9}`))
+	}))
+	defer upstream.Close()
+
+	srv := New(&config.Config{
+		SonnetModel:     "claude-sonnet-4-5",
+		TokenCounting:   config.TokenCountingUpstream,
+		Upstreams:       map[string]config.Upstream{"anthropic": {BaseURL: upstream.URL, Format: config.UpstreamFormatAnthropic, Path: "/anthropic/v1/messages"}},
+		DefaultUpstream: "anthropic",
+	})
+	req := httptest.NewRequest("POST", "/v1/messages/count_tokens", strings.NewReader(`{"model":"sonnet","messages":[{"role":"user","content":"Hi"}]}`))
+	w := httptest.NewRecorder()
+	srv.handleCountTokens(w, req)
+
+	if !strings.Contains(w.Body.String(), `"input_tokens":9`) {
+		t.Errorf("Response = %s, expected the upstream count", w.Body.String())
+	}
+}
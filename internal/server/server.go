@@ -2,25 +2,41 @@ package server
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"athena/internal/config"
+	"athena/internal/tokenizer"
 	"athena/internal/transform"
 )
 
 // Server represents the HTTP server
 type Server struct {
-	cfg *config.Config
+	cfg        *config.Config
+	tokenizers *tokenizer.Registry
+	catalog    catalogCache
+	batches    *batchManager
+	started    time.Time
 }
 
 // New creates a new server instance
 func New(cfg *config.Config) *Server {
-	return &Server{cfg: cfg}
+	s := &Server{
+		cfg:        cfg,
+		tokenizers: tokenizer.NewRegistry(cfg.TokenizerTables),
+		started:    time.Now(),
+	}
+	s.batches = newBatchManager(cfg.BatchConcurrency, s.sendBatchRequest)
+	return s
 }
 
 // loggingMiddleware logs all incoming requests
@@ -36,12 +52,104 @@ func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// recoveryMiddleware converts a panic in a handler into an Anthropic-format 500
+// response instead of letting net/http drop the connection. Once a stream has started,
+// the status can no longer change, so the stream ends with an error event instead.
+func recoveryMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return recoverWith(next, func(w *trackingResponseWriter) {
+		apiErr := transform.NewAPIError(http.StatusInternalServerError, "Internal server error")
+		switch {
+		case !w.started:
+			apiErr.Write(w)
+		case isEventStream(w):
+			apiErr.WriteEvent(w)
+		}
+	})
+}
+
+// openAIRecoveryMiddleware is recoveryMiddleware for the OpenAI-format routes. A stream
+// that has started ends with a data chunk holding the OpenAI error object.
+func openAIRecoveryMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return recoverWith(next, func(w *trackingResponseWriter) {
+		switch {
+		case !w.started:
+			writeOpenAIError(w, http.StatusInternalServerError, "Internal server error")
+		case isEventStream(w):
+			writeOpenAIErrorChunk(w, http.StatusInternalServerError, "Internal server error")
+		}
+	})
+}
+
+// recoverWith logs a panic in a handler and reports it to the client with writeError
+func recoverWith(next http.HandlerFunc, writeError func(w *trackingResponseWriter)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tracked := &trackingResponseWriter{ResponseWriter: w}
+		defer func() {
+			if err := recover(); err != nil {
+				slog.Error("panic handling request",
+					"method", r.Method,
+					"path", r.URL.Path,
+					"error", err,
+					"stack", string(debug.Stack()),
+				)
+				writeError(tracked)
+			}
+		}()
+		next(tracked, r)
+	}
+}
+
+// isEventStream reports whether a started response is a server-sent event stream
+func isEventStream(w http.ResponseWriter) bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+}
+
+// trackingResponseWriter records whether the response has started, passing flushes
+// through so streaming still works
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+// WriteHeader sends the status line and marks the response as started
+func (t *trackingResponseWriter) WriteHeader(status int) {
+	t.started = true
+	t.ResponseWriter.WriteHeader(status)
+}
+
+// Write sends body data, implicitly starting the response
+func (t *trackingResponseWriter) Write(data []byte) (int, error) {
+	t.started = true
+	return t.ResponseWriter.Write(data)
+}
+
+// Flush sends buffered data to the client
+func (t *trackingResponseWriter) Flush() {
+	t.started = true
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (t *trackingResponseWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
 // Start starts the HTTP server
 func (s *Server) Start() error {
 
-	http.HandleFunc("/v1/messages", loggingMiddleware(s.handleMessages))
-	http.HandleFunc("/health", loggingMiddleware(s.handleHealth))
-	http.HandleFunc("/", loggingMiddleware(s.handleCatchAll))
+	http.HandleFunc("/v1/messages", loggingMiddleware(recoveryMiddleware(s.handleMessages)))
+	http.HandleFunc("/v1/messages/count_tokens", loggingMiddleware(recoveryMiddleware(s.handleCountTokens)))
+	http.HandleFunc("/v1/messages/batches", loggingMiddleware(recoveryMiddleware(s.handleBatches)))
+	http.HandleFunc("/v1/messages/batches/", loggingMiddleware(recoveryMiddleware(s.handleBatches)))
+	http.HandleFunc("/v1/chat/completions", loggingMiddleware(openAIRecoveryMiddleware(s.handleChatCompletions)))
+	http.HandleFunc("/v1/models", loggingMiddleware(recoveryMiddleware(s.handleModels)))
+	http.HandleFunc("/v1/models/", loggingMiddleware(recoveryMiddleware(s.handleModels)))
+	http.HandleFunc("/health", loggingMiddleware(recoveryMiddleware(s.handleHealth)))
+	http.HandleFunc("/", loggingMiddleware(recoveryMiddleware(s.handleCatchAll)))
+
+	s.batches.resume()
 
 	slog.Info("starting server", "port", s.cfg.Port)
 
@@ -71,22 +179,29 @@ func (s *Server) handleCatchAll(w http.ResponseWriter, r *http.Request) {
 		"remote_addr", r.RemoteAddr,
 		"user_agent", r.Header.Get("User-Agent"),
 	)
-	http.Error(w, "404 page not found", http.StatusNotFound)
+	transform.WriteError(w, http.StatusNotFound, "Not found: "+r.URL.Path)
+}
+
+// newRequestID returns a unique ID for correlating the logs of a single request
+func newRequestID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
 }
 
 func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	ctx := r.Context()
+	requestID := newRequestID()
+	w.Header().Set("request-id", requestID)
 
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		transform.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	// Read and parse request
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		transform.WriteError(w, http.StatusBadRequest, "Failed to read request body")
 		return
 	}
 
@@ -94,17 +209,39 @@ func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 
 	var req transform.AnthropicRequest
 	if unmarshalErr := json.Unmarshal(body, &req); unmarshalErr != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		transform.WriteError(w, http.StatusBadRequest, "Invalid JSON: "+unmarshalErr.Error())
 		return
 	}
+	req.RequestID = requestID
 
 	slog.Info("request received",
+		"request_id", requestID,
 		"method", "POST",
 		"path", "/v1/messages",
 		"model", req.Model,
 		"stream", req.Stream,
 	)
 
+	s.forwardMessage(w, r, req, body)
+}
+
+// forwardMessage translates a parsed Messages request, sends it upstream and writes the
+// translated response. Anthropic-format upstreams receive the original body instead.
+func (s *Server) forwardMessage(w http.ResponseWriter, r *http.Request, req transform.AnthropicRequest, body []byte) {
+	route, err := s.upstreamFor(req.Model)
+	if err != nil {
+		transform.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if route.Format == config.UpstreamFormatAnthropic {
+		s.forwardAnthropic(w, r, req, body, route)
+		return
+	}
+
+	start := time.Now()
+	ctx := r.Context()
+	requestID := req.RequestID
+
 	// Transform to OpenAI format
 	openAIReq := transform.AnthropicToOpenAI(req, s.cfg)
 
@@ -115,41 +252,36 @@ func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	slog.Info("routing request",
+		"request_id", requestID,
 		"from_model", req.Model,
 		"to_model", openAIReq.Model,
+		"upstream", route.Name,
 		"provider", providerInfo,
 	)
 
 	openAIBody, err := json.Marshal(openAIReq)
 	if err != nil {
-		http.Error(w, "Failed to marshal OpenAI request", http.StatusInternalServerError)
+		transform.WriteError(w, http.StatusInternalServerError, "Failed to marshal OpenAI request")
 		return
 	}
 
 	slog.Debug("transformed request", "body", string(openAIBody))
 
-	// Forward to OpenRouter
-	client := &http.Client{}
-	url := s.cfg.BaseURL + "/v1/chat/completions"
-	openRouterReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(openAIBody))
+	// Estimate input tokens only for responses where the upstream reports no usage
+	estimateInputTokens := sync.OnceValue(func() int {
+		return transform.CountInputTokens(req, s.tokenizers.ForModel(openAIReq.Model))
+	})
+
+	// Forward to the upstream
+	upstreamReq, err := s.newUpstreamRequest(r, route, openAIBody)
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		transform.WriteError(w, http.StatusInternalServerError, "Failed to create request")
 		return
 	}
 
-	// Copy headers
-	openRouterReq.Header.Set("Content-Type", "application/json")
-	openRouterReq.Header.Set("Authorization", "Bearer "+s.cfg.APIKey)
-	openRouterReq.Header.Set("HTTP-Referer", "https://github.com/martinffx/athena")
-	openRouterReq.Header.Set("X-Title", "Athena Proxy")
-
-	if userAgent := r.Header.Get("User-Agent"); userAgent != "" {
-		openRouterReq.Header.Set("User-Agent", userAgent)
-	}
-
-	resp, err := client.Do(openRouterReq)
+	resp, err := http.DefaultClient.Do(upstreamReq)
 	if err != nil {
-		http.Error(w, "Failed to connect to OpenRouter", http.StatusBadGateway)
+		transform.WriteError(w, http.StatusBadGateway, "Failed to connect to upstream")
 		return
 	}
 	defer resp.Body.Close()
@@ -166,7 +298,8 @@ func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 	if resp.StatusCode >= 400 {
 		// Read and log error responses with full body
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		slog.Error("error response from OpenRouter",
+		slog.Error("error response from upstream",
+			"request_id", requestID,
 			"status", resp.StatusCode,
 			"duration_ms", duration.Milliseconds(),
 			"actual_provider", actualProvider,
@@ -177,6 +310,7 @@ func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 	} else {
 		// Log success at INFO level without body
 		slog.Info("response received",
+			"request_id", requestID,
 			"status", resp.StatusCode,
 			"duration_ms", duration.Milliseconds(),
 			"actual_provider", actualProvider,
@@ -191,9 +325,186 @@ func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Handle response based on streaming
+	opts := transform.ResponseOptions{
+		ToolNames:           openAIReq.ToolNames,
+		EstimateInputTokens: estimateInputTokens,
+		StrictToolSchemas:   openAIReq.StrictToolSchemas,
+		WebSearchDomains:    openAIReq.WebSearchDomains,
+		MaxSSELineSize:      s.cfg.MaxSSELineBytes,
+	}
 	if req.Stream {
-		transform.HandleStreaming(w, resp, openAIReq.Model)
+		transform.HandleStreaming(w, resp, openAIReq.Model, opts)
 	} else {
-		transform.HandleNonStreaming(w, resp, openAIReq.Model)
+		transform.HandleNonStreaming(w, resp, openAIReq.Model, opts)
+	}
+}
+
+// upstreamRoute is a resolved upstream and the name it is configured under, "default"
+// for the top-level base_url
+type upstreamRoute struct {
+	Name string
+	config.Upstream
+}
+
+// upstreamFor returns the upstream a requested model is routed to
+func (s *Server) upstreamFor(model string) (upstreamRoute, error) {
+	name := transform.GetUpstreamForModel(model, s.cfg)
+	upstream, ok := s.cfg.ResolveUpstream(name)
+	if !ok {
+		return upstreamRoute{}, fmt.Errorf("unknown upstream %q", name)
+	}
+	if name == "" {
+		name = "default"
+	}
+	return upstreamRoute{Name: name, Upstream: upstream}, nil
+}
+
+// endpoint returns the URL for a request to the upstream, using its configured path in
+// place of defaultPath when set
+func (u upstreamRoute) endpoint(defaultPath string) string {
+	if u.Path != "" {
+		return u.BaseURL + u.Path
+	}
+	return u.BaseURL + defaultPath
+}
+
+// modelsURL returns the upstream's /models endpoint, beside the configured path when
+// one replaces the default
+func (u upstreamRoute) modelsURL() string {
+	prefix := "/v1"
+	if u.Path != "" {
+		prefix = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/chat/completions"), "/messages")
+	}
+	return u.BaseURL + prefix + "/models"
+}
+
+// setHeaders adds the upstream's custom headers, which override any already set
+func (u upstreamRoute) setHeaders(req *http.Request) {
+	for key, value := range u.Headers {
+		req.Header.Set(key, value)
+	}
+}
+
+// newUpstreamRequest creates a chat completions request to an OpenAI-format upstream,
+// forwarding the client's User-Agent
+func (s *Server) newUpstreamRequest(r *http.Request, route upstreamRoute, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), "POST", route.endpoint("/v1/chat/completions"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if route.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+route.APIKey)
+	}
+	req.Header.Set("HTTP-Referer", "https://github.com/martinffx/athena")
+	req.Header.Set("X-Title", "Athena Proxy")
+
+	if userAgent := r.Header.Get("User-Agent"); userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	route.setHeaders(req)
+	return req, nil
+}
+
+// handleCountTokens answers count_tokens with a local estimate, or with the upstream's
+// prompt token count when token_counting is "upstream"
+func (s *Server) handleCountTokens(w http.ResponseWriter, r *http.Request) {
+	requestID := newRequestID()
+	w.Header().Set("request-id", requestID)
+
+	if r.Method != "POST" {
+		transform.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req transform.AnthropicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		transform.WriteError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	req.RequestID = requestID
+
+	var inputTokens int
+	source := config.TokenCountingLocal
+	if s.cfg.TokenCounting == config.TokenCountingUpstream {
+		if upstreamTokens, err := s.countUpstreamTokens(r, req); err != nil {
+			slog.Warn("upstream token count failed, using local estimate",
+				"request_id", requestID,
+				"error", err,
+			)
+		} else {
+			inputTokens = upstreamTokens
+			source = config.TokenCountingUpstream
+		}
+	}
+	if source == config.TokenCountingLocal {
+		mappedModel := transform.MapModel(req.Model, s.cfg)
+		inputTokens = transform.CountInputTokens(req, s.tokenizers.ForModel(mappedModel))
+	}
+
+	slog.Info("tokens counted",
+		"request_id", requestID,
+		"model", req.Model,
+		"input_tokens", inputTokens,
+		"source", source,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"input_tokens": inputTokens}); err != nil {
+		slog.Error("failed to encode count_tokens response", "error", err)
+	}
+}
+
+// countUpstreamTokens sends the request upstream with max_tokens 1 and returns the
+// reported prompt tokens
+func (s *Server) countUpstreamTokens(r *http.Request, req transform.AnthropicRequest) (int, error) {
+	route, err := s.upstreamFor(req.Model)
+	if err != nil {
+		return 0, err
+	}
+	if route.Format == config.UpstreamFormatAnthropic {
+		return s.countAnthropicTokens(r, route, req)
+	}
+
+	req.MaxTokens = 1
+	req.Stream = false
+	req.Thinking = nil
+
+	// Server tools would run a paid web search, which adds nothing to the prompt count
+	openAIReq := transform.AnthropicToOpenAI(req, s.cfg)
+	openAIReq.Plugins = nil
+	openAIReq.Model = strings.TrimSuffix(openAIReq.Model, ":online")
+
+	body, err := json.Marshal(openAIReq)
+	if err != nil {
+		return 0, err
+	}
+	upstreamReq, err := s.newUpstreamRequest(r, route, body)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := http.DefaultClient.Do(upstreamReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, transform.UpstreamError(resp, respBody)
+	}
+
+	var openAIResp transform.OpenAIResponse
+	if err := json.Unmarshal(respBody, &openAIResp); err != nil {
+		return 0, err
+	}
+	if openAIResp.Usage == nil {
+		return 0, fmt.Errorf("upstream response has no usage")
 	}
+	return openAIResp.Usage.PromptTokens, nil
 }
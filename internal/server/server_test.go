@@ -331,6 +331,184 @@ func TestHandleMessages_OpenRouterError(t *testing.T) {
 	if resp.StatusCode != http.StatusUnauthorized {
 		t.Errorf("Status code = %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
 	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	errObj, ok := body["error"].(map[string]interface{})
+	if body["type"] != "error" || !ok || errObj["type"] != "authentication_error" {
+		t.Errorf("Response = %v, expected authentication_error envelope", body)
+	}
+}
+
+func TestHandleMessages_RequestID(t *testing.T) {
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"Hi"},"finish_reason":"stop"}]}`))
+	}))
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "test/model"})
+
+	ids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model":"claude-3-5-sonnet","messages":[{"role":"user","content":"Hello"}]}`))
+		w := httptest.NewRecorder()
+
+		srv.handleMessages(w, req)
+
+		id := w.Header().Get("request-id")
+		if !strings.HasPrefix(id, "req_") {
+			t.Errorf("request-id = %q, expected a req_ ID", id)
+		}
+		ids[id] = true
+	}
+	if len(ids) != 2 {
+		t.Errorf("Expected a distinct request ID per request, got %v", ids)
+	}
+}
+
+func TestHandleMessages_RateLimited(t *testing.T) {
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error":{"message":"Rate limit exceeded","code":429}}`))
+	}))
+	defer openRouterServer.Close()
+
+	cfg := &config.Config{
+		APIKey:      "test-key",
+		BaseURL:     openRouterServer.URL,
+		SonnetModel: "test/sonnet",
+	}
+	srv := New(cfg)
+
+	reqJSON := []byte(`{"model":"claude-3-5-sonnet","stream":true,"messages":[{"role":"user","content":"Hello"}]}`)
+	req := httptest.NewRequest("POST", "/v1/messages", bytes.NewReader(reqJSON))
+	w := httptest.NewRecorder()
+
+	srv.handleMessages(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Status code = %d, expected %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, expected %q", got, "30")
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	errObj, ok := body["error"].(map[string]interface{})
+	if !ok || errObj["type"] != "rate_limit_error" || errObj["message"] != "Rate limit exceeded" {
+		t.Errorf("Error = %v, expected rate_limit_error", body["error"])
+	}
+}
+
+func TestHandleCountTokens_Local(t *testing.T) {
+	srv := New(&config.Config{Model: "test/model", TokenCounting: config.TokenCountingLocal})
+
+	count := func(body string) int {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/v1/messages/count_tokens", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		srv.handleCountTokens(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Status code = %d, body %s", w.Code, w.Body.String())
+		}
+		var result map[string]int
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return result["input_tokens"]
+	}
+
+	short := count(`{"model":"claude-3-5-sonnet","messages":[{"role":"user","content":"Hello"}]}`)
+	long := count(`{"model":"claude-3-5-sonnet","system":"You are a helpful assistant.","messages":[{"role":"user","content":"Hello, please explain how the proxy translates tool calls."}]}`)
+	if short <= 0 || long <= short {
+		t.Errorf("Token counts short = %d, long = %d, expected positive and growing", short, long)
+	}
+}
+
+func TestHandleCountTokens_Upstream(t *testing.T) {
+	var upstreamReq map[string]interface{}
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&upstreamReq)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"H"},"finish_reason":"length"}],"usage":{"prompt_tokens":123,"completion_tokens":1}}`))
+	}))
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "test/model", TokenCounting: config.TokenCountingUpstream})
+
+	req := httptest.NewRequest("POST", "/v1/messages/count_tokens", strings.NewReader(`{"model":"claude-3-5-sonnet","stream":true,"messages":[{"role":"user","content":"Hello"}]}`))
+	w := httptest.NewRecorder()
+
+	srv.handleCountTokens(w, req)
+
+	if !strings.Contains(w.Body.String(), `"input_tokens":123`) {
+		t.Errorf("Body = %s, expected the upstream prompt tokens", w.Body.String())
+	}
+	if upstreamReq["max_tokens"] != float64(1) || upstreamReq["stream"] != nil {
+		t.Errorf("Upstream request = %v, expected max_tokens 1 without streaming", upstreamReq)
+	}
+}
+
+func TestHandleCountTokens_UpstreamDropsWebSearch(t *testing.T) {
+	for _, mode := range []string{config.WebSearchPlugin, config.WebSearchOnline} {
+		t.Run(mode, func(t *testing.T) {
+			var upstreamReq map[string]interface{}
+			openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewDecoder(r.Body).Decode(&upstreamReq)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"H"},"finish_reason":"length"}],"usage":{"prompt_tokens":42,"completion_tokens":1}}`))
+			}))
+			defer openRouterServer.Close()
+
+			srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "test/model", TokenCounting: config.TokenCountingUpstream, WebSearchMode: mode})
+
+			body := `{"model":"claude-3-5-sonnet","messages":[{"role":"user","content":"Hello"}],"tools":[{"type":"web_search_20250305","name":"web_search"}]}`
+			req := httptest.NewRequest("POST", "/v1/messages/count_tokens", strings.NewReader(body))
+			w := httptest.NewRecorder()
+
+			srv.handleCountTokens(w, req)
+
+			if !strings.Contains(w.Body.String(), `"input_tokens":42`) {
+				t.Errorf("Body = %s, expected the upstream prompt tokens", w.Body.String())
+			}
+			if upstreamReq["plugins"] != nil || upstreamReq["model"] != "test/model" {
+				t.Errorf("Upstream request = %v, expected no web search", upstreamReq)
+			}
+		})
+	}
+}
+
+func TestHandleCountTokens_UpstreamFailureFallsBack(t *testing.T) {
+	openRouterServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer openRouterServer.Close()
+
+	srv := New(&config.Config{BaseURL: openRouterServer.URL, Model: "test/model", TokenCounting: config.TokenCountingUpstream})
+
+	req := httptest.NewRequest("POST", "/v1/messages/count_tokens", strings.NewReader(`{"model":"claude-3-5-sonnet","messages":[{"role":"user","content":"Hello"}]}`))
+	w := httptest.NewRecorder()
+
+	srv.handleCountTokens(w, req)
+
+	var result map[string]int
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || result["input_tokens"] <= 0 {
+		t.Errorf("Body = %v (%v), expected a local estimate", result, err)
+	}
 }
 
 func TestHandleMessages_UserAgentForwarding(t *testing.T) {
@@ -445,3 +623,154 @@ func TestHandleMessages_HeadersSet(t *testing.T) {
 		t.Errorf("Status code = %d, expected %d", resp.StatusCode, http.StatusOK)
 	}
 }
+
+func TestRecoveryMiddleware(t *testing.T) {
+	handler := recoveryMiddleware(func(_ http.ResponseWriter, _ *http.Request) {
+		var resp map[string]interface{}
+		_ = resp["choices"].([]interface{})
+	})
+
+	req := httptest.NewRequest("POST", "/v1/messages", nil)
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Status code = %d, expected %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if body["type"] != "error" {
+		t.Errorf("Response type = %v, expected %q", body["type"], "error")
+	}
+
+	errObj, ok := body["error"].(map[string]interface{})
+	if !ok || errObj["type"] != "api_error" {
+		t.Errorf("Error = %v, expected api_error", body["error"])
+	}
+}
+
+func TestRecoveryMiddleware_StreamStarted(t *testing.T) {
+	handler := recoveryMiddleware(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("event: message_start\ndata: {\"type\":\"message_start\"}\n\n"))
+		w.(http.Flusher).Flush()
+		panic("stream translation failed")
+	})
+
+	req := httptest.NewRequest("POST", "/v1/messages", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusOK || !w.Flushed {
+		t.Errorf("Status = %d, flushed = %v, expected the stream's original status", w.Code, w.Flushed)
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "event: message_start") || !strings.HasSuffix(body, "event: error\ndata: {\"error\":{\"message\":\"Internal server error\",\"type\":\"api_error\"},\"type\":\"error\"}\n\n") {
+		t.Errorf("Stream = %q, expected it to end with an error event", body)
+	}
+}
+
+func TestOpenAIRecoveryMiddleware(t *testing.T) {
+	handler := openAIRecoveryMiddleware(func(_ http.ResponseWriter, _ *http.Request) {
+		panic("relay failed")
+	})
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Status code = %d, expected %d", w.Code, http.StatusInternalServerError)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"type":"server_error"`) || strings.Contains(body, `"api_error"`) {
+		t.Errorf("Body = %s, expected an OpenAI-format error", body)
+	}
+}
+
+func TestOpenAIRecoveryMiddleware_StreamStarted(t *testing.T) {
+	handler := openAIRecoveryMiddleware(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"choices\":[]}\n\n"))
+		panic("relay failed")
+	})
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	expected := "data: {\"choices\":[]}\n\ndata: {\"error\":{\"code\":500,\"message\":\"Internal server error\",\"type\":\"server_error\"}}\n\n"
+	if w.Code != http.StatusOK || w.Body.String() != expected {
+		t.Errorf("Stream = %d %q, expected it to end with an error chunk", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleMessages_NamedUpstreams(t *testing.T) {
+	var ollamaPath, ollamaAuth, ollamaHeader, ollamaModel string
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ollamaPath, ollamaAuth, ollamaHeader = r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("X-Team")
+		var req map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		ollamaModel, _ = req["model"].(string)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"local"},"finish_reason":"stop"}]}`))
+	}))
+	defer ollama.Close()
+
+	var anthropicKey string
+	anthropic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		anthropicKey = r.Header.Get("x-api-key")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"type":"message","content":[{"type":"text","text":"remote"}]}`))
+	}))
+	defer anthropic.Close()
+
+	srv := New(&config.Config{
+		APIKey:     "openrouter-key",
+		BaseURL:    "http://127.0.0.1:1",
+		Model:      "moonshotai/kimi-k2",
+		OpusModel:  "claude-opus-4-1",
+		HaikuModel: "qwen3:8b",
+		Upstreams: map[string]config.Upstream{
+			"anthropic": {BaseURL: anthropic.URL, APIKey: "sk-ant", Format: config.UpstreamFormatAnthropic},
+			"ollama":    {BaseURL: ollama.URL, Path: "/ollama/v1/chat/completions", Headers: map[string]string{"X-Team": "evals"}},
+		},
+		OpusUpstream:  "anthropic",
+		HaikuUpstream: "ollama",
+	})
+
+	send := func(model string) *httptest.ResponseRecorder {
+		body := `{"model":"` + model + `","max_tokens":10,"messages":[{"role":"user","content":"Hi"}]}`
+		w := httptest.NewRecorder()
+		srv.handleMessages(w, httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body)))
+		return w
+	}
+
+	if w := send("claude-3-5-haiku"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "local") {
+		t.Errorf("Haiku response = %d %s", w.Code, w.Body.String())
+	}
+	if ollamaPath != "/ollama/v1/chat/completions" || ollamaAuth != "" || ollamaHeader != "evals" || ollamaModel != "qwen3:8b" {
+		t.Errorf("Ollama request = path %q, auth %q, header %q, model %q", ollamaPath, ollamaAuth, ollamaHeader, ollamaModel)
+	}
+
+	if w := send("claude-opus-4"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "remote") {
+		t.Errorf("Opus response = %d %s", w.Code, w.Body.String())
+	}
+	if anthropicKey != "sk-ant" {
+		t.Errorf("Anthropic upstream key = %q, expected the upstream's own key", anthropicKey)
+	}
+
+	// OpenAI clients cannot reach an Anthropic-format upstream
+	w := httptest.NewRecorder()
+	srv.handleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"opus","messages":[]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Chat completions to an Anthropic upstream: status code = %d, expected 400", w.Code)
+	}
+}
@@ -0,0 +1,228 @@
+//go:build ignore
+
+// gen_table trains the embedded generic BPE table from the Go distribution's source
+// and documentation, a mix of code and English prose similar to coding agent prompts.
+// The result only approximates real model vocabularies such as cl100k or o200k.
+//
+//	go run gen_table.go -root "$(go env GOROOT)" -vocab 16384 -out tables/generic.tiktoken
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// pretokenize must match the pattern the tokenizer splits text with
+var pretokenize = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+type pair struct{ a, b int }
+
+type pairHeap []pairCount
+
+type pairCount struct {
+	pair
+	count int
+}
+
+func (h pairHeap) Len() int { return len(h) }
+func (h pairHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count > h[j].count
+	}
+	if h[i].a != h[j].a {
+		return h[i].a < h[j].a
+	}
+	return h[i].b < h[j].b
+}
+func (h pairHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pairHeap) Push(x interface{}) { *h = append(*h, x.(pairCount)) }
+func (h *pairHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+type word struct {
+	tokens []int
+	count  int
+}
+
+func main() {
+	root := flag.String("root", "", "Go distribution root to read the corpus from")
+	vocab := flag.Int("vocab", 16384, "vocabulary size including the 256 byte tokens")
+	maxBytes := flag.Int("max-bytes", 32<<20, "maximum corpus size")
+	out := flag.String("out", "tables/generic.tiktoken", "output table path")
+	flag.Parse()
+	if *root == "" {
+		log.Fatal("-root is required")
+	}
+
+	counts := readCorpus(*root, *maxBytes)
+	words := make([]*word, 0, len(counts))
+	keys := make([]string, 0, len(counts))
+	for piece, count := range counts {
+		if count > 1 {
+			keys = append(keys, piece)
+		}
+	}
+	sort.Strings(keys)
+	for _, piece := range keys {
+		tokens := make([]int, len(piece))
+		for i := 0; i < len(piece); i++ {
+			tokens[i] = int(piece[i])
+		}
+		words = append(words, &word{tokens: tokens, count: counts[piece]})
+	}
+
+	vocabulary := make([][]byte, 256)
+	for i := range vocabulary {
+		vocabulary[i] = []byte{byte(i)}
+	}
+
+	pairCounts := map[pair]int{}
+	pairWords := map[pair]map[int]bool{}
+	for i, w := range words {
+		addPairs(pairCounts, pairWords, i, w, 1)
+	}
+	queue := &pairHeap{}
+	for p, count := range pairCounts {
+		*queue = append(*queue, pairCount{p, count})
+	}
+	heap.Init(queue)
+
+	for len(vocabulary) < *vocab && queue.Len() > 0 {
+		// Entries are pushed on every count change, so skip stale ones
+		top := heap.Pop(queue).(pairCount)
+		if pairCounts[top.pair] != top.count {
+			continue
+		}
+		best := top.pair
+		if top.count < 2 {
+			break
+		}
+
+		id := len(vocabulary)
+		vocabulary = append(vocabulary, append(append([]byte(nil), vocabulary[best.a]...), vocabulary[best.b]...))
+
+		affected := make([]int, 0, len(pairWords[best]))
+		for i := range pairWords[best] {
+			affected = append(affected, i)
+		}
+		sort.Ints(affected)
+		for _, i := range affected {
+			w := words[i]
+			addPairs(pairCounts, pairWords, i, w, -1)
+			merged := w.tokens[:0:0]
+			for j := 0; j < len(w.tokens); j++ {
+				if j+1 < len(w.tokens) && w.tokens[j] == best.a && w.tokens[j+1] == best.b {
+					merged = append(merged, id)
+					j++
+					continue
+				}
+				merged = append(merged, w.tokens[j])
+			}
+			w.tokens = merged
+			for _, p := range addPairs(pairCounts, pairWords, i, w, 1) {
+				heap.Push(queue, pairCount{p, pairCounts[p]})
+			}
+		}
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bw := bufio.NewWriter(f)
+	for rank, token := range vocabulary {
+		fmt.Fprintf(bw, "%s %d\n", base64.StdEncoding.EncodeToString(token), rank)
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d tokens to %s", len(vocabulary), *out)
+}
+
+// addPairs adds (or with delta -1 removes) a word's adjacent token pairs to the counts,
+// returning the pairs it touched
+func addPairs(counts map[pair]int, index map[pair]map[int]bool, i int, w *word, delta int) []pair {
+	var touched []pair
+	for j := 0; j+1 < len(w.tokens); j++ {
+		p := pair{w.tokens[j], w.tokens[j+1]}
+		touched = append(touched, p)
+		counts[p] += delta * w.count
+		if counts[p] <= 0 {
+			delete(counts, p)
+		}
+		if delta > 0 {
+			if index[p] == nil {
+				index[p] = map[int]bool{}
+			}
+			index[p][i] = true
+		} else if index[p] != nil {
+			delete(index[p], i)
+		}
+	}
+	return touched
+}
+
+// readCorpus counts the pre-tokenized pieces of the distribution's Go source and docs
+func readCorpus(root string, maxBytes int) map[string]int {
+	var paths []string
+	for _, dir := range []string{"doc", "src"} {
+		_ = filepath.WalkDir(filepath.Join(root, dir), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() && (d.Name() == "testdata" || d.Name() == "vendor") {
+				return filepath.SkipDir
+			}
+			ext := filepath.Ext(path)
+			if !d.IsDir() && (ext == ".go" || ext == ".md" || ext == ".html") && !strings.HasSuffix(path, "_test.go") {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+	}
+	sort.Strings(paths)
+
+	// Sample evenly across the tree rather than reading the first packages in full
+	size := 0
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			size += int(info.Size())
+		}
+	}
+	stride := size/maxBytes + 1
+
+	counts := map[string]int{}
+	total := 0
+	for n, path := range paths {
+		if n%stride != 0 {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || total+len(data) > maxBytes {
+			continue
+		}
+		total += len(data)
+		for _, piece := range pretokenize.FindAllString(string(data), -1) {
+			counts[piece]++
+		}
+	}
+	log.Printf("read %d bytes from %d files", total, len(paths))
+	return counts
+}
@@ -0,0 +1,273 @@
+// Package tokenizer is a heuristic token estimator that runs locally, without calling
+// the upstream.
+//
+// The embedded table is a single generic 16K vocabulary trained on Go source and docs.
+// It is not the vocabulary of cl100k, o200k or any other upstream model family, so its
+// counts are estimates that can differ from what the upstream bills. Configure a
+// family's own tiktoken table, or count with the upstream, where exact counts matter.
+package tokenizer
+
+//go:generate go run gen_table.go -root $GOROOT -vocab 16384 -out tables/generic.tiktoken
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"athena/internal/config"
+)
+
+const (
+	// DefaultCharsPerToken is the character ratio used when no BPE table is available
+	DefaultCharsPerToken = 3.5
+	// maxPieceBytes bounds the pieces encoded with BPE; longer runs such as base64 blobs
+	// are estimated by character ratio to avoid quadratic merging
+	maxPieceBytes = 256
+	// maxCacheEntries bounds the per-tokenizer piece cache before it is reset
+	maxCacheEntries = 1 << 16
+)
+
+//go:embed tables/*.tiktoken
+var tables embed.FS
+
+// pretokenize splits text into the pieces BPE merges within, following the GPT-4 pattern
+// without its lookahead. It must match the pattern in gen_table.go.
+var pretokenize = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// Tokenizer counts the tokens in a piece of text
+type Tokenizer interface {
+	Count(text string) int
+}
+
+// CharRatio estimates tokens from the character count. Wide characters such as CJK are
+// counted as a token each, since BPE vocabularies rarely merge them.
+type CharRatio struct {
+	CharsPerToken float64
+}
+
+// Count returns the estimated number of tokens in text
+func (c CharRatio) Count(text string) int {
+	ratio := c.CharsPerToken
+	if ratio <= 0 {
+		ratio = DefaultCharsPerToken
+	}
+
+	narrow, wide := 0, 0
+	for _, r := range text {
+		if isWide(r) {
+			wide++
+		} else {
+			narrow++
+		}
+	}
+	return wide + int(math.Ceil(float64(narrow)/ratio))
+}
+
+// isWide reports whether a rune is from a script BPE tables usually encode per character
+func isWide(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// BPE counts tokens with a byte-level BPE rank table in tiktoken format
+type BPE struct {
+	ranks    map[string]int
+	fallback CharRatio
+
+	mu    sync.Mutex
+	cache map[string]int
+}
+
+// NewBPE creates a tokenizer from token ranks, where lower ranks merge first
+func NewBPE(ranks map[string]int) *BPE {
+	return &BPE{ranks: ranks, cache: make(map[string]int)}
+}
+
+// Count returns the number of tokens in text
+func (b *BPE) Count(text string) int {
+	total := 0
+	for _, piece := range pretokenize.FindAllString(text, -1) {
+		total += b.countPiece(piece)
+	}
+	return total
+}
+
+// countPiece returns the number of tokens in a single pre-tokenized piece
+func (b *BPE) countPiece(piece string) int {
+	if _, ok := b.ranks[piece]; ok {
+		return 1
+	}
+	if len(piece) > maxPieceBytes {
+		return b.fallback.Count(piece)
+	}
+
+	b.mu.Lock()
+	count, ok := b.cache[piece]
+	b.mu.Unlock()
+	if ok {
+		return count
+	}
+
+	count = b.merge(piece)
+	b.mu.Lock()
+	if len(b.cache) >= maxCacheEntries {
+		b.cache = make(map[string]int)
+	}
+	b.cache[piece] = count
+	b.mu.Unlock()
+	return count
+}
+
+// merge applies BPE merges to a piece, lowest rank first, and returns the part count
+func (b *BPE) merge(piece string) int {
+	// boundaries holds the start offset of each part, followed by the end of the piece
+	boundaries := make([]int, len(piece)+1)
+	for i := range boundaries {
+		boundaries[i] = i
+	}
+
+	for len(boundaries) > 2 {
+		best, bestRank := -1, math.MaxInt
+		for i := 0; i+2 < len(boundaries); i++ {
+			if rank, ok := b.ranks[piece[boundaries[i]:boundaries[i+2]]]; ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		boundaries = append(boundaries[:best+1], boundaries[best+2:]...)
+	}
+	return len(boundaries) - 1
+}
+
+// ParseTiktoken reads a rank table in tiktoken format: one base64 token and its rank per line
+func ParseTiktoken(r io.Reader) (map[string]int, error) {
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a token and a rank", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid token: %w", line, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid rank: %w", line, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranks, nil
+}
+
+var (
+	genericOnce sync.Once
+	generic     Tokenizer
+)
+
+// Generic returns the heuristic estimator built from the embedded generic table. It
+// approximates, rather than reproduces, upstream vocabularies, and falls back to a
+// character ratio if the table can't be read.
+func Generic() Tokenizer {
+	genericOnce.Do(func() {
+		generic = CharRatio{CharsPerToken: DefaultCharsPerToken}
+		data, err := tables.ReadFile("tables/generic.tiktoken")
+		if err != nil {
+			slog.Error("failed to read embedded tokenizer table", "error", err)
+			return
+		}
+		ranks, err := ParseTiktoken(bytes.NewReader(data))
+		if err != nil {
+			slog.Error("failed to parse embedded tokenizer table", "error", err)
+			return
+		}
+		generic = NewBPE(ranks)
+	})
+	return generic
+}
+
+// Registry selects a tokenizer per upstream model, using configured tables for matching
+// model families and the embedded table otherwise
+type Registry struct {
+	families []family
+}
+
+// family is a tokenizer and the model patterns it serves
+type family struct {
+	models    []string
+	tokenizer Tokenizer
+}
+
+// NewRegistry loads the configured tokenizer tables. Tables that fail to load are
+// skipped with a warning, so their models use the embedded table.
+func NewRegistry(configured []config.TokenizerTable) *Registry {
+	r := &Registry{}
+	for _, table := range configured {
+		tokenizer, err := loadTable(table)
+		if err != nil {
+			slog.Warn("failed to load tokenizer table", "path", table.Path, "error", err)
+			continue
+		}
+		r.families = append(r.families, family{models: table.Models, tokenizer: tokenizer})
+	}
+	return r
+}
+
+// loadTable reads a configured table, or returns a character ratio tokenizer for
+// entries that only set a ratio
+func loadTable(table config.TokenizerTable) (Tokenizer, error) {
+	if table.Path == "" {
+		if table.CharsPerToken <= 0 {
+			return nil, fmt.Errorf("either path or chars_per_token is required")
+		}
+		return CharRatio{CharsPerToken: table.CharsPerToken}, nil
+	}
+
+	f, err := os.Open(table.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	ranks, err := ParseTiktoken(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewBPE(ranks), nil
+}
+
+// ForModel returns the tokenizer for an upstream model, matching configured families by substring
+func (r *Registry) ForModel(model string) Tokenizer {
+	if r != nil {
+		for _, f := range r.families {
+			for _, pattern := range f.models {
+				if pattern != "" && strings.Contains(model, pattern) {
+					return f.tokenizer
+				}
+			}
+		}
+	}
+	return Generic()
+}
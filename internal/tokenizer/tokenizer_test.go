@@ -0,0 +1,137 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"athena/internal/config"
+)
+
+// writeTable writes a tiktoken table with the 256 byte tokens followed by the given merges
+func writeTable(t *testing.T, merges ...string) string {
+	t.Helper()
+	var b strings.Builder
+	rank := 0
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), rank)
+		rank++
+	}
+	for _, merge := range merges {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(merge)), rank)
+		rank++
+	}
+	path := filepath.Join(t.TempDir(), "table.tiktoken")
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	return path
+}
+
+func TestParseTiktoken(t *testing.T) {
+	ranks, err := ParseTiktoken(strings.NewReader("aGVsbG8= 0\n\nIHdvcmxk 1\n"))
+	if err != nil {
+		t.Fatalf("ParseTiktoken() error: %v", err)
+	}
+	if ranks["hello"] != 0 || ranks[" world"] != 1 || len(ranks) != 2 {
+		t.Errorf("Ranks = %v", ranks)
+	}
+
+	for _, input := range []string{"aGVsbG8=\n", "!!! 0\n", "aGVsbG8= x\n"} {
+		if _, err := ParseTiktoken(strings.NewReader(input)); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestBPE_Count(t *testing.T) {
+	f, err := os.Open(writeTable(t, "he", "ll", "hell", "hello", " w", "or", " wor", "ld", " world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ranks, err := ParseTiktoken(f)
+	if err != nil {
+		t.Fatalf("ParseTiktoken() error: %v", err)
+	}
+	bpe := NewBPE(ranks)
+
+	tests := []struct {
+		text     string
+		expected int
+	}{
+		{"hello", 1},
+		{"hello world", 2},
+		{"help", 3},    // he + l + p
+		{" worlds", 2}, // " world" + s
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := bpe.Count(tt.text); got != tt.expected {
+			t.Errorf("Count(%q) = %d, expected %d", tt.text, got, tt.expected)
+		}
+		// Cached counts must match
+		if got := bpe.Count(tt.text); got != tt.expected {
+			t.Errorf("Cached Count(%q) = %d, expected %d", tt.text, got, tt.expected)
+		}
+	}
+
+	long := strings.Repeat("x", 1000)
+	if got := bpe.Count(long); got != (CharRatio{}).Count(long) {
+		t.Errorf("Long pieces should use the character ratio, got %d", got)
+	}
+}
+
+func TestCharRatio_Count(t *testing.T) {
+	if got := (CharRatio{CharsPerToken: 4}).Count("abcdefgh"); got != 2 {
+		t.Errorf("Count = %d, expected 2", got)
+	}
+	if got := (CharRatio{CharsPerToken: 4}).Count("abcde"); got != 2 {
+		t.Errorf("Partial tokens should round up, got %d", got)
+	}
+	if got := (CharRatio{CharsPerToken: 4}).Count("日本語"); got != 3 {
+		t.Errorf("Wide characters should count as a token each, got %d", got)
+	}
+	if got := (CharRatio{}).Count("abcdefg"); got != 2 {
+		t.Errorf("Zero ratio should use the default, got %d", got)
+	}
+}
+
+func TestGeneric(t *testing.T) {
+	if _, ok := Generic().(*BPE); !ok {
+		t.Fatalf("Generic() = %T, expected the embedded BPE table", Generic())
+	}
+
+	text := "func main() {\n\tfmt.Println(\"The quick brown fox jumps over the lazy dog\")\n}\n"
+	got := Generic().Count(text)
+	if got < len(text)/6 || got > len(text)/2 {
+		t.Errorf("Count = %d for %d bytes, expected between 2 and 6 bytes per token", got, len(text))
+	}
+}
+
+func TestRegistry_ForModel(t *testing.T) {
+	registry := NewRegistry([]config.TokenizerTable{
+		{Models: []string{"openai/"}, Path: writeTable(t, "he", "ll", "hello")},
+		{Models: []string{"qwen/"}, CharsPerToken: 2},
+		{Models: []string{"mistralai/"}, Path: filepath.Join(t.TempDir(), "missing.tiktoken")},
+	})
+
+	if got := registry.ForModel("openai/gpt-4o").Count("hello"); got != 1 {
+		t.Errorf("Configured table count = %d, expected 1", got)
+	}
+	if got := registry.ForModel("qwen/qwen3-coder").Count("abcd"); got != 2 {
+		t.Errorf("Configured ratio count = %d, expected 2", got)
+	}
+	if registry.ForModel("mistralai/devstral") != Generic() {
+		t.Error("Models with a table that failed to load should use the embedded table")
+	}
+	if registry.ForModel("moonshotai/kimi-k2") != Generic() {
+		t.Error("Unmatched models should use the embedded table")
+	}
+	if (*Registry)(nil).ForModel("any") != Generic() {
+		t.Error("A nil registry should use the embedded table")
+	}
+}
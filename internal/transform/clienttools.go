@@ -0,0 +1,169 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Anthropic-defined client tool names, which are fixed by the tool type
+const (
+	bashToolName             = "bash"
+	textEditorToolName       = "str_replace_based_edit_tool"
+	legacyTextEditorToolName = "str_replace_editor"
+	computerToolName         = "computer"
+)
+
+// clientToolSpec describes an Anthropic-defined client tool as an OpenAI function.
+// describe builds the description from the tool's options, such as the display size.
+type clientToolSpec struct {
+	name     string
+	describe func(tool Tool) string
+	schema   string
+}
+
+// ToolNameMap maps the tool names an upstream may use in tool calls back to the names
+// the client declared. A nil map leaves names unchanged.
+type ToolNameMap map[string]string
+
+// client returns the client tool name for an upstream tool call name
+func (m ToolNameMap) client(name string) string {
+	if original, ok := m[name]; ok {
+		return original
+	}
+	return name
+}
+
+const bashToolSchema = `{
+	"type": "object",
+	"properties": {
+		"command": {"type": "string", "description": "The bash command to run. Required unless the tool is being restarted."},
+		"restart": {"type": "boolean", "description": "Set to true to restart the bash session."}
+	}
+}`
+
+const textEditorToolSchema = `{
+	"type": "object",
+	"properties": {
+		"command": {"type": "string", "enum": [%s], "description": "The command to run."},
+		"path": {"type": "string", "description": "Absolute path to the file or directory."},
+		"file_text": {"type": "string", "description": "Content of the file to create. Required for create."},
+		"old_str": {"type": "string", "description": "Exact text to replace, which must appear exactly once in the file. Required for str_replace."},
+		"new_str": {"type": "string", "description": "Replacement text for str_replace, or the text to insert for insert."},
+		"insert_line": {"type": "integer", "description": "Line number after which to insert new_str, where 0 inserts at the start. Required for insert."},
+		"view_range": {"type": "array", "items": {"type": "integer"}, "description": "Optional [start, end] line range for view, 1-indexed, where an end of -1 reads to the end of the file."}
+	},
+	"required": ["command", "path"]
+}`
+
+const computerToolSchema = `{
+	"type": "object",
+	"properties": {
+		"action": {"type": "string", "enum": [%s], "description": "The action to perform."},
+		"coordinate": {"type": "array", "items": {"type": "integer"}, "description": "[x, y] pixel position for mouse actions, and the end position for left_click_drag."},
+		"start_coordinate": {"type": "array", "items": {"type": "integer"}, "description": "[x, y] pixel position where left_click_drag starts."},
+		"text": {"type": "string", "description": "Text to type, or the key or key combination (xdotool syntax, e.g. ctrl+s) to press or hold."},
+		"scroll_direction": {"type": "string", "enum": ["up", "down", "left", "right"], "description": "Direction to scroll."},
+		"scroll_amount": {"type": "integer", "description": "Number of scroll wheel clicks."},
+		"duration": {"type": "number", "description": "Seconds to hold the key or wait."}
+	},
+	"required": ["action"]
+}`
+
+// clientToolSpecs are the built-in Anthropic client tool types, keyed by versioned type
+var clientToolSpecs = map[string]clientToolSpec{
+	"bash_20241022": bashTool(),
+	"bash_20250124": bashTool(),
+	"text_editor_20241022": textEditorTool(legacyTextEditorToolName,
+		`"view", "create", "str_replace", "insert", "undo_edit"`),
+	"text_editor_20250124": textEditorTool(legacyTextEditorToolName,
+		`"view", "create", "str_replace", "insert", "undo_edit"`),
+	"text_editor_20250429": textEditorTool(textEditorToolName,
+		`"view", "create", "str_replace", "insert"`),
+	"text_editor_20250728": textEditorTool(textEditorToolName,
+		`"view", "create", "str_replace", "insert"`),
+	"computer_20241022": computerTool(`"key", "type", "mouse_move", "left_click", "left_click_drag", "right_click",
+		"middle_click", "double_click", "screenshot", "cursor_position"`),
+	"computer_20250124": computerTool(`"key", "hold_key", "type", "cursor_position", "mouse_move", "left_mouse_down",
+		"left_mouse_up", "left_click", "left_click_drag", "right_click", "middle_click", "double_click",
+		"triple_click", "scroll", "wait", "screenshot"`),
+}
+
+// clientToolAliases are other names models use for the built-in tools
+var clientToolAliases = map[string][]string{
+	textEditorToolName:       {legacyTextEditorToolName, "text_editor"},
+	legacyTextEditorToolName: {textEditorToolName, "text_editor"},
+}
+
+// bashTool describes the bash tool
+func bashTool() clientToolSpec {
+	return clientToolSpec{
+		name: bashToolName,
+		describe: func(Tool) string {
+			return "Run commands in a persistent bash shell. State such as the working directory and environment " +
+				"variables is kept between calls. Avoid commands that run interactively or produce very large output."
+		},
+		schema: bashToolSchema,
+	}
+}
+
+// textEditorTool describes a text editor tool version with its supported commands
+func textEditorTool(name, commands string) clientToolSpec {
+	return clientToolSpec{
+		name: name,
+		describe: func(tool Tool) string {
+			description := "View, create and edit files. view shows a file with line numbers or lists a directory, " +
+				"create writes a new file, str_replace replaces text that appears exactly once, and insert adds text after a line."
+			if tool.MaxCharacters > 0 {
+				description += fmt.Sprintf(" File views are truncated to %d characters.", tool.MaxCharacters)
+			}
+			return description
+		},
+		schema: fmt.Sprintf(textEditorToolSchema, commands),
+	}
+}
+
+// computerTool describes a computer use tool version with its supported actions
+func computerTool(actions string) clientToolSpec {
+	return clientToolSpec{
+		name: computerToolName,
+		describe: func(tool Tool) string {
+			description := "Control a computer's mouse and keyboard and take screenshots. Take a screenshot before " +
+				"acting to see the current state of the screen."
+			if tool.DisplayWidth > 0 && tool.DisplayHeight > 0 {
+				description += fmt.Sprintf(" The screen is %dx%d pixels.", tool.DisplayWidth, tool.DisplayHeight)
+			}
+			if tool.DisplayNumber != nil {
+				description += fmt.Sprintf(" The X11 display number is %d.", *tool.DisplayNumber)
+			}
+			return description
+		},
+		schema: fmt.Sprintf(computerToolSchema, actions),
+	}
+}
+
+// clientToolFunction expands an Anthropic-defined client tool into a function definition.
+// ok is false for tools that aren't a known client tool type.
+func clientToolFunction(tool Tool) (name, description string, schema json.RawMessage, ok bool) {
+	spec, ok := clientToolSpecs[tool.Type]
+	if !ok {
+		return "", "", nil, false
+	}
+	name = tool.Name
+	if name == "" {
+		name = spec.name
+	}
+	return name, spec.describe(tool), json.RawMessage(spec.schema), true
+}
+
+// addClientToolNames records the names an upstream may call a client tool by, so calls
+// are returned under the name the client declared
+func addClientToolNames(names ToolNameMap, tool Tool, name string) {
+	spec := clientToolSpecs[tool.Type]
+	for _, alias := range append([]string{tool.Type, spec.name}, clientToolAliases[spec.name]...) {
+		if alias != name {
+			if _, taken := names[alias]; !taken {
+				names[alias] = name
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package transform
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"athena/internal/config"
+)
+
+func clientToolsRequest(t *testing.T, tools string) AnthropicRequest {
+	t.Helper()
+	req := AnthropicRequest{
+		Model:    "claude-3-5-sonnet",
+		Messages: []Message{{Role: "user", Content: json.RawMessage(`"Fix the build"`)}},
+	}
+	if err := json.Unmarshal([]byte(tools), &req.Tools); err != nil {
+		t.Fatalf("Failed to unmarshal tools: %v", err)
+	}
+	return req
+}
+
+func TestAnthropicToOpenAI_ClientTools(t *testing.T) {
+	req := clientToolsRequest(t, `[
+		{"type":"bash_20250124","name":"bash"},
+		{"type":"text_editor_20250728","name":"str_replace_based_edit_tool","max_characters":10000},
+		{"type":"computer_20250124","name":"computer","display_width_px":1024,"display_height_px":768,"display_number":1},
+		{"type":"memory_20250818","name":"memory"}
+	]`)
+
+	result := AnthropicToOpenAI(req, &config.Config{Model: "moonshotai/kimi-k2"})
+
+	if len(result.Tools) != 3 {
+		t.Fatalf("Expected 3 function tools with the unknown type dropped, got %d", len(result.Tools))
+	}
+
+	tests := []struct {
+		name        string
+		description string
+		property    string
+	}{
+		{name: "bash", description: "bash shell", property: "command"},
+		{name: "str_replace_based_edit_tool", description: "10000 characters", property: "old_str"},
+		{name: "computer", description: "1024x768 pixels", property: "action"},
+	}
+	for i, tt := range tests {
+		fn := result.Tools[i].Function
+		if fn.Name != tt.name {
+			t.Errorf("Tool %d name = %q, expected %q", i, fn.Name, tt.name)
+		}
+		if !strings.Contains(fn.Description, tt.description) {
+			t.Errorf("Tool %s description = %q, expected it to mention %q", tt.name, fn.Description, tt.description)
+		}
+		var schema struct {
+			Type       string                     `json:"type"`
+			Properties map[string]json.RawMessage `json:"properties"`
+		}
+		if err := json.Unmarshal(fn.Parameters, &schema); err != nil {
+			t.Fatalf("Tool %s parameters are not valid JSON: %v", tt.name, err)
+		}
+		if schema.Type != "object" || schema.Properties[tt.property] == nil {
+			t.Errorf("Tool %s parameters = %s, expected an object with %q", tt.name, fn.Parameters, tt.property)
+		}
+	}
+
+	if strings.Contains(string(result.Tools[1].Function.Parameters), "undo_edit") {
+		t.Error("text_editor_20250728 should not offer undo_edit")
+	}
+	if name := result.ToolNames.client("text_editor_20250728"); name != "str_replace_based_edit_tool" {
+		t.Errorf("Type name maps to %q, expected str_replace_based_edit_tool", name)
+	}
+	if name := result.ToolNames.client("str_replace_editor"); name != "str_replace_based_edit_tool" {
+		t.Errorf("Legacy name maps to %q, expected str_replace_based_edit_tool", name)
+	}
+}
+
+func TestAnthropicToOpenAI_ClientToolAliasesKeepDeclaredTools(t *testing.T) {
+	req := clientToolsRequest(t, `[
+		{"type":"text_editor_20250124","name":"str_replace_editor"},
+		{"name":"text_editor","description":"A custom editor","input_schema":{"type":"object"}}
+	]`)
+
+	result := AnthropicToOpenAI(req, &config.Config{Model: "moonshotai/kimi-k2"})
+
+	if name := result.ToolNames.client("text_editor"); name != "text_editor" {
+		t.Errorf("Declared tool text_editor maps to %q, expected it unchanged", name)
+	}
+	if name := result.ToolNames.client("str_replace_based_edit_tool"); name != "str_replace_editor" {
+		t.Errorf("Newer editor name maps to %q, expected str_replace_editor", name)
+	}
+}
+
+func TestOpenAIToAnthropic_ClientToolNames(t *testing.T) {
+	toolNames := ToolNameMap{"bash_20250124": "bash"}
+	var resp OpenAIResponse
+	if err := json.Unmarshal([]byte(`{"choices":[{"message":{"role":"assistant","content":"","tool_calls":[
+		{"id":"call_1","type":"function","function":{"name":"bash_20250124","arguments":"{\"command\":\"go build ./...\"}"}}
+	]},"finish_reason":"tool_calls"}]}`), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	result, err := OpenAIToAnthropic(resp, "test/model", ResponseOptions{ToolNames: toolNames})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error: %v", err)
+	}
+
+	content := result["content"].([]map[string]interface{})
+	if len(content) != 1 || content[0]["name"] != "bash" {
+		t.Errorf("Content = %v, expected a bash tool_use block", content)
+	}
+}
+
+func TestHandleStreaming_ClientToolNames(t *testing.T) {
+	toolNames := ToolNameMap{"str_replace_editor": "str_replace_based_edit_tool"}
+	streamData := `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"str_replace_editor","arguments":"{\"command\":\"view\",\"path\":\"/tmp/a.go\"}"}}]},"finish_reason":null}]}
+
+data: {"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}
+
+data: [DONE]
+
+`
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(streamData)),
+		Header:     make(http.Header),
+	}
+
+	w := httptest.NewRecorder()
+	HandleStreaming(w, resp, "test/model", ResponseOptions{ToolNames: toolNames})
+
+	body, _ := io.ReadAll(w.Result().Body)
+	if !strings.Contains(string(body), `"name":"str_replace_based_edit_tool"`) {
+		t.Errorf("Expected the tool call under its declared name, got:\n%s", body)
+	}
+}
@@ -0,0 +1,182 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Anthropic error types
+const (
+	ErrorTypeInvalidRequest  = "invalid_request_error"
+	ErrorTypeAuthentication  = "authentication_error"
+	ErrorTypeBilling         = "billing_error"
+	ErrorTypePermission      = "permission_error"
+	ErrorTypeNotFound        = "not_found_error"
+	ErrorTypeRequestTooLarge = "request_too_large"
+	ErrorTypeRateLimit       = "rate_limit_error"
+	ErrorTypeAPI             = "api_error"
+	ErrorTypeTimeout         = "timeout_error"
+	ErrorTypeOverloaded      = "overloaded_error"
+)
+
+// StatusOverloaded is the non-standard status Anthropic uses for overloaded_error
+const StatusOverloaded = 529
+
+// APIError is an error returned to clients in the Anthropic error envelope
+type APIError struct {
+	Status     int
+	Type       string
+	Message    string
+	RetryAfter string
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Type, e.Status, e.Message)
+}
+
+// NewAPIError creates an APIError whose type and status follow Anthropic's conventions for the given status
+func NewAPIError(status int, message string) *APIError {
+	status, errorType := mapErrorStatus(status)
+	return &APIError{
+		Status:  status,
+		Type:    errorType,
+		Message: message,
+	}
+}
+
+// WriteError writes an Anthropic-format error response with the given status and message
+func WriteError(w http.ResponseWriter, status int, message string) {
+	NewAPIError(status, message).Write(w)
+}
+
+// Write sends the error to the client as {"type":"error","error":{...}}
+func (e *APIError) Write(w http.ResponseWriter) {
+	if e.RetryAfter != "" {
+		w.Header().Set("Retry-After", e.RetryAfter)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	if err := json.NewEncoder(w).Encode(e.body()); err != nil {
+		slog.Error("failed to encode error response", "error", err)
+	}
+}
+
+// WriteEvent sends the error as an SSE error event, for streams already under way
+func (e *APIError) WriteEvent(w http.ResponseWriter) {
+	data, err := json.Marshal(e.body())
+	if err != nil {
+		slog.Error("failed to encode error event", "error", err)
+		return
+	}
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// body returns the Anthropic error envelope
+func (e *APIError) body() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "error",
+		"error": map[string]string{
+			"type":    e.Type,
+			"message": e.Message,
+		},
+	}
+}
+
+// UpstreamError builds an APIError from a failed upstream response and its body.
+// OpenRouter error bodies are unwrapped so clients see the provider's message,
+// and a numeric error code in the body takes precedence over the HTTP status.
+func UpstreamError(resp *http.Response, body []byte) *APIError {
+	status := resp.StatusCode
+	message := string(body)
+
+	var parsed struct {
+		Error *OpenAIError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil && parsed.Error != nil {
+		if code := errorCode(parsed.Error.Code); code >= 400 && code < 600 {
+			status = code
+		}
+		message = errorMessage(parsed.Error)
+	}
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+
+	apiErr := NewAPIError(status, message)
+	apiErr.RetryAfter = resp.Header.Get("Retry-After")
+	return apiErr
+}
+
+// openAIError builds an APIError from an error object embedded in an otherwise successful response
+func openAIError(upstream *OpenAIError) *APIError {
+	status := http.StatusBadGateway
+	if code := errorCode(upstream.Code); code >= 400 && code < 600 {
+		status = code
+	}
+	return NewAPIError(status, errorMessage(upstream))
+}
+
+// errorMessage returns an OpenRouter error message, including the provider's raw error when present
+func errorMessage(upstream *OpenAIError) string {
+	message := upstream.Message
+	if upstream.Metadata == nil {
+		return message
+	}
+	if provider, ok := upstream.Metadata["provider_name"].(string); ok && provider != "" {
+		message = provider + ": " + message
+	}
+	if raw, ok := upstream.Metadata["raw"].(string); ok && raw != "" {
+		message += " (" + raw + ")"
+	}
+	return message
+}
+
+// errorCode returns an error code as an int, accepting both numeric and string codes
+func errorCode(code interface{}) int {
+	switch v := code.(type) {
+	case float64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	default:
+		return 0
+	}
+}
+
+// mapErrorStatus maps an HTTP status to the status and error type Anthropic clients expect
+func mapErrorStatus(status int) (int, string) {
+	switch {
+	case status == http.StatusBadRequest:
+		return status, ErrorTypeInvalidRequest
+	case status == http.StatusUnauthorized:
+		return status, ErrorTypeAuthentication
+	case status == http.StatusPaymentRequired:
+		return status, ErrorTypeBilling
+	case status == http.StatusForbidden:
+		return status, ErrorTypePermission
+	case status == http.StatusNotFound:
+		return status, ErrorTypeNotFound
+	case status == http.StatusRequestEntityTooLarge:
+		return status, ErrorTypeRequestTooLarge
+	case status == http.StatusTooManyRequests:
+		return status, ErrorTypeRateLimit
+	case status == http.StatusRequestTimeout, status == http.StatusGatewayTimeout:
+		return status, ErrorTypeTimeout
+	case status == http.StatusServiceUnavailable, status == StatusOverloaded:
+		return StatusOverloaded, ErrorTypeOverloaded
+	case status >= 500:
+		return status, ErrorTypeAPI
+	case status >= 400:
+		return status, ErrorTypeInvalidRequest
+	default:
+		return http.StatusInternalServerError, ErrorTypeAPI
+	}
+}
@@ -0,0 +1,144 @@
+package transform
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewAPIError_StatusMapping(t *testing.T) {
+	tests := []struct {
+		status         int
+		expectedStatus int
+		expectedType   string
+	}{
+		{http.StatusBadRequest, http.StatusBadRequest, ErrorTypeInvalidRequest},
+		{http.StatusUnauthorized, http.StatusUnauthorized, ErrorTypeAuthentication},
+		{http.StatusPaymentRequired, http.StatusPaymentRequired, ErrorTypeBilling},
+		{http.StatusForbidden, http.StatusForbidden, ErrorTypePermission},
+		{http.StatusNotFound, http.StatusNotFound, ErrorTypeNotFound},
+		{http.StatusRequestEntityTooLarge, http.StatusRequestEntityTooLarge, ErrorTypeRequestTooLarge},
+		{http.StatusTooManyRequests, http.StatusTooManyRequests, ErrorTypeRateLimit},
+		{http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, ErrorTypeInvalidRequest},
+		{http.StatusInternalServerError, http.StatusInternalServerError, ErrorTypeAPI},
+		{http.StatusBadGateway, http.StatusBadGateway, ErrorTypeAPI},
+		{http.StatusServiceUnavailable, StatusOverloaded, ErrorTypeOverloaded},
+		{http.StatusGatewayTimeout, http.StatusGatewayTimeout, ErrorTypeTimeout},
+		{StatusOverloaded, StatusOverloaded, ErrorTypeOverloaded},
+		{http.StatusOK, http.StatusInternalServerError, ErrorTypeAPI},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			err := NewAPIError(tt.status, "message")
+			if err.Status != tt.expectedStatus {
+				t.Errorf("Status = %d, expected %d", err.Status, tt.expectedStatus)
+			}
+			if err.Type != tt.expectedType {
+				t.Errorf("Type = %q, expected %q", err.Type, tt.expectedType)
+			}
+		})
+	}
+}
+
+func TestUpstreamError(t *testing.T) {
+	tests := []struct {
+		name            string
+		status          int
+		retryAfter      string
+		body            string
+		expectedStatus  int
+		expectedType    string
+		expectedMessage string
+	}{
+		{
+			name:            "OpenRouter error body",
+			status:          http.StatusPaymentRequired,
+			body:            `{"error":{"message":"Insufficient credits","code":402}}`,
+			expectedStatus:  http.StatusPaymentRequired,
+			expectedType:    ErrorTypeBilling,
+			expectedMessage: "Insufficient credits",
+		},
+		{
+			name:            "provider error with raw metadata",
+			status:          http.StatusBadGateway,
+			body:            `{"error":{"message":"Provider returned error","code":429,"metadata":{"provider_name":"Anthropic","raw":"overloaded"}}}`,
+			retryAfter:      "5",
+			expectedStatus:  http.StatusTooManyRequests,
+			expectedType:    ErrorTypeRateLimit,
+			expectedMessage: "Anthropic: Provider returned error (overloaded)",
+		},
+		{
+			name:            "plain text body",
+			status:          http.StatusServiceUnavailable,
+			body:            "upstream unavailable",
+			expectedStatus:  StatusOverloaded,
+			expectedType:    ErrorTypeOverloaded,
+			expectedMessage: "upstream unavailable",
+		},
+		{
+			name:            "empty body",
+			status:          http.StatusNotFound,
+			expectedStatus:  http.StatusNotFound,
+			expectedType:    ErrorTypeNotFound,
+			expectedMessage: "Not Found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+
+			err := UpstreamError(resp, []byte(tt.body))
+
+			if err.Status != tt.expectedStatus {
+				t.Errorf("Status = %d, expected %d", err.Status, tt.expectedStatus)
+			}
+			if err.Type != tt.expectedType {
+				t.Errorf("Type = %q, expected %q", err.Type, tt.expectedType)
+			}
+			if err.Message != tt.expectedMessage {
+				t.Errorf("Message = %q, expected %q", err.Message, tt.expectedMessage)
+			}
+			if err.RetryAfter != tt.retryAfter {
+				t.Errorf("RetryAfter = %q, expected %q", err.RetryAfter, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestAPIError_Write(t *testing.T) {
+	apiErr := NewAPIError(http.StatusTooManyRequests, "slow down")
+	apiErr.RetryAfter = "10"
+
+	w := httptest.NewRecorder()
+	apiErr.Write(w)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status code = %d, expected %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After = %q, expected %q", got, "10")
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, expected %q", got, "application/json")
+	}
+
+	var body struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if body.Type != "error" || body.Error.Type != ErrorTypeRateLimit || body.Error.Message != "slow down" {
+		t.Errorf("Body = %+v, expected rate_limit_error envelope", body)
+	}
+}
@@ -0,0 +1,344 @@
+package transform
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+
+	"athena/internal/config"
+)
+
+// SchemaSanitizer rewrites a single JSON schema node in place. depth is 0 for the root
+// schema. Nodes are visited parent first, so removing a keyword also skips its subschemas.
+type SchemaSanitizer func(node map[string]interface{}, depth int)
+
+// SchemaPipeline is an ordered list of sanitizers applied to every node of a tool schema
+type SchemaPipeline []SchemaSanitizer
+
+// schemaSanitizers are the named sanitizers available to schema profiles
+var schemaSanitizers = map[string]SchemaSanitizer{
+	"remove_uri_format":           removeURIFormatNode,
+	"strip_schema_keywords":       stripKeywords("$schema", "$id", "$comment"),
+	"strip_additional_properties": stripKeywords("additionalProperties"),
+	"strip_defaults":              stripKeywords("default", "examples"),
+	"strip_unsupported_formats":   stripUnsupportedFormats,
+	"const_to_enum":               constToEnum,
+	"strict_objects":              strictObjects,
+}
+
+// schemaProfiles are the built-in profiles, as lists of sanitizer names
+var schemaProfiles = map[string][]string{
+	"default": {"remove_uri_format"},
+	"gemini": {
+		"strip_schema_keywords",
+		"strip_additional_properties",
+		"strip_defaults",
+		"strip_unsupported_formats",
+		"const_to_enum",
+	},
+	"openai_strict": {
+		"strip_schema_keywords",
+		"remove_uri_format",
+		"strip_defaults",
+		"strict_objects",
+	},
+}
+
+// geminiFormats are the string formats Gemini accepts
+var geminiFormats = map[string]bool{"enum": true, "date-time": true}
+
+// schemaChildren lists keywords whose values are a subschema, a list of subschemas, or a map of subschemas
+var schemaChildren = []string{
+	"properties", "patternProperties", "$defs", "definitions", "dependentSchemas", "dependencies",
+	"items", "prefixItems", "additionalItems", "unevaluatedItems", "contains",
+	"additionalProperties", "unevaluatedProperties", "propertyNames", "contentSchema", "not",
+	"anyOf", "oneOf", "allOf", "if", "then", "else",
+}
+
+// SchemaPipelineFor returns the sanitizers for a mapped model, using the first matching
+// configured profile and falling back to the default profile
+func SchemaPipelineFor(model string, cfg *config.Config) SchemaPipeline {
+	return buildSchemaPipeline(schemaProfileFor(model, cfg))
+}
+
+// schemaProfileFor returns the first configured profile matching a mapped model, or the
+// default profile
+func schemaProfileFor(model string, cfg *config.Config) config.SchemaProfile {
+	if cfg != nil {
+		for _, profile := range cfg.SchemaProfiles {
+			if modelMatches(model, profile.Models) {
+				return profile
+			}
+		}
+	}
+	return config.SchemaProfile{Profile: "default"}
+}
+
+// sanitizerNames returns a profile's built-in sanitizers followed by its extra ones
+func sanitizerNames(profile config.SchemaProfile) []string {
+	if profile.Profile == "" {
+		return profile.Sanitizers
+	}
+	return append(append([]string(nil), schemaProfiles[profile.Profile]...), profile.Sanitizers...)
+}
+
+// usesStrictSchemas reports whether a profile rewrites schemas for OpenAI strict mode,
+// so tools must be sent with strict set
+func usesStrictSchemas(profile config.SchemaProfile) bool {
+	for _, name := range sanitizerNames(profile) {
+		if name == "strict_objects" {
+			return true
+		}
+	}
+	return false
+}
+
+// buildSchemaPipeline resolves a profile's built-in and extra sanitizers
+func buildSchemaPipeline(profile config.SchemaProfile) SchemaPipeline {
+	var pipeline SchemaPipeline
+	if profile.MaxDepth > 0 {
+		pipeline = append(pipeline, maxDepth(profile.MaxDepth))
+	}
+	if profile.MaxEnumValues > 0 {
+		pipeline = append(pipeline, maxEnumValues(profile.MaxEnumValues))
+	}
+
+	if _, ok := schemaProfiles[profile.Profile]; profile.Profile != "" && !ok {
+		slog.Warn("unknown schema profile", "profile", profile.Profile)
+	}
+	for _, name := range sanitizerNames(profile) {
+		sanitizer, ok := schemaSanitizers[name]
+		if !ok {
+			slog.Warn("unknown schema sanitizer", "sanitizer", name)
+			continue
+		}
+		pipeline = append(pipeline, sanitizer)
+	}
+	return pipeline
+}
+
+// Apply runs the pipeline over a schema, returning it unchanged if it isn't a JSON object
+func (p SchemaPipeline) Apply(schema json.RawMessage) json.RawMessage {
+	if len(p) == 0 {
+		return schema
+	}
+
+	var root map[string]interface{}
+	if err := json.Unmarshal(schema, &root); err != nil || root == nil {
+		return schema
+	}
+
+	p.walk(root, 0)
+	result, err := json.Marshal(root)
+	if err != nil {
+		return schema
+	}
+	return result
+}
+
+// walk applies the pipeline to a schema node, or to each node of a list, and then to
+// each of their subschemas
+func (p SchemaPipeline) walk(data interface{}, depth int) {
+	switch v := data.(type) {
+	case []interface{}:
+		for _, item := range v {
+			p.walk(item, depth)
+		}
+	case map[string]interface{}:
+		for _, sanitize := range p {
+			sanitize(v, depth)
+		}
+		for _, key := range schemaChildren {
+			child, ok := v[key].(map[string]interface{})
+			if ok && isSchemaMap(key) {
+				for _, value := range child {
+					p.walk(value, depth+1)
+				}
+				continue
+			}
+			p.walk(v[key], depth+1)
+		}
+	}
+}
+
+// isSchemaMap reports whether a keyword's object value maps names to subschemas. The
+// values of draft-04 dependencies may also be property name lists, which walk leaves alone.
+func isSchemaMap(key string) bool {
+	switch key {
+	case "properties", "patternProperties", "$defs", "definitions", "dependentSchemas", "dependencies":
+		return true
+	default:
+		return false
+	}
+}
+
+// stripKeywords returns a sanitizer that deletes the given keywords
+func stripKeywords(keys ...string) SchemaSanitizer {
+	return func(node map[string]interface{}, _ int) {
+		for _, key := range keys {
+			delete(node, key)
+		}
+	}
+}
+
+// removeURIFormatNode removes "format": "uri", which several providers reject
+func removeURIFormatNode(node map[string]interface{}, _ int) {
+	if node["format"] == "uri" {
+		delete(node, "format")
+	}
+}
+
+// stripUnsupportedFormats removes string formats Gemini doesn't accept
+func stripUnsupportedFormats(node map[string]interface{}, _ int) {
+	if format, ok := node["format"].(string); ok && !geminiFormats[format] {
+		delete(node, "format")
+	}
+}
+
+// constToEnum rewrites "const" as a single-value "enum"
+func constToEnum(node map[string]interface{}, _ int) {
+	if value, ok := node["const"]; ok {
+		node["enum"] = []interface{}{value}
+		delete(node, "const")
+	}
+}
+
+// strictObjects makes objects satisfy OpenAI strict mode: no additional properties and
+// every property required, with previously optional properties made nullable
+func strictObjects(node map[string]interface{}, _ int) {
+	properties, ok := node["properties"].(map[string]interface{})
+	if !ok && !hasType(node, "object") {
+		return
+	}
+	node["additionalProperties"] = false
+
+	required := map[string]bool{}
+	if list, ok := node["required"].([]interface{}); ok {
+		for _, name := range list {
+			if s, ok := name.(string); ok {
+				required[s] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(properties))
+	for name, value := range properties {
+		names = append(names, name)
+		if prop, ok := value.(map[string]interface{}); ok && !required[name] {
+			makeNullable(prop)
+		}
+	}
+	sort.Strings(names)
+
+	all := make([]interface{}, len(names))
+	for i, name := range names {
+		all[i] = name
+	}
+	node["required"] = all
+}
+
+// hasType reports whether a schema's type is, or includes, the given type
+func hasType(node map[string]interface{}, name string) bool {
+	switch t := node["type"].(type) {
+	case string:
+		return t == name
+	case []interface{}:
+		for _, item := range t {
+			if item == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// makeNullable lets a schema also accept null. Plain typed schemas gain "null" in their
+// type; schemas without a type, or restricted by enum or const, are wrapped in anyOf
+// with a null schema, since adding to the type alone would still reject null.
+func makeNullable(node map[string]interface{}) {
+	_, hasEnum := node["enum"]
+	_, hasConst := node["const"]
+	switch t := node["type"].(type) {
+	case string:
+		if t == "null" {
+			return
+		}
+		if !hasEnum && !hasConst {
+			node["type"] = []interface{}{t, "null"}
+			return
+		}
+	case []interface{}:
+		for _, item := range t {
+			if item == "null" {
+				return
+			}
+		}
+		if !hasEnum && !hasConst {
+			node["type"] = append(t, "null")
+			return
+		}
+	}
+
+	original := make(map[string]interface{}, len(node))
+	for key, value := range node {
+		original[key] = value
+		delete(node, key)
+	}
+	node["anyOf"] = []interface{}{original, map[string]interface{}{"type": "null"}}
+}
+
+// stripOptionalNulls removes null values that a strict-mode model filled in for
+// properties the original schema left optional, so clients see them omitted again
+func stripOptionalNulls(value interface{}, schema map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		required := map[string]bool{}
+		if list, ok := schema["required"].([]interface{}); ok {
+			for _, name := range list {
+				if s, ok := name.(string); ok {
+					required[s] = true
+				}
+			}
+		}
+		for key, item := range v {
+			if item == nil && !required[key] {
+				delete(v, key)
+				continue
+			}
+			if propSchema, ok := properties[key].(map[string]interface{}); ok {
+				stripOptionalNulls(item, propSchema)
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for _, item := range v {
+				stripOptionalNulls(item, items)
+			}
+		}
+	}
+}
+
+// maxDepth returns a sanitizer that drops subschemas below the given depth, so the
+// deepest nodes accept any value of their type
+func maxDepth(limit int) SchemaSanitizer {
+	return func(node map[string]interface{}, depth int) {
+		if depth < limit {
+			return
+		}
+		for _, key := range schemaChildren {
+			delete(node, key)
+		}
+		delete(node, "required")
+	}
+}
+
+// maxEnumValues returns a sanitizer that removes enums larger than the limit, since
+// truncating them would reject valid values
+func maxEnumValues(limit int) SchemaSanitizer {
+	return func(node map[string]interface{}, _ int) {
+		if values, ok := node["enum"].([]interface{}); ok && len(values) > limit {
+			delete(node, "enum")
+		}
+	}
+}
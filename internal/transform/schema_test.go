@@ -0,0 +1,405 @@
+package transform
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"athena/internal/config"
+)
+
+// assertSchema compares two JSON documents structurally
+func assertSchema(t *testing.T, got json.RawMessage, expected string) {
+	t.Helper()
+	var gotValue, expectedValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("Failed to unmarshal result: %v", err)
+	}
+	if err := json.Unmarshal([]byte(expected), &expectedValue); err != nil {
+		t.Fatalf("Failed to unmarshal expected: %v", err)
+	}
+	gotJSON, _ := json.Marshal(gotValue)
+	expectedJSON, _ := json.Marshal(expectedValue)
+	if string(gotJSON) != string(expectedJSON) {
+		t.Errorf("Schema = %s, expected %s", gotJSON, expectedJSON)
+	}
+}
+
+func TestSchemaPipeline_Profiles(t *testing.T) {
+	input := `{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"type": "object",
+		"additionalProperties": false,
+		"properties": {
+			"url": {"type": "string", "format": "uri", "default": "https://example.com"},
+			"when": {"type": "string", "format": "date-time"},
+			"mode": {"const": "fast"},
+			"tags": {"type": "array", "items": {"type": "object", "properties": {"name": {"type": "string", "format": "email"}}}}
+		},
+		"required": ["url"]
+	}`
+
+	tests := []struct {
+		name     string
+		profile  config.SchemaProfile
+		expected string
+	}{
+		{
+			name:    "default",
+			profile: config.SchemaProfile{Profile: "default"},
+			expected: `{
+				"$schema": "http://json-schema.org/draft-07/schema#",
+				"type": "object",
+				"additionalProperties": false,
+				"properties": {
+					"url": {"type": "string", "default": "https://example.com"},
+					"when": {"type": "string", "format": "date-time"},
+					"mode": {"const": "fast"},
+					"tags": {"type": "array", "items": {"type": "object", "properties": {"name": {"type": "string", "format": "email"}}}}
+				},
+				"required": ["url"]
+			}`,
+		},
+		{
+			name:    "gemini",
+			profile: config.SchemaProfile{Profile: "gemini"},
+			expected: `{
+				"type": "object",
+				"properties": {
+					"url": {"type": "string"},
+					"when": {"type": "string", "format": "date-time"},
+					"mode": {"enum": ["fast"]},
+					"tags": {"type": "array", "items": {"type": "object", "properties": {"name": {"type": "string"}}}}
+				},
+				"required": ["url"]
+			}`,
+		},
+		{
+			name:    "openai strict",
+			profile: config.SchemaProfile{Profile: "openai_strict"},
+			expected: `{
+				"type": "object",
+				"additionalProperties": false,
+				"properties": {
+					"url": {"type": "string"},
+					"when": {"type": ["string", "null"], "format": "date-time"},
+					"mode": {"anyOf": [{"const": "fast"}, {"type": "null"}]},
+					"tags": {"type": ["array", "null"], "items": {"type": "object", "additionalProperties": false, "properties": {"name": {"type": ["string", "null"], "format": "email"}}, "required": ["name"]}}
+				},
+				"required": ["mode", "tags", "url", "when"]
+			}`,
+		},
+		{
+			name:    "max depth",
+			profile: config.SchemaProfile{MaxDepth: 2},
+			expected: `{
+				"$schema": "http://json-schema.org/draft-07/schema#",
+				"type": "object",
+				"additionalProperties": false,
+				"properties": {
+					"url": {"type": "string", "format": "uri", "default": "https://example.com"},
+					"when": {"type": "string", "format": "date-time"},
+					"mode": {"const": "fast"},
+					"tags": {"type": "array", "items": {"type": "object"}}
+				},
+				"required": ["url"]
+			}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := buildSchemaPipeline(tt.profile).Apply(json.RawMessage(input))
+			assertSchema(t, result, tt.expected)
+		})
+	}
+}
+
+func TestSchemaPipeline_MaxEnumValues(t *testing.T) {
+	pipeline := buildSchemaPipeline(config.SchemaProfile{MaxEnumValues: 2})
+
+	result := pipeline.Apply(json.RawMessage(`{"type":"object","properties":{"a":{"type":"string","enum":["x","y","z"]},"b":{"type":"string","enum":["x","y"]}}}`))
+	assertSchema(t, result, `{"type":"object","properties":{"a":{"type":"string"},"b":{"type":"string","enum":["x","y"]}}}`)
+}
+
+func TestSchemaPipeline_Combinators(t *testing.T) {
+	pipeline := buildSchemaPipeline(config.SchemaProfile{Profile: "gemini"})
+
+	result := pipeline.Apply(json.RawMessage(`{"anyOf":[{"type":"string","format":"uri"},{"$defs":{"x":{"type":"integer","default":1}}}]}`))
+	assertSchema(t, result, `{"anyOf":[{"type":"string"},{"$defs":{"x":{"type":"integer"}}}]}`)
+}
+
+func TestSchemaPipeline_ApplicatorKeywords(t *testing.T) {
+	pipeline := SchemaPipeline{removeURIFormatNode}
+
+	result := pipeline.Apply(json.RawMessage(`{
+		"type": "object",
+		"propertyNames": {"type": "string", "format": "uri"},
+		"unevaluatedProperties": {"type": "string", "format": "uri"},
+		"dependentSchemas": {"a": {"properties": {"b": {"type": "string", "format": "uri"}}}},
+		"dependencies": {"c": ["d"], "e": {"properties": {"f": {"type": "string", "format": "uri"}}}}
+	}`))
+	assertSchema(t, result, `{
+		"type": "object",
+		"propertyNames": {"type": "string"},
+		"unevaluatedProperties": {"type": "string"},
+		"dependentSchemas": {"a": {"properties": {"b": {"type": "string"}}}},
+		"dependencies": {"c": ["d"], "e": {"properties": {"f": {"type": "string"}}}}
+	}`)
+}
+
+func TestSchemaPipeline_RemoveURIFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "removes format uri",
+			input:    `{"type":"object","properties":{"url":{"type":"string","format":"uri"}}}`,
+			expected: `{"properties":{"url":{"type":"string"}},"type":"object"}`,
+		},
+		{
+			name:     "nested format uri",
+			input:    `{"type":"object","properties":{"data":{"type":"object","properties":{"link":{"type":"string","format":"uri"}}}}}`,
+			expected: `{"properties":{"data":{"properties":{"link":{"type":"string"}},"type":"object"}},"type":"object"}`,
+		},
+		{
+			name:     "preserves other formats",
+			input:    `{"type":"object","properties":{"date":{"type":"string","format":"date-time"}}}`,
+			expected: `{"properties":{"date":{"format":"date-time","type":"string"}},"type":"object"}`,
+		},
+		{
+			name:     "no format field",
+			input:    `{"type":"object","properties":{"name":{"type":"string"}}}`,
+			expected: `{"properties":{"name":{"type":"string"}},"type":"object"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := SchemaPipeline{removeURIFormatNode}.Apply(json.RawMessage(tt.input))
+			assertSchema(t, result, tt.expected)
+		})
+	}
+}
+
+func TestSchemaPipeline_WalkRemovesURIFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    interface{}
+		expected interface{}
+	}{
+		{
+			name: "removes format uri from map",
+			input: map[string]interface{}{
+				"format": "uri",
+				"type":   "string",
+			},
+			expected: map[string]interface{}{
+				"type": "string",
+			},
+		},
+		{
+			name: "preserves other formats",
+			input: map[string]interface{}{
+				"format": "date-time",
+				"type":   "string",
+			},
+			expected: map[string]interface{}{
+				"format": "date-time",
+				"type":   "string",
+			},
+		},
+		{
+			name: "handles nested maps",
+			input: map[string]interface{}{
+				"properties": map[string]interface{}{
+					"url": map[string]interface{}{
+						"format": "uri",
+						"type":   "string",
+					},
+				},
+			},
+			expected: map[string]interface{}{
+				"properties": map[string]interface{}{
+					"url": map[string]interface{}{
+						"type": "string",
+					},
+				},
+			},
+		},
+		{
+			name: "handles arrays",
+			input: []interface{}{
+				map[string]interface{}{
+					"format": "uri",
+					"type":   "string",
+				},
+			},
+			expected: []interface{}{
+				map[string]interface{}{
+					"type": "string",
+				},
+			},
+		},
+		{
+			name:     "preserves primitives",
+			input:    "plain string",
+			expected: "plain string",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SchemaPipeline{removeURIFormatNode}.walk(tt.input, 0)
+
+			resultJSON, _ := json.Marshal(tt.input)
+			expectedJSON, _ := json.Marshal(tt.expected)
+
+			if string(resultJSON) != string(expectedJSON) {
+				t.Errorf("walk() = %s, expected %s", resultJSON, expectedJSON)
+			}
+		})
+	}
+}
+
+func TestSchemaPipeline_InvalidSchema(t *testing.T) {
+	pipeline := buildSchemaPipeline(config.SchemaProfile{Profile: "gemini"})
+
+	for _, input := range []string{`not json`, `null`, `[1,2]`} {
+		if result := pipeline.Apply(json.RawMessage(input)); string(result) != input {
+			t.Errorf("Apply(%s) = %s, expected input unchanged", input, result)
+		}
+	}
+}
+
+func TestSchemaPipelineFor(t *testing.T) {
+	cfg := &config.Config{
+		SchemaProfiles: []config.SchemaProfile{
+			{Models: []string{"google/gemini"}, Profile: "gemini"},
+			{Models: []string{"mistralai/"}, Sanitizers: []string{"strip_defaults", "unknown_sanitizer"}},
+		},
+	}
+	input := json.RawMessage(`{"type":"object","additionalProperties":false,"properties":{"u":{"type":"string","format":"uri","default":"x"}}}`)
+
+	tests := []struct {
+		model    string
+		expected string
+	}{
+		{"google/gemini-2.5-pro", `{"type":"object","properties":{"u":{"type":"string"}}}`},
+		{"mistralai/devstral", `{"type":"object","additionalProperties":false,"properties":{"u":{"type":"string","format":"uri"}}}`},
+		{"moonshotai/kimi-k2", `{"type":"object","additionalProperties":false,"properties":{"u":{"type":"string","default":"x"}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			assertSchema(t, SchemaPipelineFor(tt.model, cfg).Apply(input), tt.expected)
+		})
+	}
+}
+
+func TestAnthropicToOpenAI_SchemaProfiles(t *testing.T) {
+	cfg := &config.Config{
+		Model:          "google/gemini-2.5-pro",
+		SchemaProfiles: config.DefaultSchemaProfiles,
+	}
+	req := AnthropicRequest{
+		Model:    "claude-3-5-sonnet",
+		Messages: []Message{{Role: "user", Content: json.RawMessage(`"Hi"`)}},
+		Tools: []Tool{{
+			Name:        "fetch",
+			InputSchema: json.RawMessage(`{"$schema":"http://json-schema.org/draft-07/schema#","type":"object","additionalProperties":false,"properties":{"url":{"type":"string","format":"uri"}}}`),
+		}},
+	}
+
+	result := AnthropicToOpenAI(req, cfg)
+
+	assertSchema(t, result.Tools[0].Function.Parameters, `{"type":"object","properties":{"url":{"type":"string"}}}`)
+}
+
+func TestAnthropicToOpenAI_StrictTools(t *testing.T) {
+	cfg := &config.Config{
+		Model:          "openai/gpt-4o",
+		SchemaProfiles: []config.SchemaProfile{{Models: []string{"openai/"}, Profile: "openai_strict"}},
+	}
+	req := AnthropicRequest{
+		Model:    "claude-3-5-sonnet",
+		Messages: []Message{{Role: "user", Content: json.RawMessage(`"Hi"`)}},
+		Tools: []Tool{{
+			Name:        "read",
+			InputSchema: json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"},"limit":{"type":"integer"}},"required":["path"]}`),
+		}},
+	}
+
+	result := AnthropicToOpenAI(req, cfg)
+	if !result.Tools[0].Function.Strict {
+		t.Error("Expected the tool to be sent in strict mode")
+	}
+	if _, ok := result.StrictToolSchemas["read"]; !ok {
+		t.Errorf("Strict schemas = %v, expected the original read schema", result.StrictToolSchemas)
+	}
+
+	cfg.Model = "moonshotai/kimi-k2"
+	if result := AnthropicToOpenAI(req, cfg); result.Tools[0].Function.Strict || result.StrictToolSchemas != nil {
+		t.Error("Expected non-strict profiles to leave strict mode off")
+	}
+}
+
+func TestStripOptionalNulls(t *testing.T) {
+	var schema map[string]interface{}
+	_ = json.Unmarshal([]byte(`{"type":"object","required":["path","note"],"properties":{
+		"path":{"type":"string"},
+		"note":{"type":["string","null"]},
+		"limit":{"type":"integer"},
+		"edits":{"type":"array","items":{"type":"object","required":["old"],"properties":{"old":{"type":"string"},"all":{"type":"boolean"}}}}
+	}}`), &schema)
+
+	var input map[string]interface{}
+	_ = json.Unmarshal([]byte(`{"path":"a.go","note":null,"limit":null,"edits":[{"old":"x","all":null}]}`), &input)
+	stripOptionalNulls(input, schema)
+
+	got, _ := json.Marshal(input)
+	if string(got) != `{"edits":[{"old":"x"}],"note":null,"path":"a.go"}` {
+		t.Errorf("Input = %s, expected optional nulls removed and required ones kept", got)
+	}
+}
+
+func TestStrictToolResponses(t *testing.T) {
+	opts := ResponseOptions{StrictToolSchemas: map[string]json.RawMessage{
+		"read": json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"},"limit":{"type":"integer"}},"required":["path"]}`),
+	}}
+
+	var resp OpenAIResponse
+	_ = json.Unmarshal([]byte(`{"choices":[{"message":{"role":"assistant","tool_calls":[
+		{"id":"call_1","type":"function","function":{"name":"read","arguments":"{\"path\":\"a.go\",\"limit\":null}"}}
+	]},"finish_reason":"tool_calls"}]}`), &resp)
+	result, err := OpenAIToAnthropic(resp, "test/model", opts)
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error: %v", err)
+	}
+	input := result["content"].([]map[string]interface{})[0]["input"].(map[string]interface{})
+	if _, ok := input["limit"]; ok || input["path"] != "a.go" {
+		t.Errorf("Input = %v, expected the optional null removed", input)
+	}
+
+	streamData := `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"read","arguments":"{\"path\":\"a.go\","}}]},"finish_reason":null}]}
+
+data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"limit\":null}"}}]},"finish_reason":null}]}
+
+data: {"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}
+
+data: [DONE]
+
+`
+	w := httptest.NewRecorder()
+	HandleStreaming(w, &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(streamData)), Header: make(http.Header)}, "test/model", opts)
+
+	body, _ := io.ReadAll(w.Result().Body)
+	if strings.Count(string(body), "input_json_delta") != 1 || !strings.Contains(string(body), `"partial_json":"{\"path\":\"a.go\"}"`) {
+		t.Errorf("Expected the arguments in one delta without the optional null, got:\n%s", body)
+	}
+}
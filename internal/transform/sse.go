@@ -0,0 +1,180 @@
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"athena/internal/config"
+)
+
+// DefaultMaxSSELineSize caps a single upstream SSE line, and the data of a single event
+const DefaultMaxSSELineSize = config.DefaultMaxSSELineBytes
+
+// ErrSSELineTooLong is returned when an SSE line or event exceeds the decoder's cap
+var ErrSSELineTooLong = errors.New("sse: line too long")
+
+// SSEEvent is a single event decoded from a Server-Sent Events stream. Comment lines
+// (e.g. OpenRouter's ": OPENROUTER PROCESSING") are returned as separate events with
+// Keepalive set and the comment text in Comment.
+type SSEEvent struct {
+	Event     string
+	Data      string
+	ID        string
+	Comment   string
+	Keepalive bool
+}
+
+// SSEDecoder reads events from a Server-Sent Events stream following the WHATWG spec:
+// CR, LF and CRLF line endings, multi-line data fields, and lines of any length up to
+// the configured cap. An event left pending at EOF is still dispatched, since some
+// upstreams omit the final blank line.
+type SSEDecoder struct {
+	r           *bufio.Reader
+	maxLineSize int
+	skipLF      bool
+	started     bool
+	line        []byte
+
+	event   string
+	data    []byte
+	hasData bool
+	lastID  string
+}
+
+// NewSSEDecoder creates a decoder reading from r. A maxLineSize of 0 means no cap.
+func NewSSEDecoder(r io.Reader, maxLineSize int) *SSEDecoder {
+	return &SSEDecoder{
+		r:           bufio.NewReader(r),
+		maxLineSize: maxLineSize,
+	}
+}
+
+// Next returns the next event or keepalive, or io.EOF when the stream ends
+func (d *SSEDecoder) Next() (*SSEEvent, error) {
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			if errors.Is(err, io.EOF) && d.hasData {
+				return d.dispatch(), nil
+			}
+			return nil, err
+		}
+
+		if len(line) == 0 {
+			if d.hasData {
+				return d.dispatch(), nil
+			}
+			d.event = ""
+			continue
+		}
+
+		if line[0] == ':' {
+			return &SSEEvent{
+				Comment:   strings.TrimPrefix(string(line[1:]), " "),
+				Keepalive: true,
+			}, nil
+		}
+
+		if err := d.processField(line); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// processField applies a single "name: value" line to the pending event
+func (d *SSEDecoder) processField(line []byte) error {
+	name, value := line, []byte(nil)
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		name, value = line[:i], line[i+1:]
+		if len(value) > 0 && value[0] == ' ' {
+			value = value[1:]
+		}
+	}
+
+	switch string(name) {
+	case "event":
+		d.event = string(value)
+	case "data":
+		if d.maxLineSize > 0 && len(d.data)+len(value) > d.maxLineSize {
+			return ErrSSELineTooLong
+		}
+		if d.hasData {
+			d.data = append(d.data, '\n')
+		}
+		d.data = append(d.data, value...)
+		d.hasData = true
+	case "id":
+		if bytes.IndexByte(value, 0) < 0 {
+			d.lastID = string(value)
+		}
+	}
+	return nil
+}
+
+// dispatch returns the pending event and resets the event buffers
+func (d *SSEDecoder) dispatch() *SSEEvent {
+	event := &SSEEvent{
+		Event: d.event,
+		Data:  string(d.data),
+		ID:    d.lastID,
+	}
+	d.event = ""
+	d.data = d.data[:0]
+	d.hasData = false
+	return event
+}
+
+// readLine returns the next line without its terminator. The returned slice is only
+// valid until the next call.
+func (d *SSEDecoder) readLine() ([]byte, error) {
+	d.line = d.line[:0]
+
+	if !d.started {
+		d.started = true
+		if bom, err := d.r.Peek(3); err == nil && bytes.Equal(bom, []byte("\xEF\xBB\xBF")) {
+			_, _ = d.r.Discard(3)
+		}
+	}
+
+	for {
+		// Peek rather than read so a CR at the end of the buffer doesn't block waiting for LF
+		if d.r.Buffered() == 0 {
+			if _, err := d.r.Peek(1); err != nil {
+				if errors.Is(err, io.EOF) && len(d.line) > 0 {
+					return d.line, nil
+				}
+				return nil, err
+			}
+		}
+		buf, _ := d.r.Peek(d.r.Buffered())
+
+		if d.skipLF {
+			d.skipLF = false
+			if buf[0] == '\n' {
+				_, _ = d.r.Discard(1)
+				continue
+			}
+		}
+
+		i := bytes.IndexAny(buf, "\r\n")
+		if i < 0 {
+			i = len(buf)
+		}
+		if d.maxLineSize > 0 && len(d.line)+i > d.maxLineSize {
+			return nil, ErrSSELineTooLong
+		}
+		d.line = append(d.line, buf[:i]...)
+
+		if i == len(buf) {
+			_, _ = d.r.Discard(i)
+			continue
+		}
+
+		d.skipLF = buf[i] == '\r'
+		_, _ = d.r.Discard(i + 1)
+		return d.line, nil
+	}
+}
@@ -0,0 +1,250 @@
+package transform
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func decodeAll(t *testing.T, d *SSEDecoder) ([]SSEEvent, error) {
+	t.Helper()
+	var events []SSEEvent
+	for {
+		event, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, *event)
+	}
+}
+
+func TestSSEDecoder(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []SSEEvent
+	}{
+		{
+			name:     "single data line",
+			input:    "data: hello\n\n",
+			expected: []SSEEvent{{Data: "hello"}},
+		},
+		{
+			name:     "multi-line data",
+			input:    "data: first\ndata: second\n\n",
+			expected: []SSEEvent{{Data: "first\nsecond"}},
+		},
+		{
+			name:     "CRLF line endings",
+			input:    "event: update\r\ndata: one\r\n\r\ndata: two\r\n\r\n",
+			expected: []SSEEvent{{Event: "update", Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:     "CR line endings",
+			input:    "data: one\r\rdata: two\r\r",
+			expected: []SSEEvent{{Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:  "comments surfaced as keepalives",
+			input: ": OPENROUTER PROCESSING\n\n:\ndata: x\n\n",
+			expected: []SSEEvent{
+				{Comment: "OPENROUTER PROCESSING", Keepalive: true},
+				{Keepalive: true},
+				{Data: "x"},
+			},
+		},
+		{
+			name:     "comment inside an event keeps pending data",
+			input:    "data: a\n: ping\ndata: b\n\n",
+			expected: []SSEEvent{{Comment: "ping", Keepalive: true}, {Data: "a\nb"}},
+		},
+		{
+			name:     "no space after colon",
+			input:    "data:value\n\n",
+			expected: []SSEEvent{{Data: "value"}},
+		},
+		{
+			name:     "only one leading space stripped",
+			input:    "data:  value\n\n",
+			expected: []SSEEvent{{Data: " value"}},
+		},
+		{
+			name:     "field without colon",
+			input:    "data\n\n",
+			expected: []SSEEvent{{Data: ""}},
+		},
+		{
+			name:     "id persists across events",
+			input:    "id: 7\ndata: a\n\ndata: b\n\n",
+			expected: []SSEEvent{{ID: "7", Data: "a"}, {ID: "7", Data: "b"}},
+		},
+		{
+			name:     "event without data is not dispatched",
+			input:    "event: ping\n\ndata: a\n\n",
+			expected: []SSEEvent{{Data: "a"}},
+		},
+		{
+			name:     "unknown fields ignored",
+			input:    "retry: 1000\nfoo: bar\ndata: a\n\n",
+			expected: []SSEEvent{{Data: "a"}},
+		},
+		{
+			name:     "byte order mark stripped",
+			input:    "\xEF\xBB\xBFdata: a\n\n",
+			expected: []SSEEvent{{Data: "a"}},
+		},
+		{
+			name:     "pending event dispatched at EOF",
+			input:    "data: [DONE]",
+			expected: []SSEEvent{{Data: "[DONE]"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := decodeAll(t, NewSSEDecoder(strings.NewReader(tt.input), 0))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(events) != len(tt.expected) {
+				t.Fatalf("Got %d events %+v, expected %d %+v", len(events), events, len(tt.expected), tt.expected)
+			}
+			for i := range events {
+				if events[i] != tt.expected[i] {
+					t.Errorf("Event %d = %+v, expected %+v", i, events[i], tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSSEDecoder_LongLines(t *testing.T) {
+	long := strings.Repeat("x", 1<<20)
+
+	events, err := decodeAll(t, NewSSEDecoder(strings.NewReader("data: "+long+"\n\n"), 0))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(events) != 1 || events[0].Data != long {
+		t.Errorf("Expected a single 1MB event, got %d events", len(events))
+	}
+
+	_, err = decodeAll(t, NewSSEDecoder(strings.NewReader("data: "+long+"\n\n"), 1024))
+	if !errors.Is(err, ErrSSELineTooLong) {
+		t.Errorf("Error = %v, expected %v", err, ErrSSELineTooLong)
+	}
+}
+
+func TestSSEDecoder_SplitReads(t *testing.T) {
+	input := "data: one\r\n\r\n: keepalive\r\ndata: two\r\ndata: three\r\n\r\n"
+
+	events, err := decodeAll(t, NewSSEDecoder(iotest.OneByteReader(strings.NewReader(input)), 0))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []SSEEvent{{Data: "one"}, {Comment: "keepalive", Keepalive: true}, {Data: "two\nthree"}}
+	if len(events) != len(expected) {
+		t.Fatalf("Got %+v, expected %+v", events, expected)
+	}
+	for i := range events {
+		if events[i] != expected[i] {
+			t.Errorf("Event %d = %+v, expected %+v", i, events[i], expected[i])
+		}
+	}
+}
+
+func TestHandleStreaming_SSEFormatting(t *testing.T) {
+	longArgs := strings.Repeat("a", 100*1024)
+	streamData := ": OPENROUTER PROCESSING\r\n\r\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"},\"finish_reason\":null}]}\r\n\r\n" +
+		": OPENROUTER PROCESSING\r\n\r\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"write\",\"arguments\":\"{\\\"s\\\":\\\"" + longArgs + "\\\"}\"}}]},\"finish_reason\":null}]}\r\n\r\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"tool_calls\"}]}\r\n\r\n" +
+		"data: [DONE]\r\n\r\n"
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(streamData)),
+		Header:     make(http.Header),
+	}
+
+	w := httptest.NewRecorder()
+	HandleStreaming(w, resp, "test/model", ResponseOptions{})
+
+	body, _ := io.ReadAll(w.Result().Body)
+	bodyStr := string(body)
+
+	if strings.Count(bodyStr, "event: ping\n") != 1 {
+		t.Errorf("Expected one ping for the keepalive after message_start, got:\n%.500s", bodyStr)
+	}
+	if !strings.Contains(bodyStr, longArgs) {
+		t.Error("Expected the 100KB tool arguments to be forwarded")
+	}
+	if !strings.Contains(bodyStr, `"stop_reason":"tool_use"`) || !strings.Contains(bodyStr, "event: message_stop") {
+		t.Errorf("Expected a complete tool_use turn, got:\n%.500s", bodyStr)
+	}
+}
+
+func FuzzSSEDecoder(f *testing.F) {
+	f.Add([]byte("data: hello\n\n"))
+	f.Add([]byte("event: a\r\ndata: 1\r\ndata: 2\r\n\r\n"))
+	f.Add([]byte(": comment\rdata: x\r\r"))
+	f.Add([]byte("\xEF\xBB\xBFid: 1\x00\ndata\n\n"))
+	f.Add([]byte("data: unterminated"))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		const maxLineSize = 64
+		d := NewSSEDecoder(strings.NewReader(string(input)), maxLineSize)
+		for i := 0; i <= len(input); i++ {
+			event, err := d.Next()
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, ErrSSELineTooLong) {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if len(event.Data) > maxLineSize || len(event.Comment) > maxLineSize {
+				t.Fatalf("Event exceeds cap: %+v", event)
+			}
+		}
+		t.Fatalf("Decoder returned more events than input bytes")
+	})
+}
+
+func FuzzSSEDecoder_RoundTrip(f *testing.F) {
+	f.Add("hello", "\n")
+	f.Add("multi\nline\ndata", "\r\n")
+	f.Add(": not a comment", "\r")
+	f.Add("", "\n")
+
+	f.Fuzz(func(t *testing.T, data, newline string) {
+		if newline != "\n" && newline != "\r\n" && newline != "\r" {
+			t.Skip()
+		}
+		if strings.Contains(data, "\r") {
+			t.Skip()
+		}
+
+		var encoded strings.Builder
+		for _, line := range strings.Split(data, "\n") {
+			encoded.WriteString("data: " + line + newline)
+		}
+		encoded.WriteString(newline)
+
+		event, err := NewSSEDecoder(strings.NewReader(encoded.String()), 0).Next()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if event.Data != data {
+			t.Errorf("Data = %q, expected %q", event.Data, data)
+		}
+	})
+}
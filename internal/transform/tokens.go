@@ -0,0 +1,122 @@
+package transform
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	_ "image/gif"  // register GIF dimensions for image token estimates
+	_ "image/jpeg" // register JPEG dimensions for image token estimates
+	_ "image/png"  // register PNG dimensions for image token estimates
+	"strings"
+
+	"athena/internal/tokenizer"
+)
+
+const (
+	// requestOverheadTokens covers the framing that primes the assistant's reply
+	requestOverheadTokens = 3
+	// messageOverheadTokens covers the role and turn markers around each message
+	messageOverheadTokens = 4
+	// toolOverheadTokens covers the framing around each tool definition
+	toolOverheadTokens = 8
+	// imagePixelsPerToken is Anthropic's published image cost of (width * height) / 750
+	imagePixelsPerToken = 750
+	// maxImageTokens is the cost of an image at the largest size the API keeps without resizing
+	maxImageTokens = 1600
+)
+
+// CountInputTokens estimates the input tokens of a request, counting the system prompt,
+// messages and tool definitions as the upstream model would see them
+func CountInputTokens(req AnthropicRequest, tok tokenizer.Tokenizer) int {
+	total := requestOverheadTokens
+	total += countContentTokens(req.System, tok)
+	for _, msg := range req.Messages {
+		total += messageOverheadTokens + countContentTokens(msg.Content, tok)
+	}
+	for _, tool := range req.Tools {
+		total += toolOverheadTokens + countToolTokens(tool, tok)
+	}
+	return total
+}
+
+// countContentTokens counts a string or content block array
+func countContentTokens(raw json.RawMessage, tok tokenizer.Tokenizer) int {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return tok.Count(text)
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return tok.Count(string(raw))
+	}
+
+	total := 0
+	for _, block := range blocks {
+		total += countBlockTokens(block, tok)
+	}
+	return total
+}
+
+// countBlockTokens counts a single content block
+func countBlockTokens(block ContentBlock, tok tokenizer.Tokenizer) int {
+	switch block.Type {
+	case contentTypeText:
+		return tok.Count(block.Text)
+	case TypeThinking:
+		return tok.Count(block.Thinking)
+	case TypeToolUse:
+		return tok.Count(block.Name) + tok.Count(string(block.Input))
+	case "tool_result":
+		return countContentTokens(block.Content, tok)
+	case contentTypeImage:
+		return imageTokens(block.Source)
+	default:
+		// Other blocks are counted by their JSON, which over- rather than under-estimates
+		encoded, _ := json.Marshal(block)
+		return tok.Count(string(encoded))
+	}
+}
+
+// countToolTokens counts a tool definition, expanding client tools into the function
+// the upstream receives
+func countToolTokens(tool Tool, tok tokenizer.Tokenizer) int {
+	name, description, schema := tool.Name, tool.Description, tool.InputSchema
+	if clientName, clientDescription, clientSchema, ok := clientToolFunction(tool); ok {
+		name, description, schema = clientName, clientDescription, clientSchema
+		// A description set on the tool replaces the implied one, as in AnthropicToOpenAI
+		if tool.Description != "" {
+			description = tool.Description
+		}
+	}
+	if len(schema) == 0 {
+		encoded, _ := json.Marshal(tool)
+		return tok.Count(string(encoded))
+	}
+	return tok.Count(name) + tok.Count(description) + tok.Count(string(schema))
+}
+
+// imageTokens estimates an image's cost from its dimensions, when they can be read from
+// inline data, and otherwise assumes an image at the maximum size
+func imageTokens(source *ImageSource) int {
+	if source == nil || source.Type != "base64" {
+		return maxImageTokens
+	}
+
+	// Decode lazily, as the dimensions sit in the header and the rest of the image is never read
+	data := base64.NewDecoder(base64.StdEncoding, strings.NewReader(strings.TrimSpace(source.Data)))
+	cfg, _, err := image.DecodeConfig(data)
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return maxImageTokens
+	}
+
+	tokens := (cfg.Width*cfg.Height + imagePixelsPerToken - 1) / imagePixelsPerToken
+	if tokens > maxImageTokens {
+		return maxImageTokens
+	}
+	return tokens
+}
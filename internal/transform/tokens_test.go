@@ -0,0 +1,137 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"athena/internal/tokenizer"
+)
+
+func encodePNG(t *testing.T, width, height int) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestCountInputTokens(t *testing.T) {
+	tok := tokenizer.CharRatio{CharsPerToken: 4}
+
+	base := AnthropicRequest{
+		Messages: []Message{{Role: "user", Content: json.RawMessage(`"abcdefgh"`)}},
+	}
+	if got := CountInputTokens(base, tok); got != requestOverheadTokens+messageOverheadTokens+2 {
+		t.Errorf("Simple request = %d tokens", got)
+	}
+
+	withSystem := base
+	withSystem.System = json.RawMessage(`[{"type":"text","text":"abcd"}]`)
+	if got := CountInputTokens(withSystem, tok) - CountInputTokens(base, tok); got != 1 {
+		t.Errorf("System prompt added %d tokens, expected 1", got)
+	}
+
+	withBlocks := base
+	withBlocks.Messages = append(withBlocks.Messages,
+		Message{Role: "assistant", Content: json.RawMessage(`[
+			{"type":"thinking","thinking":"abcd","signature":"sig"},
+			{"type":"tool_use","id":"toolu_1","name":"read","input":{"a":1}}
+		]`)},
+		Message{Role: "user", Content: json.RawMessage(`[{"type":"tool_result","tool_use_id":"toolu_1","content":"abcdefgh"}]`)},
+	)
+	// thinking (1) + name (1) + input `{"a":1}` (2) + tool result (2)
+	if got := CountInputTokens(withBlocks, tok) - CountInputTokens(base, tok); got != 2*messageOverheadTokens+6 {
+		t.Errorf("Content blocks added %d tokens, expected %d", got, 2*messageOverheadTokens+6)
+	}
+
+	withTools := base
+	withTools.Tools = []Tool{{Type: "bash_20250124", Name: "bash"}}
+	if got := CountInputTokens(withTools, tok) - CountInputTokens(base, tok); got < toolOverheadTokens+20 {
+		t.Errorf("Client tool added %d tokens, expected its expanded schema to be counted", got)
+	}
+
+	described := base
+	described.Tools = []Tool{{Type: "bash_20250124", Name: "bash", Description: strings.Repeat("abcd", 100)}}
+	if got := CountInputTokens(described, tok) - CountInputTokens(withTools, tok); got < 50 {
+		t.Errorf("Tool description added %d tokens, expected the description sent upstream to be counted", got)
+	}
+}
+
+func TestImageTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   *ImageSource
+		expected int
+	}{
+		{name: "small PNG", source: &ImageSource{Type: "base64", MediaType: "image/png", Data: encodePNG(t, 100, 75)}, expected: 10},
+		{name: "only the header is read", source: &ImageSource{Type: "base64", MediaType: "image/png", Data: encodePNG(t, 100, 75)[:64]}, expected: 10},
+		{name: "large PNG is capped", source: &ImageSource{Type: "base64", MediaType: "image/png", Data: encodePNG(t, 2000, 2000)}, expected: maxImageTokens},
+		{name: "URL image", source: &ImageSource{Type: "url", URL: "https://example.com/a.png"}, expected: maxImageTokens},
+		{name: "undecodable data", source: &ImageSource{Type: "base64", MediaType: "image/webp", Data: "AAAA"}, expected: maxImageTokens},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := imageTokens(tt.source); got != tt.expected {
+				t.Errorf("imageTokens() = %d, expected %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandleStreaming_EstimatedInputTokens(t *testing.T) {
+	streamData := `data: {"choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":"stop"}]}
+
+data: [DONE]
+
+`
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(streamData)),
+		Header:     make(http.Header),
+	}
+
+	w := httptest.NewRecorder()
+	HandleStreaming(w, resp, "test/model", ResponseOptions{EstimateInputTokens: func() int { return 42 }})
+
+	body, _ := io.ReadAll(w.Result().Body)
+	if strings.Count(string(body), `"input_tokens":42`) != 2 {
+		t.Errorf("Expected the estimate in message_start and message_delta, got:\n%s", body)
+	}
+}
+
+func TestOpenAIToAnthropic_UpstreamUsagePreferred(t *testing.T) {
+	var resp OpenAIResponse
+	if err := json.Unmarshal([]byte(`{"choices":[{"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}],
+		"usage":{"prompt_tokens":7,"completion_tokens":1}}`), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	estimates := 0
+	estimate := func() int {
+		estimates++
+		return 42
+	}
+	result, err := OpenAIToAnthropic(resp, "test/model", ResponseOptions{EstimateInputTokens: estimate})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error: %v", err)
+	}
+	if usage := result["usage"].(Usage); usage.InputTokens != 7 || estimates != 0 {
+		t.Errorf("Input tokens = %d after %d estimates, expected the upstream's 7 without estimating", usage.InputTokens, estimates)
+	}
+
+	resp.Usage = nil
+	result, _ = OpenAIToAnthropic(resp, "test/model", ResponseOptions{EstimateInputTokens: func() int { return 42 }})
+	if usage := result["usage"].(Usage); usage.InputTokens != 42 {
+		t.Errorf("Input tokens = %d, expected the estimate 42", usage.InputTokens)
+	}
+}
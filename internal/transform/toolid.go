@@ -0,0 +1,78 @@
+package transform
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"strings"
+)
+
+const (
+	// toolIDAlphabet encodes hashed tool call IDs using only alphanumeric characters
+	toolIDAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	// strictToolIDLength is the ID length required by Mistral-style upstreams
+	strictToolIDLength = 9
+	// anthropicToolIDPrefix starts every tool_use ID returned to clients
+	anthropicToolIDPrefix = "toolu_"
+	// anthropicToolIDLength is the length of the hashed part of generated tool_use IDs
+	anthropicToolIDLength = 24
+)
+
+// toolIDMapper rewrites Anthropic tool_use IDs into the 9-character alphanumeric form
+// strict upstreams require. IDs are derived by hashing, so replaying the same
+// conversation always produces the same upstream IDs. A nil mapper leaves IDs unchanged.
+type toolIDMapper struct {
+	upstreamIDs map[string]string
+	originals   map[string]string
+}
+
+// newToolIDMapper creates a mapper for an upstream with strict tool call IDs
+func newToolIDMapper() *toolIDMapper {
+	return &toolIDMapper{
+		upstreamIDs: make(map[string]string),
+		originals:   make(map[string]string),
+	}
+}
+
+// upstream returns the upstream tool call ID for an Anthropic tool_use ID
+func (m *toolIDMapper) upstream(id string) string {
+	if m == nil {
+		return id
+	}
+	if mapped, ok := m.upstreamIDs[id]; ok {
+		return mapped
+	}
+
+	// Rehash on the rare collision so distinct calls never share an ID
+	seed := id
+	for attempt := 1; ; attempt++ {
+		candidate := hashToolID(seed, strictToolIDLength)
+		if _, taken := m.originals[candidate]; !taken {
+			m.upstreamIDs[id] = candidate
+			m.originals[candidate] = id
+			return candidate
+		}
+		seed = id + "#" + strconv.Itoa(attempt)
+	}
+}
+
+// anthropicToolID returns the tool_use ID sent to the client for an upstream tool call.
+// IDs already in Anthropic form are kept; empty, duplicate and provider-specific IDs are
+// replaced by a toolu_ ID derived from the message ID and the call's position.
+func anthropicToolID(messageID, upstreamID string, position int, seen map[string]bool) string {
+	id := upstreamID
+	if !strings.HasPrefix(id, anthropicToolIDPrefix) || seen[id] {
+		id = anthropicToolIDPrefix + hashToolID(messageID+"/"+upstreamID+"/"+strconv.Itoa(position), anthropicToolIDLength)
+	}
+	seen[id] = true
+	return id
+}
+
+// hashToolID derives an alphanumeric ID of the given length (at most 32) from a seed
+func hashToolID(seed string, length int) string {
+	sum := sha256.Sum256([]byte(seed))
+	id := make([]byte, length)
+	for i := range id {
+		id[i] = toolIDAlphabet[int(sum[i])%len(toolIDAlphabet)]
+	}
+	return string(id)
+}
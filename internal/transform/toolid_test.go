@@ -0,0 +1,139 @@
+package transform
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"athena/internal/config"
+)
+
+var strictToolIDPattern = regexp.MustCompile(`^[a-zA-Z0-9]{9}$`)
+
+func TestToolIDMapper(t *testing.T) {
+	m := newToolIDMapper()
+
+	first := m.upstream("toolu_01A09q90qw90lq917835lq9")
+	if !strictToolIDPattern.MatchString(first) {
+		t.Errorf("Upstream ID %q should be 9 alphanumeric characters", first)
+	}
+	if again := m.upstream("toolu_01A09q90qw90lq917835lq9"); again != first {
+		t.Errorf("Upstream ID = %q on second call, expected %q", again, first)
+	}
+	if replay := newToolIDMapper().upstream("toolu_01A09q90qw90lq917835lq9"); replay != first {
+		t.Errorf("Upstream ID = %q in a new mapper, expected deterministic %q", replay, first)
+	}
+	if other := m.upstream("toolu_02"); other == first {
+		t.Errorf("Distinct IDs mapped to the same upstream ID %q", other)
+	}
+
+	var passthrough *toolIDMapper
+	if id := passthrough.upstream("toolu_abc"); id != "toolu_abc" {
+		t.Errorf("Nil mapper returned %q, expected the ID unchanged", id)
+	}
+}
+
+func TestToolIDMapper_Collision(t *testing.T) {
+	m := newToolIDMapper()
+	taken := hashToolID("toolu_b", strictToolIDLength)
+	m.originals[taken] = "toolu_a"
+	m.upstreamIDs["toolu_a"] = taken
+
+	id := m.upstream("toolu_b")
+	if id == taken || !strictToolIDPattern.MatchString(id) {
+		t.Errorf("Upstream ID = %q, expected a fresh 9-character ID", id)
+	}
+}
+
+func TestAnthropicToolID(t *testing.T) {
+	seen := map[string]bool{}
+
+	if id := anthropicToolID("msg_1", "toolu_keep", 0, seen); id != "toolu_keep" {
+		t.Errorf("ID = %q, expected Anthropic IDs to be kept", id)
+	}
+
+	duplicate := anthropicToolID("msg_1", "toolu_keep", 1, seen)
+	empty := anthropicToolID("msg_1", "", 2, seen)
+	mistral := anthropicToolID("msg_1", "aB3dE6gH9", 3, seen)
+
+	for _, id := range []string{duplicate, empty, mistral} {
+		if !strings.HasPrefix(id, "toolu_") || len(id) != len("toolu_")+anthropicToolIDLength {
+			t.Errorf("ID = %q, expected a generated toolu_ ID", id)
+		}
+	}
+	if duplicate == "toolu_keep" || duplicate == empty || empty == mistral {
+		t.Errorf("Generated IDs should be unique: %q %q %q", duplicate, empty, mistral)
+	}
+	if replay := anthropicToolID("msg_1", "aB3dE6gH9", 3, map[string]bool{}); replay != mistral {
+		t.Errorf("ID = %q on replay, expected deterministic %q", replay, mistral)
+	}
+}
+
+func TestAnthropicToOpenAI_StrictToolIDs(t *testing.T) {
+	cfg := &config.Config{
+		Model:              "mistralai/devstral-medium",
+		StrictToolIDModels: config.DefaultStrictToolIDModels,
+	}
+	req := AnthropicRequest{
+		Model: "claude-3-5-sonnet",
+		Messages: []Message{
+			{Role: "user", Content: json.RawMessage(`"List files"`)},
+			{Role: "assistant", Content: json.RawMessage(`[{"type":"tool_use","id":"toolu_01A09q90qw90lq917835lq9","name":"ls","input":{}}]`)},
+			{Role: "user", Content: json.RawMessage(`[{"type":"tool_result","tool_use_id":"toolu_01A09q90qw90lq917835lq9","content":"a.go"}]`)},
+		},
+	}
+
+	result := AnthropicToOpenAI(req, cfg)
+
+	if len(result.Messages) != 3 || len(result.Messages[1].ToolCalls) != 1 {
+		t.Fatalf("Expected user, assistant tool call and tool messages, got %+v", result.Messages)
+	}
+	callID := result.Messages[1].ToolCalls[0].ID
+	if !strictToolIDPattern.MatchString(callID) {
+		t.Errorf("Tool call ID = %q, expected 9 alphanumeric characters", callID)
+	}
+	if result.Messages[2].ToolCallID != callID {
+		t.Errorf("Tool message call ID = %q, expected %q", result.Messages[2].ToolCallID, callID)
+	}
+
+	// Other upstreams receive the original IDs
+	cfg.Model = "moonshotai/kimi-k2"
+	result = AnthropicToOpenAI(req, cfg)
+	if id := result.Messages[1].ToolCalls[0].ID; id != "toolu_01A09q90qw90lq917835lq9" {
+		t.Errorf("Tool call ID = %q, expected the original ID", id)
+	}
+}
+
+func TestHandleStreaming_ToolIDs(t *testing.T) {
+	streamData := `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"","type":"function","function":{"name":"ls","arguments":"{}"}}]}}]}
+
+data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"aB3dE6gH9","type":"function","function":{"name":"ls","arguments":"{}"}}]}}]}
+
+data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":2,"id":"aB3dE6gH9","type":"function","function":{"name":"ls","arguments":"{}"}}]}}]}
+
+data: {"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}
+
+data: [DONE]
+
+`
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(streamData)),
+		Header:     make(http.Header),
+	}
+
+	w := httptest.NewRecorder()
+	HandleStreaming(w, resp, "mistralai/devstral-medium", ResponseOptions{})
+
+	body, _ := io.ReadAll(w.Result().Body)
+
+	// collectToolInputs checks that every tool_use ID is a unique toolu_ ID
+	if inputs := collectToolInputs(t, string(body)); len(inputs) != 3 {
+		t.Errorf("Expected 3 tool_use blocks, got %d", len(inputs))
+	}
+}
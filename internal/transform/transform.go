@@ -1,8 +1,8 @@
 package transform
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -14,29 +14,41 @@ import (
 )
 
 const (
-	contentTypeText = "text"
-	roleUser        = "user"
-	stopReasonEnd   = "end_turn"
+	contentTypeText        = "text"
+	contentTypeImage       = "image"
+	roleUser               = "user"
+	stopReasonEnd          = "end_turn"
+	stopReasonStopSequence = "stop_sequence"
+	stopReasonMaxTokens    = "max_tokens"
+	stopReasonRefusal      = "refusal"
 )
 
 // AnthropicToOpenAI converts Anthropic request to OpenAI format
 func AnthropicToOpenAI(req AnthropicRequest, cfg *config.Config) OpenAIRequest {
 	messages := []OpenAIMessage{}
 
+	mappedModel := MapModel(req.Model, cfg)
+	// OpenRouter-only fields are rejected or ignored by other OpenAI-compatible upstreams
+	extensions := usesOpenRouterExtensions(req.Model, cfg)
+	opts := messageOptions{
+		imagesInToolResults: modelMatches(mappedModel, cfg.ToolResultImageModels),
+		cacheControl:        modelMatches(mappedModel, cfg.CacheControlModels),
+		reasoning:           extensions,
+	}
+	if modelMatches(mappedModel, cfg.StrictToolIDModels) {
+		opts.toolIDs = newToolIDMapper()
+	}
+
 	// Handle system messages
 	if len(req.System) > 0 {
 		var systemArray []ContentBlock
 		if err := json.Unmarshal(req.System, &systemArray); err == nil {
+			// Each block becomes its own part of a single system message
+			content := []map[string]interface{}{}
 			for _, item := range systemArray {
-				content := []map[string]interface{}{
-					{
-						"type": "text",
-						"text": item.Text,
-					},
-				}
-				if strings.Contains(req.Model, "claude") {
-					content[0]["cache_control"] = map[string]string{"type": "ephemeral"}
-				}
+				content = append(content, textPart(item.Text, opts.cacheControlFor(item.CacheControl)))
+			}
+			if len(content) > 0 {
 				messages = append(messages, OpenAIMessage{
 					Role:    "system",
 					Content: content,
@@ -45,14 +57,9 @@ func AnthropicToOpenAI(req AnthropicRequest, cfg *config.Config) OpenAIRequest {
 		} else {
 			var systemString string
 			if err := json.Unmarshal(req.System, &systemString); err == nil {
+				// A plain string system prompt has no breakpoint of its own, so cache it as a whole
 				content := []map[string]interface{}{
-					{
-						"type": "text",
-						"text": systemString,
-					},
-				}
-				if strings.Contains(req.Model, "claude") {
-					content[0]["cache_control"] = map[string]string{"type": "ephemeral"}
+					textPart(systemString, opts.cacheControlFor(&CacheControl{Type: "ephemeral"})),
 				}
 				messages = append(messages, OpenAIMessage{
 					Role:    "system",
@@ -64,53 +71,191 @@ func AnthropicToOpenAI(req AnthropicRequest, cfg *config.Config) OpenAIRequest {
 
 	// Transform messages
 	for _, msg := range req.Messages {
-		openAIMsgs := transformMessage(msg)
+		openAIMsgs := transformMessage(msg, opts)
 		messages = append(messages, openAIMsgs...)
 	}
 
-	// Validate tool calls
-	messages = validateToolCalls(messages)
+	// Keep tool results next to their calls, then repair or drop any that remain unmatched
+	messages = orderToolResults(messages)
+	if cfg.ToolCallRepair == config.ToolCallRepairRepair {
+		messages = repairToolCalls(messages, req.RequestID)
+	} else {
+		messages = validateToolCalls(messages)
+	}
+	messages = mergeUserMessages(messages)
 
-	mappedModel := MapModel(req.Model, cfg)
 	result := OpenAIRequest{
 		Model:       mappedModel,
 		Messages:    messages,
 		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stop:        req.StopSequences,
 		Stream:      req.Stream,
 	}
 
-	// Add provider routing from config
-	if provider := GetProviderForModel(req.Model, cfg); provider != nil {
-		result.Provider = provider
+	// Reasoning model families reject max_tokens in favor of max_completion_tokens
+	if usesMaxCompletionTokens(mappedModel) {
+		result.MaxCompletionTokens = req.MaxTokens
+	} else {
+		result.MaxTokens = req.MaxTokens
+	}
+
+	if req.Metadata != nil {
+		result.User = req.Metadata.UserID
+	}
+
+	// Ask the upstream to report token usage, including on the final stream chunk
+	if req.Stream {
+		result.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+
+	if extensions {
+		result.TopK = req.TopK
+		result.Usage = &UsageConfig{Include: true}
+
+		// Map extended thinking to OpenRouter reasoning
+		if req.Thinking != nil && req.Thinking.Type == "enabled" {
+			result.Reasoning = &ReasoningConfig{MaxTokens: req.Thinking.BudgetTokens}
+			if req.Thinking.BudgetTokens == 0 {
+				enabled := true
+				result.Reasoning.Enabled = &enabled
+			}
+		}
+
+		// Add provider routing from config
+		if provider := GetProviderForModel(req.Model, cfg); provider != nil {
+			result.Provider = provider
+		}
 	}
 
 	// Transform tools
 	if len(req.Tools) > 0 {
 		tools := []OpenAITool{}
+		profile := schemaProfileFor(mappedModel, cfg)
+		pipeline := buildSchemaPipeline(profile)
+		strict := usesStrictSchemas(profile)
+		serverTools := map[string]bool{}
+		toolNames := ToolNameMap{}
+		declared := map[string]bool{}
 		for _, tool := range req.Tools {
-			// Remove format: "uri" from parameters
-			cleanedParams := removeUriFormat(tool.InputSchema)
+			if isServerTool(tool) {
+				applyServerTool(&result, tool, cfg, extensions)
+				serverTools[tool.Name] = true
+				continue
+			}
+
+			name, description, schema := tool.Name, tool.Description, tool.InputSchema
+			if clientName, clientDescription, clientSchema, ok := clientToolFunction(tool); ok {
+				// Anthropic-defined client tools imply their schema, so expand them into full functions
+				name, description, schema = clientName, clientDescription, clientSchema
+				if tool.Description != "" {
+					description = tool.Description
+				}
+				addClientToolNames(toolNames, tool, name)
+			} else if len(schema) == 0 {
+				if tool.Type != "" && tool.Type != "custom" {
+					slog.Warn("dropping unsupported tool type", "type", tool.Type, "name", tool.Name)
+					continue
+				}
+				schema = json.RawMessage(`{"type":"object","properties":{}}`)
+			}
+			declared[name] = true
+
+			// Sanitize the schema for the upstream model family
+			cleanedParams := pipeline.Apply(schema)
 			tools = append(tools, OpenAITool{
 				Type: "function",
 				Function: struct {
 					Name        string          `json:"name"`
 					Description string          `json:"description,omitempty"`
 					Parameters  json.RawMessage `json:"parameters"`
+					Strict      bool            `json:"strict,omitempty"`
 				}{
-					Name:        tool.Name,
-					Description: tool.Description,
+					Name:        name,
+					Description: description,
 					Parameters:  cleanedParams,
+					Strict:      strict,
 				},
+				CacheControl: opts.cacheControlFor(tool.CacheControl),
 			})
+			if strict {
+				if result.StrictToolSchemas == nil {
+					result.StrictToolSchemas = map[string]json.RawMessage{}
+				}
+				result.StrictToolSchemas[name] = schema
+			}
 		}
 		result.Tools = tools
+
+		// Aliases never override a tool the client declared under that name
+		for alias := range toolNames {
+			if declared[alias] {
+				delete(toolNames, alias)
+			}
+		}
+		if len(toolNames) > 0 {
+			result.ToolNames = toolNames
+		}
+
+		// OpenAI rejects tool_choice when no tools are declared
+		if req.ToolChoice != nil && len(tools) > 0 {
+			result.ToolChoice = transformToolChoice(req.ToolChoice)
+			if req.ToolChoice.Type == "tool" && serverTools[req.ToolChoice.Name] {
+				// Server tools run on the provider and cannot be forced
+				result.ToolChoice = "auto"
+			}
+			if req.ToolChoice.DisableParallelToolUse {
+				parallel := false
+				result.ParallelToolCalls = &parallel
+			}
+		}
 	}
 
 	return result
 }
 
+// transformToolChoice converts an Anthropic tool_choice to OpenAI format
+func transformToolChoice(choice *ToolChoice) interface{} {
+	switch choice.Type {
+	case "any":
+		return "required"
+	case "none":
+		return "none"
+	case "tool":
+		return map[string]interface{}{
+			"type": "function",
+			"function": map[string]string{
+				"name": choice.Name,
+			},
+		}
+	default:
+		return "auto"
+	}
+}
+
+// messageOptions holds the upstream capabilities that affect message translation
+type messageOptions struct {
+	// imagesInToolResults keeps tool_result images inside the tool message
+	// instead of forwarding them as a follow-up user message
+	imagesInToolResults bool
+	// cacheControl forwards Anthropic cache_control breakpoints to the upstream
+	cacheControl bool
+	// reasoning forwards thinking blocks as OpenRouter reasoning and reasoning_details
+	reasoning bool
+	// toolIDs rewrites tool call IDs for upstreams with strict ID formats
+	toolIDs *toolIDMapper
+}
+
+// cacheControlFor returns the cache_control marker to forward, or nil when caching is disabled
+func (o messageOptions) cacheControlFor(cc *CacheControl) *CacheControl {
+	if !o.cacheControl {
+		return nil
+	}
+	return cc
+}
+
 // transformMessage converts a single Anthropic message to OpenAI format
-func transformMessage(msg Message) []OpenAIMessage {
+func transformMessage(msg Message, opts messageOptions) []OpenAIMessage {
 	result := []OpenAIMessage{}
 
 	var content []ContentBlock
@@ -126,74 +271,309 @@ func transformMessage(msg Message) []OpenAIMessage {
 		return result
 	}
 
-	if msg.Role == RoleAssistant {
-		assistantMsg := OpenAIMessage{
-			Role:    "assistant",
-			Content: nil,
-		}
-		textContent := ""
-		toolCalls := []ToolCall{}
-
-		for _, block := range content {
-			if block.Type == contentTypeText {
-				textContent += block.Text + "\n"
-			} else if block.Type == TypeToolUse {
-				args, _ := json.Marshal(block.Input)
-				toolCalls = append(toolCalls, ToolCall{
-					ID:   block.ID,
-					Type: "function",
-					Function: struct {
-						Name      string `json:"name"`
-						Arguments string `json:"arguments"`
-					}{
-						Name:      block.Name,
-						Arguments: string(args),
-					},
-				})
+	switch msg.Role {
+	case RoleAssistant:
+		result = transformAssistantContent(content, opts)
+	case roleUser:
+		result = transformUserContent(content, opts)
+	}
+
+	return result
+}
+
+// assistantTurn accumulates the blocks of one OpenAI assistant message
+type assistantTurn struct {
+	text             string
+	textBlocks       []map[string]interface{}
+	hasCacheControl  bool
+	reasoningText    string
+	reasoningDetails []ReasoningDetail
+	toolCalls        []ToolCall
+}
+
+// appendTo adds the turn to messages if it has any content or tool calls
+func (t *assistantTurn) appendTo(messages []OpenAIMessage, opts messageOptions) []OpenAIMessage {
+	msg := OpenAIMessage{Role: RoleAssistant}
+	trimmedText := strings.TrimSpace(t.text)
+	if t.hasCacheControl {
+		// Keep text blocks as separate parts so their breakpoints survive
+		msg.Content = t.textBlocks
+	} else if trimmedText != "" {
+		msg.Content = trimmedText
+	}
+	if len(t.toolCalls) > 0 {
+		msg.ToolCalls = t.toolCalls
+	}
+	if opts.reasoning && len(t.reasoningDetails) > 0 {
+		msg.Reasoning = t.reasoningText
+		msg.ReasoningDetails = t.reasoningDetails
+	}
+	if msg.Content == nil && len(msg.ToolCalls) == 0 {
+		return messages
+	}
+	return append(messages, msg)
+}
+
+// transformAssistantContent converts assistant blocks to OpenAI messages. OpenAI places
+// content before tool_calls, so text or reasoning after a tool call starts a new message.
+func transformAssistantContent(content []ContentBlock, opts messageOptions) []OpenAIMessage {
+	result := []OpenAIMessage{}
+	turn := &assistantTurn{}
+
+	for _, block := range content {
+		switch block.Type {
+		case contentTypeText, TypeThinking, TypeRedacted:
+			if len(turn.toolCalls) > 0 {
+				result = turn.appendTo(result, opts)
+				turn = &assistantTurn{}
 			}
 		}
 
-		trimmedText := strings.TrimSpace(textContent)
-		if trimmedText != "" {
-			assistantMsg.Content = trimmedText
-		}
-		if len(toolCalls) > 0 {
-			assistantMsg.ToolCalls = toolCalls
-		}
-		if assistantMsg.Content != nil || len(assistantMsg.ToolCalls) > 0 {
-			result = append(result, assistantMsg)
+		switch block.Type {
+		case contentTypeText:
+			turn.text += block.Text + "\n"
+			cc := opts.cacheControlFor(block.CacheControl)
+			turn.hasCacheControl = turn.hasCacheControl || cc != nil
+			turn.textBlocks = append(turn.textBlocks, textPart(block.Text, cc))
+		case TypeThinking:
+			turn.reasoningText += block.Thinking
+			turn.reasoningDetails = append(turn.reasoningDetails, ReasoningDetail{
+				Type:      reasoningTypeText,
+				Text:      block.Thinking,
+				Signature: block.Signature,
+			})
+		case TypeRedacted:
+			turn.reasoningDetails = append(turn.reasoningDetails, ReasoningDetail{
+				Type: reasoningTypeEncrypted,
+				Data: block.Data,
+			})
+		case TypeToolUse:
+			args, _ := json.Marshal(block.Input)
+			turn.toolCalls = append(turn.toolCalls, ToolCall{
+				ID:   opts.toolIDs.upstream(block.ID),
+				Type: "function",
+				Function: struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				}{
+					Name:      block.Name,
+					Arguments: string(args),
+				},
+			})
 		}
-	} else if msg.Role == roleUser {
-		userText := ""
-		toolMessages := []OpenAIMessage{}
+	}
+
+	return turn.appendTo(result, opts)
+}
+
+// userTurn accumulates a run of text and image blocks forming one OpenAI user message
+type userTurn struct {
+	text        string
+	parts       []map[string]interface{}
+	richContent bool
+}
+
+// appendTo adds the turn to messages if it has any content
+func (t *userTurn) appendTo(messages []OpenAIMessage) []OpenAIMessage {
+	if t.richContent {
+		// Images and cache breakpoints need the multi-part content form
+		return append(messages, OpenAIMessage{Role: roleUser, Content: t.parts})
+	}
+	if trimmedText := strings.TrimSpace(t.text); trimmedText != "" {
+		return append(messages, OpenAIMessage{Role: roleUser, Content: trimmedText})
+	}
+	return messages
+}
 
-		for _, block := range content {
-			if block.Type == contentTypeText {
-				userText += block.Text + "\n"
-			} else if block.Type == "tool_result" {
-				var content string
-				if err := json.Unmarshal(block.Content, &content); err != nil {
-					content = string(block.Content)
+// transformUserContent converts user blocks to OpenAI messages in their original order.
+// Runs of text and images become user messages and each tool_result becomes a tool message.
+func transformUserContent(content []ContentBlock, opts messageOptions) []OpenAIMessage {
+	result := []OpenAIMessage{}
+	turn := &userTurn{}
+
+	for _, block := range content {
+		switch block.Type {
+		case contentTypeText:
+			turn.text += block.Text + "\n"
+			cc := opts.cacheControlFor(block.CacheControl)
+			turn.richContent = turn.richContent || cc != nil
+			turn.parts = append(turn.parts, textPart(block.Text, cc))
+		case contentTypeImage:
+			if part := imagePart(block.Source); part != nil {
+				if cc := opts.cacheControlFor(block.CacheControl); cc != nil {
+					part["cache_control"] = cc
+				}
+				turn.parts = append(turn.parts, part)
+				turn.richContent = true
+			}
+		case "tool_result":
+			result = turn.appendTo(result)
+			turn = &userTurn{}
+
+			text, images := toolResultContent(block.Content)
+			if block.IsError {
+				text = toolErrorText(text)
+			}
+
+			var toolContent interface{} = text
+			cc := opts.cacheControlFor(block.CacheControl)
+			if cc != nil {
+				toolContent = []map[string]interface{}{textPart(text, cc)}
+			}
+			if len(images) > 0 {
+				if opts.imagesInToolResults {
+					parts := append(textParts(text), images...)
+					if cc != nil {
+						parts[len(parts)-1]["cache_control"] = cc
+					}
+					toolContent = parts
+				} else {
+					// Tool messages cannot carry images, so forward them in the following user message
+					turn.parts = append(turn.parts, map[string]interface{}{
+						"type": "text",
+						"text": "Images returned by tool call " + block.ToolUseID + ":",
+					})
+					turn.parts = append(turn.parts, images...)
+					turn.richContent = true
 				}
-				toolMessages = append(toolMessages, OpenAIMessage{
-					Role:       "tool",
-					ToolCallID: block.ToolUseID,
-					Content:    content,
-				})
 			}
-		}
 
-		trimmedText := strings.TrimSpace(userText)
-		if trimmedText != "" {
 			result = append(result, OpenAIMessage{
-				Role:    "user",
-				Content: trimmedText,
+				Role:       RoleTool,
+				ToolCallID: opts.toolIDs.upstream(block.ToolUseID),
+				Content:    toolContent,
 			})
 		}
-		result = append(result, toolMessages...)
 	}
 
-	return result
+	return turn.appendTo(result)
+}
+
+// orderToolResults moves each tool message directly after the assistant message that made
+// the call, since many providers require results to follow their tool_calls immediately.
+// Tool messages without a matching call are left in place.
+func orderToolResults(messages []OpenAIMessage) []OpenAIMessage {
+	calls := map[string]bool{}
+	for _, msg := range messages {
+		for _, toolCall := range msg.ToolCalls {
+			calls[toolCall.ID] = true
+		}
+	}
+
+	results := map[string]OpenAIMessage{}
+	for _, msg := range messages {
+		if msg.Role == RoleTool && calls[msg.ToolCallID] {
+			if _, exists := results[msg.ToolCallID]; !exists {
+				results[msg.ToolCallID] = msg
+			}
+		}
+	}
+
+	ordered := make([]OpenAIMessage, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Role == RoleTool && calls[msg.ToolCallID] {
+			continue
+		}
+		ordered = append(ordered, msg)
+		for _, toolCall := range msg.ToolCalls {
+			if result, ok := results[toolCall.ID]; ok {
+				ordered = append(ordered, result)
+				delete(results, toolCall.ID)
+			}
+		}
+	}
+	return ordered
+}
+
+// toolResultContent extracts the text and image parts of a tool_result content field,
+// which may be either a plain string or an array of content blocks
+func toolResultContent(raw json.RawMessage) (string, []map[string]interface{}) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return string(raw), nil
+	}
+
+	texts := []string{}
+	images := []map[string]interface{}{}
+	for _, block := range blocks {
+		switch block.Type {
+		case contentTypeText:
+			texts = append(texts, block.Text)
+		case contentTypeImage:
+			if part := imagePart(block.Source); part != nil {
+				images = append(images, part)
+			}
+		}
+	}
+
+	return strings.Join(texts, "\n"), images
+}
+
+// toolErrorText marks tool output as a failure so the model knows the call did not succeed
+func toolErrorText(text string) string {
+	if text == "" {
+		return "Error: tool execution failed"
+	}
+	return "Error: " + text
+}
+
+// textParts returns a single text content part, or no parts for empty text
+func textParts(text string) []map[string]interface{} {
+	if text == "" {
+		return []map[string]interface{}{}
+	}
+	return []map[string]interface{}{textPart(text, nil)}
+}
+
+// textPart builds a text content part with an optional cache_control breakpoint
+func textPart(text string, cc *CacheControl) map[string]interface{} {
+	part := map[string]interface{}{
+		"type": "text",
+		"text": text,
+	}
+	if cc != nil {
+		part["cache_control"] = cc
+	}
+	return part
+}
+
+// modelMatches reports whether a model name contains any of the given patterns
+func modelMatches(model string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern != "" && strings.Contains(model, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// imagePart converts an Anthropic image source to an OpenAI image_url content part
+func imagePart(source *ImageSource) map[string]interface{} {
+	if source == nil {
+		return nil
+	}
+
+	var url string
+	switch source.Type {
+	case "base64":
+		url = "data:" + source.MediaType + ";base64," + source.Data
+	case "url":
+		url = source.URL
+	default:
+		return nil
+	}
+
+	return map[string]interface{}{
+		"type": "image_url",
+		"image_url": map[string]interface{}{
+			"url": url,
+		},
+	}
 }
 
 // validateToolCalls ensures tool calls have matching tool responses
@@ -279,8 +659,128 @@ func validateToolCalls(messages []OpenAIMessage) []OpenAIMessage {
 	return validated
 }
 
-// MapModel maps Anthropic model names to configured OpenRouter models
+// interruptedToolResult is the placeholder result for a tool call that never returned
+const interruptedToolResult = "Tool call was interrupted before it returned a result."
+
+// repairToolCalls makes tool calls and results consistent without losing history: calls
+// with no following result get a placeholder result, and results with no matching call
+// are converted into user text. Expects tool results already ordered after their calls.
+func repairToolCalls(messages []OpenAIMessage, requestID string) []OpenAIMessage {
+	repaired := make([]OpenAIMessage, 0, len(messages))
+	var calls []ToolCall
+	pending := map[string]bool{}
+	orphans := []OpenAIMessage{}
+
+	for i, msg := range messages {
+		if msg.Role == RoleTool {
+			if pending[msg.ToolCallID] {
+				delete(pending, msg.ToolCallID)
+				repaired = append(repaired, msg)
+			} else {
+				slog.Warn("converted orphaned tool result to user text",
+					"request_id", requestID,
+					"tool_call_id", msg.ToolCallID,
+				)
+				orphans = append(orphans, orphanedToolResult(msg))
+			}
+		} else {
+			repaired = append(repaired, msg)
+			calls = msg.ToolCalls
+			pending = map[string]bool{}
+			for _, toolCall := range calls {
+				pending[toolCall.ID] = true
+			}
+		}
+
+		if i+1 < len(messages) && messages[i+1].Role == RoleTool {
+			continue
+		}
+
+		// The run of results has ended, so answer dangling calls before any converted results
+		for _, toolCall := range calls {
+			if !pending[toolCall.ID] {
+				continue
+			}
+			slog.Warn("added placeholder result for dangling tool call",
+				"request_id", requestID,
+				"tool_call_id", toolCall.ID,
+				"tool", toolCall.Function.Name,
+			)
+			repaired = append(repaired, OpenAIMessage{
+				Role:       RoleTool,
+				ToolCallID: toolCall.ID,
+				Content:    interruptedToolResult,
+			})
+		}
+		repaired = append(repaired, orphans...)
+		calls = nil
+		pending = map[string]bool{}
+		orphans = orphans[:0]
+	}
+
+	return repaired
+}
+
+// mergeUserMessages joins adjacent user messages, which strict providers reject. They
+// arise from tool result images forwarded after the tool messages, converted orphaned
+// results and consecutive Anthropic user messages.
+func mergeUserMessages(messages []OpenAIMessage) []OpenAIMessage {
+	merged := make([]OpenAIMessage, 0, len(messages))
+	for _, msg := range messages {
+		if last := len(merged) - 1; last >= 0 && msg.Role == roleUser && merged[last].Role == roleUser {
+			merged[last].Content = joinUserContent(merged[last].Content, msg.Content)
+			continue
+		}
+		merged = append(merged, msg)
+	}
+	return merged
+}
+
+// joinUserContent concatenates two user message contents, keeping plain text when both
+// are text and using the multi-part form otherwise
+func joinUserContent(first, second interface{}) interface{} {
+	firstText, firstIsText := first.(string)
+	secondText, secondIsText := second.(string)
+	if firstIsText && secondIsText {
+		return firstText + "\n\n" + secondText
+	}
+	parts := append([]map[string]interface{}{}, userContentParts(first)...)
+	return append(parts, userContentParts(second)...)
+}
+
+// userContentParts returns user message content in the multi-part form
+func userContentParts(content interface{}) []map[string]interface{} {
+	switch c := content.(type) {
+	case string:
+		return textParts(c)
+	case []map[string]interface{}:
+		return c
+	default:
+		return nil
+	}
+}
+
+// orphanedToolResult converts a tool result without a matching call into a user message
+func orphanedToolResult(msg OpenAIMessage) OpenAIMessage {
+	label := "Result of tool call " + msg.ToolCallID + ":"
+	switch content := msg.Content.(type) {
+	case string:
+		return OpenAIMessage{Role: roleUser, Content: label + "\n" + content}
+	case []map[string]interface{}:
+		parts := append([]map[string]interface{}{textPart(label, nil)}, content...)
+		return OpenAIMessage{Role: roleUser, Content: parts}
+	default:
+		return OpenAIMessage{Role: roleUser, Content: label}
+	}
+}
+
+// MapModel maps Anthropic model names to configured OpenRouter models, checking exact aliases first.
+// Models routed to an Anthropic-format upstream keep their name unless an alias or family
+// model maps them, since the default model names an OpenAI-format model.
 func MapModel(anthropicModel string, cfg *config.Config) string {
+	if isModelAlias(anthropicModel, cfg) {
+		return cfg.ModelAliases[anthropicModel]
+	}
 	if strings.Contains(anthropicModel, "/") {
 		return anthropicModel
 	}
@@ -292,13 +792,105 @@ func MapModel(anthropicModel string, cfg *config.Config) string {
 		return cfg.SonnetModel
 	case strings.Contains(anthropicModel, "opus") && cfg.OpusModel != "":
 		return cfg.OpusModel
+	case routesToAnthropic(anthropicModel, cfg):
+		return anthropicModel
 	default:
 		return cfg.Model // Use default model
 	}
 }
 
-// GetProviderForModel returns the provider configuration for a given model
+// routesToAnthropic reports whether a model is routed to an Anthropic-format upstream
+func routesToAnthropic(anthropicModel string, cfg *config.Config) bool {
+	upstream, ok := cfg.ResolveUpstream(GetUpstreamForModel(anthropicModel, cfg))
+	return ok && upstream.Format == config.UpstreamFormatAnthropic
+}
+
+// isModelAlias reports whether a requested model is a model_aliases entry
+func isModelAlias(anthropicModel string, cfg *config.Config) bool {
+	upstream, ok := cfg.ModelAliases[anthropicModel]
+	return ok && upstream != ""
+}
+
+// usesMaxCompletionTokens reports whether a model expects max_completion_tokens instead of max_tokens
+func usesMaxCompletionTokens(model string) bool {
+	name := model
+	if idx := strings.LastIndex(model, "/"); idx >= 0 {
+		if model[:idx] != "openai" {
+			return false
+		}
+		name = model[idx+1:]
+	}
+
+	for _, prefix := range []string{"o1", "o3", "o4", "gpt-5"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapStopReason maps an OpenAI finish_reason to an Anthropic stop_reason. Some
+// upstreams report "stop" after emitting tool calls, so hasToolUse takes precedence
+// over a plain end of turn.
+func mapStopReason(finishReason, stopSequence string, hasToolUse bool) string {
+	switch finishReason {
+	case "length":
+		return stopReasonMaxTokens
+	case "content_filter":
+		return stopReasonRefusal
+	case "tool_calls", "function_call":
+		return TypeToolUse
+	}
+
+	if stopSequence != "" {
+		return stopReasonStopSequence
+	}
+	if hasToolUse {
+		return TypeToolUse
+	}
+	return stopReasonEnd
+}
+
+// matchedStopSequence returns the stop sequence that ended a choice, if the upstream reports it.
+// vLLM-compatible servers set stop_reason to the matched string; token IDs and nulls are ignored.
+func matchedStopSequence(choice OpenAIChoice) string {
+	if choice.FinishReason != "stop" || len(choice.StopReason) == 0 {
+		return ""
+	}
+	var stopSequence string
+	if err := json.Unmarshal(choice.StopReason, &stopSequence); err != nil {
+		return ""
+	}
+	return stopSequence
+}
+
+// convertUsage maps OpenAI token usage to Anthropic usage. OpenAI prompt_tokens
+// include cached tokens while Anthropic input_tokens exclude them.
+func convertUsage(usage OpenAIUsage) Usage {
+	result := Usage{
+		OutputTokens:         usage.CompletionTokens,
+		CacheReadInputTokens: usage.PromptCacheHitTokens,
+	}
+	if usage.PromptTokensDetails != nil {
+		if usage.PromptTokensDetails.CachedTokens > 0 {
+			result.CacheReadInputTokens = usage.PromptTokensDetails.CachedTokens
+		}
+		result.CacheCreationInputTokens = usage.PromptTokensDetails.CacheWriteTokens
+	}
+
+	result.InputTokens = usage.PromptTokens - result.CacheReadInputTokens - result.CacheCreationInputTokens
+	if result.InputTokens < 0 {
+		result.InputTokens = 0
+	}
+	return result
+}
+
+// GetProviderForModel returns the provider configuration for a given model. Aliased
+// models use the default provider rather than that of a family their name contains.
 func GetProviderForModel(anthropicModel string, cfg *config.Config) *config.ProviderConfig {
+	if isModelAlias(anthropicModel, cfg) {
+		return cfg.DefaultProvider
+	}
 	if strings.Contains(anthropicModel, "/") {
 		// Direct model ID - use default provider
 		return cfg.DefaultProvider
@@ -316,92 +908,106 @@ func GetProviderForModel(anthropicModel string, cfg *config.Config) *config.Prov
 	}
 }
 
-// removeUriFormat removes unsupported "format": "uri" from JSON schema
-func removeUriFormat(schema json.RawMessage) json.RawMessage {
-	var data interface{}
-	if err := json.Unmarshal(schema, &data); err != nil {
-		return schema
+// GetUpstreamForModel returns the name of the upstream a model is routed to, or "" for
+// the top-level base_url. Exact model_upstreams entries take precedence over the family
+// upstreams, which apply to any model naming the family, whether or not the family
+// model is configured, and which aliased models never use.
+func GetUpstreamForModel(anthropicModel string, cfg *config.Config) string {
+	if name, ok := cfg.ModelUpstreams[anthropicModel]; ok && name != "" {
+		return name
+	}
+	if isModelAlias(anthropicModel, cfg) || strings.Contains(anthropicModel, "/") {
+		return cfg.DefaultUpstream
 	}
 
-	cleaned := removeUriFormatFromInterface(data)
-	result, _ := json.Marshal(cleaned)
-	return result
-}
-
-// removeUriFormatFromInterface recursively removes "format": "uri" from data
-func removeUriFormatFromInterface(data interface{}) interface{} {
-	switch v := data.(type) {
-	case map[string]interface{}:
-		result := make(map[string]interface{})
-		for key, value := range v {
-			if key == "format" && value == "uri" {
-				continue
-			}
-			result[key] = removeUriFormatFromInterface(value)
-		}
-		return result
-	case []interface{}:
-		result := make([]interface{}, len(v))
-		for i, item := range v {
-			result[i] = removeUriFormatFromInterface(item)
-		}
-		return result
+	switch {
+	case strings.Contains(anthropicModel, "haiku") && cfg.HaikuUpstream != "":
+		return cfg.HaikuUpstream
+	case strings.Contains(anthropicModel, "sonnet") && cfg.SonnetUpstream != "":
+		return cfg.SonnetUpstream
+	case strings.Contains(anthropicModel, "opus") && cfg.OpusUpstream != "":
+		return cfg.OpusUpstream
 	default:
-		return data
+		return cfg.DefaultUpstream
 	}
 }
 
+// usesOpenRouterExtensions reports whether the upstream a model is routed to accepts
+// OpenRouter's request extensions
+func usesOpenRouterExtensions(anthropicModel string, cfg *config.Config) bool {
+	upstream, ok := cfg.ResolveUpstream(GetUpstreamForModel(anthropicModel, cfg))
+	return ok && upstream.UsesOpenRouterExtensions()
+}
+
 // OpenAIToAnthropic converts OpenAI response to Anthropic format
-func OpenAIToAnthropic(resp map[string]interface{}, modelName string) map[string]interface{} {
+func OpenAIToAnthropic(resp OpenAIResponse, modelName string, opts ResponseOptions) (map[string]interface{}, error) {
+	// Some upstreams report failures in a 200 response body
+	if resp.Error != nil {
+		return nil, openAIError(resp.Error)
+	}
+
 	messageID := fmt.Sprintf("msg_%d", time.Now().UnixNano())
 
+	var usage Usage
+	if resp.Usage != nil {
+		usage = convertUsage(*resp.Usage)
+	} else {
+		usage.InputTokens = opts.estimateInputTokens()
+	}
+
 	content := []map[string]interface{}{}
-	choices := resp["choices"].([]interface{})
-	if len(choices) > 0 {
-		choice := choices[0].(map[string]interface{})
-		message := choice["message"].(map[string]interface{})
+	stopReason := stopReasonEnd
+	var stopSequence interface{}
 
-		if msgContent, ok := message["content"]; ok && msgContent != nil {
-			content = append(content, map[string]interface{}{
-				"type": "text",
-				"text": msgContent,
-			})
+	if len(resp.Choices) > 0 {
+		choice := resp.Choices[0]
+		if choice.Message == nil {
+			return nil, fmt.Errorf("upstream response choice has no message")
 		}
+		message := choice.Message
 
-		if toolCalls, ok := message["tool_calls"]; ok && toolCalls != nil {
-			for _, tc := range toolCalls.([]interface{}) {
-				toolCall := tc.(map[string]interface{})
-				function := toolCall["function"].(map[string]interface{})
-				var input map[string]interface{}
-				if args, ok := function["arguments"].(string); ok {
-					if err := json.Unmarshal([]byte(args), &input); err != nil {
-						// Log error but continue processing
-						input = make(map[string]interface{})
-					}
-				}
+		content = append(content, reasoningBlocks(message)...)
+
+		// Web search results are reported as a server tool call ahead of the cited text
+		citations := urlCitations(message.Annotations, opts.WebSearchDomains)
+		if len(citations) > 0 {
+			content = append(content, webSearchBlocks(messageID, citations)...)
+			usage.ServerToolUse = &ServerToolUsage{WebSearchRequests: 1}
+		}
+
+		if message.Content != "" {
+			if len(citations) > 0 {
+				content = append(content, citedTextBlocks(string(message.Content), citations)...)
+			} else {
 				content = append(content, map[string]interface{}{
-					"type":  TypeToolUse,
-					"id":    toolCall["id"],
-					"name":  function["name"],
-					"input": input,
+					"type": "text",
+					"text": string(message.Content),
 				})
 			}
 		}
 
-		finishReason := choice["finish_reason"].(string)
-		stopReason := stopReasonEnd
-		if finishReason == "tool_calls" {
-			stopReason = TypeToolUse
+		seenToolIDs := map[string]bool{}
+		for i, toolCall := range message.ToolCalls {
+			input := map[string]interface{}{}
+			if args := toolCallArguments(toolCall); args != "" {
+				if err := json.Unmarshal([]byte(args), &input); err != nil {
+					slog.Warn("invalid tool call arguments", "id", toolCall.ID, "name", toolCall.Function.Name, "error", err)
+					input = map[string]interface{}{}
+				}
+			}
+			opts.stripOptionalNulls(toolCall.Function.Name, input)
+			content = append(content, map[string]interface{}{
+				"type":  TypeToolUse,
+				"id":    anthropicToolID(messageID, toolCall.ID, i, seenToolIDs),
+				"name":  opts.ToolNames.client(toolCall.Function.Name),
+				"input": input,
+			})
 		}
 
-		return map[string]interface{}{
-			"id":            messageID,
-			"type":          "message",
-			"role":          "assistant",
-			"content":       content,
-			"stop_reason":   stopReason,
-			"stop_sequence": nil,
-			"model":         modelName,
+		matched := matchedStopSequence(choice)
+		stopReason = mapStopReason(choice.FinishReason, matched, len(message.ToolCalls) > 0)
+		if matched != "" {
+			stopSequence = matched
 		}
 	}
 
@@ -410,27 +1016,99 @@ func OpenAIToAnthropic(resp map[string]interface{}, modelName string) map[string
 		"type":          "message",
 		"role":          "assistant",
 		"content":       content,
-		"stop_reason":   stopReasonEnd,
-		"stop_sequence": nil,
+		"stop_reason":   stopReason,
+		"stop_sequence": stopSequence,
 		"model":         modelName,
+		"usage":         usage,
+	}, nil
+}
+
+// toolCallArguments returns a tool call's arguments as a JSON string. Arguments are
+// normally JSON-encoded strings, but some providers send the object directly.
+func toolCallArguments(toolCall OpenAIToolCallPart) string {
+	raw := toolCall.Function.Arguments
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var args string
+	if err := json.Unmarshal(raw, &args); err == nil {
+		return args
 	}
+	return string(raw)
+}
+
+// reasoningBlocks converts upstream reasoning output into Anthropic thinking blocks.
+// Structured reasoning_details are preferred since they carry signatures and
+// encrypted reasoning; the plain reasoning string is used as a fallback.
+func reasoningBlocks(message *OpenAIResponseMessage) []map[string]interface{} {
+	blocks := []map[string]interface{}{}
+
+	for _, detail := range message.ReasoningDetails {
+		switch detail.Type {
+		case reasoningTypeText, reasoningTypeSummary:
+			text := detail.Text
+			if detail.Type == reasoningTypeSummary {
+				text = detail.Summary
+			}
+			blocks = append(blocks, map[string]interface{}{
+				"type":      TypeThinking,
+				"thinking":  text,
+				"signature": detail.Signature,
+			})
+		case reasoningTypeEncrypted:
+			blocks = append(blocks, map[string]interface{}{
+				"type": TypeRedacted,
+				"data": detail.Data,
+			})
+		}
+	}
+	if len(blocks) > 0 {
+		return blocks
+	}
+
+	if reasoning := reasoningText(message); reasoning != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type":      TypeThinking,
+			"thinking":  reasoning,
+			"signature": "",
+		})
+	}
+	return blocks
+}
+
+// reasoningText returns the plain reasoning string from a message or delta.
+// OpenRouter uses "reasoning" while DeepSeek-compatible APIs use "reasoning_content".
+func reasoningText(message *OpenAIResponseMessage) string {
+	if message.Reasoning != "" {
+		return message.Reasoning
+	}
+	return message.ReasoningContent
 }
 
 // HandleNonStreaming processes non-streaming responses from OpenRouter
-func HandleNonStreaming(w http.ResponseWriter, resp *http.Response, modelName string) {
+func HandleNonStreaming(w http.ResponseWriter, resp *http.Response, modelName string, opts ResponseOptions) {
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		http.Error(w, string(body), resp.StatusCode)
+		UpstreamError(resp, body).Write(w)
 		return
 	}
 
-	var openAIResp map[string]interface{}
+	var openAIResp OpenAIResponse
 	if err := json.NewDecoder(resp.Body).Decode(&openAIResp); err != nil {
-		http.Error(w, "Failed to decode OpenRouter response", http.StatusInternalServerError)
+		WriteError(w, http.StatusBadGateway, "Failed to decode upstream response")
 		return
 	}
 
-	anthropicResp := OpenAIToAnthropic(openAIResp, modelName)
+	anthropicResp, err := OpenAIToAnthropic(openAIResp, modelName, opts)
+	if err != nil {
+		slog.Error("failed to translate response", "error", err)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			apiErr = NewAPIError(http.StatusBadGateway, err.Error())
+		}
+		apiErr.Write(w)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(anthropicResp); err != nil {
@@ -438,11 +1116,54 @@ func HandleNonStreaming(w http.ResponseWriter, resp *http.Response, modelName st
 	}
 }
 
+// streamState tracks the Anthropic content blocks emitted while translating a stream
+type streamState struct {
+	w             http.ResponseWriter
+	flusher       http.Flusher
+	messageID     string
+	modelName     string
+	toolNames     ToolNameMap
+	estimateInput func() int
+	// responseOptions looks up the original schemas of strict-mode tools
+	responseOptions ResponseOptions
+	inputTokens     int
+	messageStarted  bool
+	usage           *Usage
+	nextBlockIndex  int
+	// openBlockType is the text or thinking block currently open, if any
+	openBlockType  string
+	openBlockIndex int
+	// Tool calls are tracked by upstream index, falling back to ID for providers that omit it
+	toolCallsByIndex  map[int]*streamToolCall
+	toolCallsByID     map[string]*streamToolCall
+	clientToolIDs     map[string]bool
+	openToolCalls     []*streamToolCall
+	lastToolCall      *streamToolCall
+	hasToolUse        bool
+	webSearchDomains  *DomainFilter
+	webSearchReported bool
+	finishReason      string
+	stopSequence      string
+}
+
+// streamToolCall tracks a single upstream tool call and its Anthropic content block
+type streamToolCall struct {
+	id         string
+	index      *int
+	name       string
+	blockIndex int
+	arguments  string
+	open       bool
+	// strictSchema is set for strict-mode tools, whose arguments are held back until the
+	// call closes so nulls filled in for optional parameters can be removed
+	strictSchema map[string]interface{}
+}
+
 // HandleStreaming processes streaming responses from OpenRouter
-func HandleStreaming(w http.ResponseWriter, resp *http.Response, modelName string) {
+func HandleStreaming(w http.ResponseWriter, resp *http.Response, modelName string, opts ResponseOptions) {
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		http.Error(w, string(body), resp.StatusCode)
+		UpstreamError(resp, body).Write(w)
 		return
 	}
 
@@ -452,85 +1173,126 @@ func HandleStreaming(w http.ResponseWriter, resp *http.Response, modelName strin
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		WriteError(w, http.StatusInternalServerError, "Streaming not supported")
 		return
 	}
 
-	messageID := fmt.Sprintf("msg_%d", time.Now().UnixNano())
-
-	// Send message_start
-	sendSSE(w, flusher, "message_start", map[string]interface{}{
-		"type": "message_start",
-		"message": map[string]interface{}{
-			"id":            messageID,
-			"type":          "message",
-			"role":          "assistant",
-			"content":       []interface{}{},
-			"model":         modelName,
-			"stop_reason":   nil,
-			"stop_sequence": nil,
-			"usage": map[string]int{
-				"input_tokens":  1,
-				"output_tokens": 1,
-			},
-		},
-	})
+	state := &streamState{
+		w:                w,
+		flusher:          flusher,
+		messageID:        fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		modelName:        modelName,
+		toolNames:        opts.ToolNames,
+		estimateInput:    opts.estimateInputTokens,
+		responseOptions:  opts,
+		webSearchDomains: opts.WebSearchDomains,
+		toolCallsByIndex: make(map[int]*streamToolCall),
+		toolCallsByID:    make(map[string]*streamToolCall),
+		clientToolIDs:    make(map[string]bool),
+	}
 
-	contentBlockIndex := 0
-	hasStartedTextBlock := false
-	isToolUse := false
-	currentToolCallID := ""
-	toolCallJSONMap := make(map[string]string)
+	done := false
+	maxLineSize := opts.MaxSSELineSize
+	if maxLineSize == 0 {
+		maxLineSize = DefaultMaxSSELineSize
+	}
+	decoder := NewSSEDecoder(resp.Body, maxLineSize)
+	for {
+		event, err := decoder.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			state.fail(NewAPIError(http.StatusBadGateway, "Upstream stream interrupted: "+err.Error()))
+			return
+		}
 
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
+		// Comments such as ": OPENROUTER PROCESSING" keep the connection alive
+		if event.Keepalive {
+			slog.Debug("upstream keepalive", "comment", event.Comment)
+			if state.messageStarted {
+				state.send("ping", map[string]string{"type": "ping"})
+			}
 			continue
 		}
 
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
+		if event.Data == "[DONE]" {
+			done = true
 			break
 		}
 
-		var parsed map[string]interface{}
-		if err := json.Unmarshal([]byte(data), &parsed); err != nil {
+		var chunk OpenAIResponse
+		if err := json.Unmarshal([]byte(event.Data), &chunk); err != nil {
+			if event.Event == "error" {
+				state.fail(NewAPIError(http.StatusBadGateway, event.Data))
+				return
+			}
+			slog.Warn("skipping malformed stream chunk", "error", err)
 			continue
 		}
 
-		if choices, ok := parsed["choices"].([]interface{}); ok && len(choices) > 0 {
-			choice := choices[0].(map[string]interface{})
-			if delta, ok := choice["delta"].(map[string]interface{}); ok {
-				processStreamDelta(w, flusher, delta, &contentBlockIndex, &hasStartedTextBlock,
-					&isToolUse, &currentToolCallID, toolCallJSONMap)
+		// OpenRouter reports mid-stream failures as an error chunk
+		if chunk.Error != nil {
+			state.fail(openAIError(chunk.Error))
+			return
+		}
+
+		// Usage usually arrives on the final chunk, but some upstreams report it early
+		if chunk.Usage != nil {
+			usage := convertUsage(*chunk.Usage)
+			state.usage = &usage
+		}
+		state.startMessage()
+
+		if len(chunk.Choices) > 0 {
+			choice := chunk.Choices[0]
+			if choice.Delta != nil {
+				processStreamDelta(state, choice.Delta)
+			}
+			if choice.FinishReason != "" {
+				state.finishReason = choice.FinishReason
+				state.stopSequence = matchedStopSequence(choice)
 			}
 		}
 	}
 
-	// Close last content block
-	if isToolUse || hasStartedTextBlock {
-		sendSSE(w, flusher, "content_block_stop", map[string]interface{}{
-			"type":  "content_block_stop",
-			"index": contentBlockIndex,
-		})
+	// A stream that ends without [DONE] or a finish_reason was cut off
+	if !done && state.finishReason == "" {
+		state.fail(NewAPIError(http.StatusBadGateway, "Upstream stream ended unexpectedly"))
+		return
 	}
 
 	// Send message_delta and message_stop
-	stopReason := stopReasonEnd
-	if isToolUse {
-		stopReason = TypeToolUse
+	stopReason := mapStopReason(state.finishReason, state.stopSequence, state.hasToolUse)
+
+	var stopSequence interface{}
+	if state.stopSequence != "" {
+		stopSequence = state.stopSequence
+	}
+
+	// Empty streams still need a message_start before the closing events
+	state.startMessage()
+
+	// Close any content blocks still open
+	state.closeAllBlocks()
+
+	var usage Usage
+	if state.usage != nil {
+		usage = *state.usage
+	} else {
+		usage.InputTokens = state.inputTokens
+	}
+	if state.webSearchReported {
+		usage.ServerToolUse = &ServerToolUsage{WebSearchRequests: 1}
 	}
 
 	sendSSE(w, flusher, "message_delta", map[string]interface{}{
 		"type": "message_delta",
 		"delta": map[string]interface{}{
 			"stop_reason":   stopReason,
-			"stop_sequence": nil,
-		},
-		"usage": map[string]int{
-			"output_tokens": 150,
+			"stop_sequence": stopSequence,
 		},
+		"usage": usage,
 	})
 
 	sendSSE(w, flusher, "message_stop", map[string]interface{}{
@@ -539,95 +1301,287 @@ func HandleStreaming(w http.ResponseWriter, resp *http.Response, modelName strin
 }
 
 // processStreamDelta processes individual streaming deltas from OpenRouter
-func processStreamDelta(w http.ResponseWriter, flusher http.Flusher, delta map[string]interface{},
-	contentBlockIndex *int, hasStartedTextBlock *bool, isToolUse *bool,
-	currentToolCallID *string, toolCallJSONMap map[string]string) {
-
-	// Handle tool calls
-	if toolCalls, ok := delta["tool_calls"].([]interface{}); ok && len(toolCalls) > 0 {
-		for _, tc := range toolCalls {
-			toolCall := tc.(map[string]interface{})
-			if id, ok := toolCall["id"].(string); ok && id != *currentToolCallID {
-				// Close previous block if exists
-				if *isToolUse || *hasStartedTextBlock {
-					sendSSE(w, flusher, "content_block_stop", map[string]interface{}{
-						"type":  "content_block_stop",
-						"index": *contentBlockIndex,
-					})
-				}
+func processStreamDelta(state *streamState, delta *OpenAIResponseMessage) {
+	// Handle reasoning before any answer content in the same delta
+	if len(delta.ReasoningDetails) > 0 {
+		for _, detail := range delta.ReasoningDetails {
+			processReasoningDetail(state, detail)
+		}
+	} else if reasoning := reasoningText(delta); reasoning != "" {
+		state.startThinkingBlock()
+		state.send("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": state.openBlockIndex,
+			"delta": map[string]interface{}{
+				"type":     "thinking_delta",
+				"thinking": reasoning,
+			},
+		})
+	}
 
-				*isToolUse = true
-				*hasStartedTextBlock = false
-				*currentToolCallID = id
-				*contentBlockIndex++
-				toolCallJSONMap[id] = ""
+	// Some upstreams send text and tool calls in one delta, and the text comes first
+	if delta.Content != "" {
+		if state.openBlockType != contentTypeText {
+			state.openTextOrThinkingBlock(contentTypeText, map[string]interface{}{
+				"type": "text",
+				"text": "",
+			})
+		}
 
-				var name string
-				if function, ok := toolCall["function"].(map[string]interface{}); ok {
-					if n, ok := function["name"].(string); ok {
-						name = n
-					}
-				}
+		state.send("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": state.openBlockIndex,
+			"delta": map[string]interface{}{
+				"type": "text_delta",
+				"text": string(delta.Content),
+			},
+		})
+	}
 
-				sendSSE(w, flusher, "content_block_start", map[string]interface{}{
-					"type":  "content_block_start",
-					"index": *contentBlockIndex,
-					"content_block": map[string]interface{}{
-						"type":  TypeToolUse,
-						"id":    id,
-						"name":  name,
-						"input": map[string]interface{}{},
-					},
-				})
-			}
+	for _, toolCall := range delta.ToolCalls {
+		processToolCallDelta(state, toolCall)
+	}
 
-			if function, ok := toolCall["function"].(map[string]interface{}); ok {
-				if args, ok := function["arguments"].(string); ok && *currentToolCallID != "" {
-					toolCallJSONMap[*currentToolCallID] += args
-					sendSSE(w, flusher, "content_block_delta", map[string]interface{}{
-						"type":  "content_block_delta",
-						"index": *contentBlockIndex,
-						"delta": map[string]interface{}{
-							"type":         "input_json_delta",
-							"partial_json": args,
-						},
-					})
-				}
-			}
+	if len(delta.Annotations) > 0 {
+		processAnnotations(state, delta.Annotations)
+	}
+}
+
+// processToolCallDelta routes a streamed tool call fragment to its content block,
+// opening a new tool_use block the first time a call is seen. Parallel calls may
+// interleave, so each call keeps its own block open until the stream moves on.
+func processToolCallDelta(state *streamState, toolCall OpenAIToolCallPart) {
+	id := toolCall.ID
+	name := state.toolNames.client(toolCall.Function.Name)
+	args := toolCallArguments(toolCall)
+
+	call := state.toolCallsByID[id]
+	if call != nil && toolCall.Index != nil && call.index != nil && *call.index != *toolCall.Index {
+		// Some providers repeat IDs, so the same ID at a new index is a new call
+		call = nil
+	}
+	if call == nil && toolCall.Index != nil {
+		// Some providers reuse an index for distinct calls, so a new ID starts a new call
+		if existing := state.toolCallsByIndex[*toolCall.Index]; existing != nil && (id == "" || id == existing.id) {
+			call = existing
 		}
-	} else if content, ok := delta["content"].(string); ok && content != "" {
-		// Close tool block if transitioning to text
-		if *isToolUse {
-			sendSSE(w, flusher, "content_block_stop", map[string]interface{}{
-				"type":  "content_block_stop",
-				"index": *contentBlockIndex,
-			})
-			*isToolUse = false
-			*currentToolCallID = ""
-			*contentBlockIndex++
+	}
+	if call == nil && toolCall.Index == nil && id == "" {
+		call = state.lastToolCall
+	}
+
+	if call == nil {
+		state.closeTextOrThinkingBlock()
+
+		call = &streamToolCall{id: id, index: toolCall.Index, name: name, open: true}
+		call.strictSchema = state.responseOptions.strictSchema(toolCall.Function.Name)
+		call.blockIndex = state.startBlock(map[string]interface{}{
+			"type":  TypeToolUse,
+			"id":    anthropicToolID(state.messageID, id, state.nextBlockIndex, state.clientToolIDs),
+			"name":  name,
+			"input": map[string]interface{}{},
+		})
+		if toolCall.Index != nil {
+			state.toolCallsByIndex[*toolCall.Index] = call
+		}
+		if id != "" {
+			state.toolCallsByID[id] = call
 		}
+		state.openToolCalls = append(state.openToolCalls, call)
+		state.hasToolUse = true
+	}
+	state.lastToolCall = call
 
-		if !*hasStartedTextBlock {
-			sendSSE(w, flusher, "content_block_start", map[string]interface{}{
-				"type":  "content_block_start",
-				"index": *contentBlockIndex,
-				"content_block": map[string]interface{}{
-					"type": "text",
-					"text": "",
+	if args == "" {
+		return
+	}
+	if !call.open {
+		slog.Warn("dropping arguments for closed tool call", "id", call.id, "name", call.name)
+		return
+	}
+
+	call.arguments += args
+	if call.strictSchema != nil {
+		return
+	}
+	state.sendInputJSON(call.blockIndex, args)
+}
+
+// sendInputJSON sends a fragment of a tool call's input
+func (s *streamState) sendInputJSON(index int, partialJSON string) {
+	s.send("content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]interface{}{
+			"type":         "input_json_delta",
+			"partial_json": partialJSON,
+		},
+	})
+}
+
+// flushStrictArguments sends the held-back input of a strict-mode tool call, without
+// the nulls filled in for optional parameters
+func (s *streamState) flushStrictArguments(call *streamToolCall) {
+	if call.strictSchema == nil || call.arguments == "" {
+		return
+	}
+	var input map[string]interface{}
+	if err := json.Unmarshal([]byte(call.arguments), &input); err != nil {
+		slog.Warn("invalid tool call arguments", "id", call.id, "name", call.name, "error", err)
+		s.sendInputJSON(call.blockIndex, call.arguments)
+		return
+	}
+	stripOptionalNulls(input, call.strictSchema)
+	encoded, _ := json.Marshal(input)
+	s.sendInputJSON(call.blockIndex, string(encoded))
+}
+
+// processReasoningDetail emits thinking, signature or redacted thinking events for a reasoning detail
+func processReasoningDetail(state *streamState, detail ReasoningDetail) {
+	switch detail.Type {
+	case reasoningTypeText, reasoningTypeSummary:
+		text := detail.Text
+		if detail.Type == reasoningTypeSummary {
+			text = detail.Summary
+		}
+		if text != "" {
+			state.startThinkingBlock()
+			state.send("content_block_delta", map[string]interface{}{
+				"type":  "content_block_delta",
+				"index": state.openBlockIndex,
+				"delta": map[string]interface{}{
+					"type":     "thinking_delta",
+					"thinking": text,
 				},
 			})
-			*hasStartedTextBlock = true
 		}
-
-		sendSSE(w, flusher, "content_block_delta", map[string]interface{}{
-			"type":  "content_block_delta",
-			"index": *contentBlockIndex,
-			"delta": map[string]interface{}{
-				"type": "text_delta",
-				"text": content,
-			},
+		if detail.Signature != "" {
+			state.startThinkingBlock()
+			state.send("content_block_delta", map[string]interface{}{
+				"type":  "content_block_delta",
+				"index": state.openBlockIndex,
+				"delta": map[string]interface{}{
+					"type":      "signature_delta",
+					"signature": detail.Signature,
+				},
+			})
+		}
+	case reasoningTypeEncrypted:
+		// Redacted thinking is delivered whole, so it opens and closes its own block
+		state.closeAllBlocks()
+		index := state.startBlock(map[string]interface{}{
+			"type": TypeRedacted,
+			"data": detail.Data,
 		})
+		state.stopBlock(index)
+	}
+}
+
+// startMessage sends message_start once, using any usage the upstream has reported so far
+func (s *streamState) startMessage() {
+	if s.messageStarted {
+		return
+	}
+	s.messageStarted = true
+
+	var usage Usage
+	if s.usage != nil {
+		usage = *s.usage
+		usage.OutputTokens = 0
+	} else {
+		// Kept for message_delta in case the upstream never reports usage
+		s.inputTokens = s.estimateInput()
+		usage.InputTokens = s.inputTokens
+	}
+
+	s.send("message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":            s.messageID,
+			"type":          "message",
+			"role":          "assistant",
+			"content":       []interface{}{},
+			"model":         s.modelName,
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         usage,
+		},
+	})
+}
+
+// startThinkingBlock opens a thinking block unless one is already open
+func (s *streamState) startThinkingBlock() {
+	if s.openBlockType == TypeThinking {
+		return
+	}
+	s.openTextOrThinkingBlock(TypeThinking, map[string]interface{}{
+		"type":     TypeThinking,
+		"thinking": "",
+	})
+}
+
+// openTextOrThinkingBlock closes every open block and opens a new text or thinking block
+func (s *streamState) openTextOrThinkingBlock(blockType string, contentBlock map[string]interface{}) {
+	s.closeAllBlocks()
+	s.openBlockType = blockType
+	s.openBlockIndex = s.startBlock(contentBlock)
+}
+
+// startBlock sends content_block_start at the next free index and returns that index
+func (s *streamState) startBlock(contentBlock map[string]interface{}) int {
+	index := s.nextBlockIndex
+	s.nextBlockIndex++
+	s.send("content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         index,
+		"content_block": contentBlock,
+	})
+	return index
+}
+
+// stopBlock sends content_block_stop for the given index
+func (s *streamState) stopBlock(index int) {
+	s.send("content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": index,
+	})
+}
+
+// closeTextOrThinkingBlock closes the open text or thinking block, if any
+func (s *streamState) closeTextOrThinkingBlock() {
+	if s.openBlockType == "" {
+		return
+	}
+	s.stopBlock(s.openBlockIndex)
+	s.openBlockType = ""
+}
+
+// closeAllBlocks closes the open text or thinking block and every open tool_use block
+func (s *streamState) closeAllBlocks() {
+	s.closeTextOrThinkingBlock()
+	for _, call := range s.openToolCalls {
+		s.flushStrictArguments(call)
+		s.stopBlock(call.blockIndex)
+		call.open = false
 	}
+	s.openToolCalls = nil
+}
+
+// fail reports a stream failure to the client. Before message_start nothing has been
+// written, so a regular error response is sent; afterwards an SSE error event ends the
+// stream without message_stop so the client knows the turn is incomplete.
+func (s *streamState) fail(apiErr *APIError) {
+	slog.Error("upstream stream failed", "error", apiErr)
+	if !s.messageStarted {
+		apiErr.Write(s.w)
+		return
+	}
+	s.send("error", apiErr.body())
+}
+
+// send writes a Server-Sent Event to the client
+func (s *streamState) send(event string, data interface{}) {
+	sendSSE(s.w, s.flusher, event, data)
 }
 
 // sendSSE sends a Server-Sent Event
@@ -3,11 +3,13 @@ package transform
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"athena/internal/config"
 )
@@ -26,6 +28,10 @@ func TestMapModel(t *testing.T) {
 		OpusModel:   "custom/opus",
 		SonnetModel: "custom/sonnet",
 		HaikuModel:  "custom/haiku",
+		ModelAliases: map[string]string{
+			"coder":         "qwen/qwen3-coder",
+			"claude-sonnet": "custom/sonnet-alias",
+		},
 	}
 
 	tests := []struct {
@@ -33,6 +39,16 @@ func TestMapModel(t *testing.T) {
 		input    string
 		expected string
 	}{
+		{
+			name:     "configured alias",
+			input:    "coder",
+			expected: "qwen/qwen3-coder",
+		},
+		{
+			name:     "alias takes precedence over family",
+			input:    "claude-sonnet",
+			expected: "custom/sonnet-alias",
+		},
 		{
 			name:     "opus model",
 			input:    "claude-3-opus",
@@ -85,54 +101,26 @@ func TestMapModel(t *testing.T) {
 	}
 }
 
-func TestRemoveUriFormat(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    string
-		expected string
-	}{
-		{
-			name:     "removes format uri",
-			input:    `{"type":"object","properties":{"url":{"type":"string","format":"uri"}}}`,
-			expected: `{"properties":{"url":{"type":"string"}},"type":"object"}`,
-		},
-		{
-			name:     "nested format uri",
-			input:    `{"type":"object","properties":{"data":{"type":"object","properties":{"link":{"type":"string","format":"uri"}}}}}`,
-			expected: `{"properties":{"data":{"properties":{"link":{"type":"string"}},"type":"object"}},"type":"object"}`,
-		},
-		{
-			name:     "preserves other formats",
-			input:    `{"type":"object","properties":{"date":{"type":"string","format":"date-time"}}}`,
-			expected: `{"properties":{"date":{"format":"date-time","type":"string"}},"type":"object"}`,
-		},
-		{
-			name:     "no format field",
-			input:    `{"type":"object","properties":{"name":{"type":"string"}}}`,
-			expected: `{"properties":{"name":{"type":"string"}},"type":"object"}`,
-		},
+func TestMapModel_AnthropicUpstream(t *testing.T) {
+	cfg := &config.Config{
+		Model:          "default/model",
+		OpusModel:      "claude-opus-4-1",
+		UpstreamFormat: config.UpstreamFormatAnthropic,
+		ModelAliases:   map[string]string{"fast": "claude-haiku-4-5"},
+		ModelUpstreams: map[string]string{"gpt": "openrouter"},
+		Upstreams:      map[string]config.Upstream{"openrouter": {BaseURL: "https://openrouter.ai/api"}},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := removeUriFormat(json.RawMessage(tt.input))
-
-			// Unmarshal both to compare structure
-			var resultMap, expectedMap map[string]interface{}
-			if err := json.Unmarshal(result, &resultMap); err != nil {
-				t.Fatalf("Failed to unmarshal result: %v", err)
-			}
-			if err := json.Unmarshal([]byte(tt.expected), &expectedMap); err != nil {
-				t.Fatalf("Failed to unmarshal expected: %v", err)
-			}
-
-			resultJSON, _ := json.Marshal(resultMap)
-			expectedJSON, _ := json.Marshal(expectedMap)
-
-			if string(resultJSON) != string(expectedJSON) {
-				t.Errorf("removeUriFormat() = %s, expected %s", resultJSON, expectedJSON)
-			}
-		})
+	tests := map[string]string{
+		"claude-sonnet-4-5": "claude-sonnet-4-5",
+		"claude-opus-4":     "claude-opus-4-1",
+		"fast":              "claude-haiku-4-5",
+		"gpt":               "default/model",
+	}
+	for input, expected := range tests {
+		if result := MapModel(input, cfg); result != expected {
+			t.Errorf("MapModel(%q) = %q, expected %q", input, result, expected)
+		}
 	}
 }
 
@@ -226,6 +214,110 @@ func TestAnthropicToOpenAI_WithSystem(t *testing.T) {
 	}
 }
 
+func TestAnthropicToOpenAI_CacheControl(t *testing.T) {
+	req := AnthropicRequest{
+		Model: "claude-sonnet-4",
+		System: json.RawMessage(`[
+			{"type":"text","text":"You are Claude Code."},
+			{"type":"text","text":"Project instructions","cache_control":{"type":"ephemeral"}}
+		]`),
+		Messages: []Message{
+			{
+				Role:    "assistant",
+				Content: json.RawMessage(`[{"type":"tool_use","id":"call_1","name":"read","input":{}}]`),
+			},
+			{
+				Role: "user",
+				Content: json.RawMessage(`[
+					{"type":"tool_result","tool_use_id":"call_1","content":"file contents","cache_control":{"type":"ephemeral"}},
+					{"type":"text","text":"Now summarize","cache_control":{"type":"ephemeral","ttl":"1h"}}
+				]`),
+			},
+		},
+		Tools: []Tool{
+			{
+				Name:         "read",
+				InputSchema:  json.RawMessage(`{"type":"object"}`),
+				CacheControl: &CacheControl{Type: "ephemeral"},
+			},
+		},
+	}
+
+	t.Run("caching-capable upstream keeps breakpoints", func(t *testing.T) {
+		cfg := &config.Config{
+			SonnetModel:        "anthropic/claude-sonnet-4",
+			CacheControlModels: config.DefaultCacheControlModels,
+		}
+		result := AnthropicToOpenAI(req, cfg)
+
+		encoded, _ := json.Marshal(result)
+		if count := strings.Count(string(encoded), `"cache_control"`); count != 4 {
+			t.Errorf("Expected 4 cache_control markers, got %d: %s", count, encoded)
+		}
+
+		system := result.Messages[0].Content.([]map[string]interface{})
+		if len(system) != 2 {
+			t.Fatalf("Expected 2 system parts, got %d", len(system))
+		}
+		if _, ok := system[0]["cache_control"]; ok {
+			t.Error("Unmarked system block should not gain cache_control")
+		}
+		if system[1]["cache_control"] == nil {
+			t.Error("Marked system block should keep cache_control")
+		}
+
+		userParts, ok := result.Messages[3].Content.([]map[string]interface{})
+		if !ok {
+			t.Fatalf("User content = %v, expected parts with cache_control", result.Messages[3].Content)
+		}
+		if cc, _ := userParts[0]["cache_control"].(*CacheControl); cc == nil || cc.TTL != "1h" {
+			t.Errorf("User cache_control = %v, expected ttl 1h", userParts[0]["cache_control"])
+		}
+
+		toolParts, ok := result.Messages[2].Content.([]map[string]interface{})
+		if !ok || toolParts[0]["cache_control"] == nil {
+			t.Errorf("Tool content = %v, expected part with cache_control", result.Messages[2].Content)
+		}
+
+		if result.Tools[0].CacheControl == nil {
+			t.Error("Tool definition should keep cache_control")
+		}
+	})
+
+	t.Run("decided by mapped model", func(t *testing.T) {
+		cfg := &config.Config{
+			SonnetModel:        "moonshotai/kimi-k2-0905",
+			CacheControlModels: config.DefaultCacheControlModels,
+		}
+		result := AnthropicToOpenAI(req, cfg)
+
+		encoded, _ := json.Marshal(result)
+		if strings.Contains(string(encoded), `"cache_control"`) {
+			t.Errorf("Expected no cache_control for non-caching model: %s", encoded)
+		}
+		if result.Messages[3].Content != "Now summarize" {
+			t.Errorf("User content = %v, expected plain string", result.Messages[3].Content)
+		}
+	})
+
+	t.Run("string system prompt gets a breakpoint", func(t *testing.T) {
+		cfg := &config.Config{
+			Model:              "google/gemini-2.5-pro",
+			CacheControlModels: config.DefaultCacheControlModels,
+		}
+		result := AnthropicToOpenAI(AnthropicRequest{
+			Model:    "some-model",
+			System:   json.RawMessage(`"Be concise."`),
+			Messages: []Message{{Role: "user", Content: json.RawMessage(`"Hi"`)}},
+		}, cfg)
+
+		system := result.Messages[0].Content.([]map[string]interface{})
+		if system[0]["cache_control"] == nil {
+			t.Error("String system prompt should be cached for caching-capable models")
+		}
+	})
+}
+
 func TestAnthropicToOpenAI_WithTools(t *testing.T) {
 	cfg := &config.Config{
 		Model:       "test/model",
@@ -272,6 +364,160 @@ func TestAnthropicToOpenAI_WithTools(t *testing.T) {
 	}
 }
 
+func TestAnthropicToOpenAI_ToolChoice(t *testing.T) {
+	cfg := &config.Config{Model: "test/model"}
+
+	tests := []struct {
+		name             string
+		toolChoice       *ToolChoice
+		expectedChoice   string
+		expectedParallel *bool
+	}{
+		{
+			name:           "no tool choice",
+			toolChoice:     nil,
+			expectedChoice: "null",
+		},
+		{
+			name:           "auto",
+			toolChoice:     &ToolChoice{Type: "auto"},
+			expectedChoice: `"auto"`,
+		},
+		{
+			name:           "any maps to required",
+			toolChoice:     &ToolChoice{Type: "any"},
+			expectedChoice: `"required"`,
+		},
+		{
+			name:           "none",
+			toolChoice:     &ToolChoice{Type: "none"},
+			expectedChoice: `"none"`,
+		},
+		{
+			name:           "specific tool",
+			toolChoice:     &ToolChoice{Type: "tool", Name: testToolName},
+			expectedChoice: `{"function":{"name":"search"},"type":"function"}`,
+		},
+		{
+			name:             "disable parallel tool use",
+			toolChoice:       &ToolChoice{Type: "auto", DisableParallelToolUse: true},
+			expectedChoice:   `"auto"`,
+			expectedParallel: new(bool),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := AnthropicRequest{
+				Model:      "test-model",
+				ToolChoice: tt.toolChoice,
+				Messages: []Message{
+					{Role: "user", Content: json.RawMessage(`"Search for cats"`)},
+				},
+				Tools: []Tool{
+					{Name: testToolName, InputSchema: json.RawMessage(`{"type":"object"}`)},
+				},
+			}
+
+			result := AnthropicToOpenAI(req, cfg)
+
+			choiceJSON, _ := json.Marshal(result.ToolChoice)
+			if string(choiceJSON) != tt.expectedChoice {
+				t.Errorf("ToolChoice = %s, expected %s", choiceJSON, tt.expectedChoice)
+			}
+
+			if tt.expectedParallel == nil {
+				if result.ParallelToolCalls != nil {
+					t.Errorf("ParallelToolCalls = %v, expected nil", *result.ParallelToolCalls)
+				}
+			} else if result.ParallelToolCalls == nil || *result.ParallelToolCalls != *tt.expectedParallel {
+				t.Errorf("ParallelToolCalls = %v, expected %v", result.ParallelToolCalls, *tt.expectedParallel)
+			}
+		})
+	}
+
+	// tool_choice is dropped when no tools are declared
+	req := AnthropicRequest{
+		Model:      "test-model",
+		ToolChoice: &ToolChoice{Type: "any"},
+		Messages: []Message{
+			{Role: "user", Content: json.RawMessage(`"Hello"`)},
+		},
+	}
+	if result := AnthropicToOpenAI(req, cfg); result.ToolChoice != nil {
+		t.Errorf("ToolChoice = %v, expected nil without tools", result.ToolChoice)
+	}
+}
+
+func TestAnthropicToOpenAI_SamplingParameters(t *testing.T) {
+	topP := 0.9
+	topK := 40
+
+	req := AnthropicRequest{
+		Model:         "test-model",
+		MaxTokens:     1024,
+		TopP:          &topP,
+		TopK:          &topK,
+		StopSequences: []string{"###", "END"},
+		Metadata:      &Metadata{UserID: "user_42"},
+		Messages: []Message{
+			{Role: "user", Content: json.RawMessage(`"Hello"`)},
+		},
+	}
+
+	result := AnthropicToOpenAI(req, &config.Config{Model: "test/model"})
+
+	if result.MaxTokens != 1024 {
+		t.Errorf("MaxTokens = %d, expected %d", result.MaxTokens, 1024)
+	}
+	if result.MaxCompletionTokens != 0 {
+		t.Errorf("MaxCompletionTokens = %d, expected 0", result.MaxCompletionTokens)
+	}
+	if result.TopP == nil || *result.TopP != topP {
+		t.Errorf("TopP = %v, expected %v", result.TopP, topP)
+	}
+	if result.TopK == nil || *result.TopK != topK {
+		t.Errorf("TopK = %v, expected %v", result.TopK, topK)
+	}
+	if len(result.Stop) != 2 || result.Stop[0] != "###" || result.Stop[1] != "END" {
+		t.Errorf("Stop = %v, expected [### END]", result.Stop)
+	}
+	if result.User != "user_42" {
+		t.Errorf("User = %q, expected %q", result.User, "user_42")
+	}
+
+	// OpenAI reasoning models take max_completion_tokens instead
+	result = AnthropicToOpenAI(req, &config.Config{Model: "openai/o3-mini"})
+	if result.MaxCompletionTokens != 1024 || result.MaxTokens != 0 {
+		t.Errorf("MaxCompletionTokens = %d, MaxTokens = %d, expected 1024 and 0",
+			result.MaxCompletionTokens, result.MaxTokens)
+	}
+}
+
+func TestUsesMaxCompletionTokens(t *testing.T) {
+	tests := []struct {
+		model    string
+		expected bool
+	}{
+		{"openai/o1", true},
+		{"openai/o3-mini", true},
+		{"openai/o4-mini-high", true},
+		{"openai/gpt-5", true},
+		{"o3", true},
+		{"openai/gpt-4o", false},
+		{"moonshotai/kimi-k2-0905", false},
+		{"deepseek/o1-lookalike", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if got := usesMaxCompletionTokens(tt.model); got != tt.expected {
+				t.Errorf("usesMaxCompletionTokens(%q) = %v, expected %v", tt.model, got, tt.expected)
+			}
+		})
+	}
+}
+
 func TestAnthropicToOpenAI_ToolCall(t *testing.T) {
 	cfg := &config.Config{Model: "test/model"}
 
@@ -418,6 +664,143 @@ func TestValidateToolCalls(t *testing.T) {
 	}
 }
 
+func TestRepairToolCalls(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []OpenAIMessage
+		expected []OpenAIMessage
+	}{
+		{
+			name: "valid tool call with response",
+			messages: []OpenAIMessage{
+				{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function"}}},
+				{Role: "tool", ToolCallID: "call_1", Content: "result"},
+			},
+			expected: []OpenAIMessage{
+				{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function"}}},
+				{Role: "tool", ToolCallID: "call_1", Content: "result"},
+			},
+		},
+		{
+			name: "interrupted tool call gets a placeholder result",
+			messages: []OpenAIMessage{
+				{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function"}}},
+				{Role: "user", Content: "stop, do something else"},
+			},
+			expected: []OpenAIMessage{
+				{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function"}}},
+				{Role: "tool", ToolCallID: "call_1", Content: interruptedToolResult},
+				{Role: "user", Content: "stop, do something else"},
+			},
+		},
+		{
+			name: "partial results keep call order",
+			messages: []OpenAIMessage{
+				{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1"}, {ID: "call_2"}, {ID: "call_3"}}},
+				{Role: "tool", ToolCallID: "call_2", Content: "result2"},
+			},
+			expected: []OpenAIMessage{
+				{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1"}, {ID: "call_2"}, {ID: "call_3"}}},
+				{Role: "tool", ToolCallID: "call_2", Content: "result2"},
+				{Role: "tool", ToolCallID: "call_1", Content: interruptedToolResult},
+				{Role: "tool", ToolCallID: "call_3", Content: interruptedToolResult},
+			},
+		},
+		{
+			name: "orphaned result becomes user text after the tool results",
+			messages: []OpenAIMessage{
+				{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1"}}},
+				{Role: "tool", ToolCallID: "call_missing", Content: "stale"},
+				{Role: "tool", ToolCallID: "call_1", Content: "result"},
+			},
+			expected: []OpenAIMessage{
+				{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1"}}},
+				{Role: "tool", ToolCallID: "call_1", Content: "result"},
+				{Role: "user", Content: "Result of tool call call_missing:\nstale"},
+			},
+		},
+		{
+			name: "orphaned result with parts keeps its parts",
+			messages: []OpenAIMessage{
+				{Role: "user", Content: "hello"},
+				{Role: "tool", ToolCallID: "call_missing", Content: []map[string]interface{}{textPart("cached", &CacheControl{Type: "ephemeral"})}},
+			},
+			expected: []OpenAIMessage{
+				{Role: "user", Content: "hello"},
+				{Role: "user", Content: []map[string]interface{}{
+					textPart("Result of tool call call_missing:", nil),
+					textPart("cached", &CacheControl{Type: "ephemeral"}),
+				}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := repairToolCalls(tt.messages, "req_test")
+
+			resultJSON, _ := json.Marshal(result)
+			expectedJSON, _ := json.Marshal(tt.expected)
+			if string(resultJSON) != string(expectedJSON) {
+				t.Errorf("repairToolCalls() = %s, expected %s", resultJSON, expectedJSON)
+			}
+		})
+	}
+}
+
+func TestAnthropicToOpenAI_MergesAdjacentUserMessages(t *testing.T) {
+	image := `{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw0KGgo="}}`
+	req := AnthropicRequest{
+		Model: "claude-3-5-sonnet",
+		Messages: []Message{
+			{Role: "user", Content: json.RawMessage(`"Take screenshots"`)},
+			{Role: "assistant", Content: json.RawMessage(`[
+				{"type":"tool_use","id":"call_1","name":"screenshot","input":{}},
+				{"type":"tool_use","id":"call_2","name":"screenshot","input":{}}
+			]`)},
+			{Role: "user", Content: json.RawMessage(`[
+				{"type":"tool_result","tool_use_id":"call_1","content":[` + image + `]},
+				{"type":"tool_result","tool_use_id":"call_2","content":[` + image + `]},
+				{"type":"text","text":"Compare them"}
+			]`)},
+		},
+	}
+
+	result := AnthropicToOpenAI(req, &config.Config{Model: "moonshotai/kimi-k2-0905"})
+	roles := []string{}
+	for _, msg := range result.Messages {
+		roles = append(roles, msg.Role)
+	}
+	if strings.Join(roles, ",") != "user,assistant,tool,tool,user" {
+		t.Fatalf("Roles = %v, expected both tool results followed by a single user message", roles)
+	}
+	parts, ok := result.Messages[4].Content.([]map[string]interface{})
+	if !ok || len(parts) != 5 || parts[4]["text"] != "Compare them" {
+		t.Errorf("User content = %+v, expected both images and the text", result.Messages[4].Content)
+	}
+}
+
+func TestAnthropicToOpenAI_ToolCallRepair(t *testing.T) {
+	req := AnthropicRequest{
+		Model: "claude-3-5-sonnet",
+		Messages: []Message{
+			{Role: "user", Content: json.RawMessage(`"Run the tests"`)},
+			{Role: "assistant", Content: json.RawMessage(`[{"type":"tool_use","id":"call_1","name":"bash","input":{"command":"go test"}}]`)},
+			{Role: "user", Content: json.RawMessage(`"[Request interrupted by user]"`)},
+		},
+	}
+
+	repaired := AnthropicToOpenAI(req, &config.Config{ToolCallRepair: config.ToolCallRepairRepair})
+	if len(repaired.Messages) != 4 || repaired.Messages[2].Role != "tool" || repaired.Messages[2].Content != interruptedToolResult {
+		t.Errorf("Repair mode messages = %+v, expected a placeholder tool result", repaired.Messages)
+	}
+
+	dropped := AnthropicToOpenAI(req, &config.Config{ToolCallRepair: config.ToolCallRepairDrop})
+	if len(dropped.Messages) != 1 || dropped.Messages[0].Content != "Run the tests\n\n[Request interrupted by user]" {
+		t.Errorf("Drop mode messages = %+v, expected the dangling call removed and the user turns merged", dropped.Messages)
+	}
+}
+
 func TestOpenAIToAnthropic(t *testing.T) {
 	resp := map[string]interface{}{
 		"choices": []interface{}{
@@ -430,7 +813,10 @@ func TestOpenAIToAnthropic(t *testing.T) {
 		},
 	}
 
-	result := OpenAIToAnthropic(resp, "test/model")
+	result, err := OpenAIToAnthropic(parseOpenAIResponse(t, resp), "test/model", ResponseOptions{})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error: %v", err)
+	}
 
 	if result["type"] != "message" {
 		t.Errorf("Response type = %v, expected %q", result["type"], "message")
@@ -488,7 +874,10 @@ func TestOpenAIToAnthropic_WithToolCalls(t *testing.T) {
 		},
 	}
 
-	result := OpenAIToAnthropic(resp, "test/model")
+	result, err := OpenAIToAnthropic(parseOpenAIResponse(t, resp), "test/model", ResponseOptions{})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error: %v", err)
+	}
 
 	if result["stop_reason"] != "tool_use" {
 		t.Errorf("Response stop_reason = %v, expected %q", result["stop_reason"], "tool_use")
@@ -513,8 +902,8 @@ func TestOpenAIToAnthropic_WithToolCalls(t *testing.T) {
 		t.Errorf("Second content type = %v, expected %q", content[1]["type"], "tool_use")
 	}
 
-	if content[1]["id"] != "call_abc" {
-		t.Errorf("Tool use ID = %v, expected %q", content[1]["id"], "call_abc")
+	if id, _ := content[1]["id"].(string); !strings.HasPrefix(id, "toolu_") {
+		t.Errorf("Tool use ID = %v, expected a toolu_ ID", content[1]["id"])
 	}
 
 	if content[1]["name"] != testToolName {
@@ -531,146 +920,752 @@ func TestOpenAIToAnthropic_WithToolCalls(t *testing.T) {
 	}
 }
 
-func TestTransformMessage_AssistantWithText(t *testing.T) {
-	msg := Message{
-		Role:    "assistant",
-		Content: json.RawMessage(`[{"type":"text","text":"Hello there"}]`),
-	}
-
-	result := transformMessage(msg)
-
-	if len(result) != 1 {
-		t.Fatalf("Expected 1 message, got %d", len(result))
-	}
-
-	if result[0].Role != "assistant" {
-		t.Errorf("Role = %q, expected %q", result[0].Role, "assistant")
-	}
-
-	content, ok := result[0].Content.(string)
-	if !ok {
-		t.Fatalf("Content is not a string")
+func TestMapStopReason(t *testing.T) {
+	tests := []struct {
+		name         string
+		finishReason string
+		stopSequence string
+		hasToolUse   bool
+		expected     string
+	}{
+		{"stop", "stop", "", false, "end_turn"},
+		{"stop with stop sequence", "stop", "###", false, "stop_sequence"},
+		{"length", "length", "", false, "max_tokens"},
+		{"content filter", "content_filter", "", false, "refusal"},
+		{"tool calls", "tool_calls", "", true, "tool_use"},
+		{"legacy function call", "function_call", "", true, "tool_use"},
+		{"stop after tool calls", "stop", "", true, "tool_use"},
+		{"length after tool calls", "length", "", true, "max_tokens"},
+		{"missing finish reason", "", "", false, "end_turn"},
 	}
 
-	if content != "Hello there" {
-		t.Errorf("Content = %q, expected %q", content, "Hello there")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mapStopReason(tt.finishReason, tt.stopSequence, tt.hasToolUse); got != tt.expected {
+				t.Errorf("mapStopReason(%q, %q, %v) = %q, expected %q",
+					tt.finishReason, tt.stopSequence, tt.hasToolUse, got, tt.expected)
+			}
+		})
 	}
 }
 
-func TestTransformMessage_UserWithToolResult(t *testing.T) {
-	msg := Message{
-		Role: "user",
-		Content: json.RawMessage(`[
-			{"type":"text","text":"Here's the result:"},
-			{"type":"tool_result","tool_use_id":"` + testToolCallID + `","content":"Result data"}
-		]`),
-	}
-
-	result := transformMessage(msg)
-
-	if len(result) != 2 {
-		t.Fatalf("Expected 2 messages (user + tool), got %d", len(result))
-	}
-
-	// Check user message
-	if result[0].Role != "user" {
-		t.Errorf("First message role = %q, expected %q", result[0].Role, "user")
-	}
-
-	// Check tool message
-	if result[1].Role != "tool" {
-		t.Errorf("Second message role = %q, expected %q", result[1].Role, "tool")
+func TestOpenAIToAnthropic_Usage(t *testing.T) {
+	resp := map[string]interface{}{
+		"choices": []interface{}{
+			map[string]interface{}{
+				"message": map[string]interface{}{
+					"content": "Hi",
+				},
+				"finish_reason": "stop",
+			},
+		},
+		"usage": map[string]interface{}{
+			"prompt_tokens":     1200,
+			"completion_tokens": 35,
+			"prompt_tokens_details": map[string]interface{}{
+				"cached_tokens":      1000,
+				"cache_write_tokens": 50,
+			},
+		},
 	}
 
-	if result[1].ToolCallID != testToolCallID {
-		t.Errorf("Tool call ID = %q, expected %q", result[1].ToolCallID, testToolCallID)
+	result, err := OpenAIToAnthropic(parseOpenAIResponse(t, resp), "test/model", ResponseOptions{})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error: %v", err)
 	}
 
-	content, ok := result[1].Content.(string)
+	usage, ok := result["usage"].(Usage)
 	if !ok {
-		t.Fatalf("Tool message content is not a string")
+		t.Fatalf("Response usage is not a Usage, got %T", result["usage"])
 	}
 
-	if content != "Result data" {
-		t.Errorf("Tool content = %q, expected %q", content, "Result data")
+	expected := Usage{
+		InputTokens:              150,
+		OutputTokens:             35,
+		CacheReadInputTokens:     1000,
+		CacheCreationInputTokens: 50,
+	}
+	if usage != expected {
+		t.Errorf("Usage = %+v, expected %+v", usage, expected)
 	}
 }
 
-func TestRemoveUriFormatFromInterface(t *testing.T) {
+func TestConvertUsage(t *testing.T) {
 	tests := []struct {
 		name     string
-		input    interface{}
-		expected interface{}
+		input    OpenAIUsage
+		expected Usage
 	}{
 		{
-			name: "removes format uri from map",
-			input: map[string]interface{}{
-				"format": "uri",
-				"type":   "string",
-			},
-			expected: map[string]interface{}{
-				"type": "string",
-			},
+			name:     "no cache details",
+			input:    OpenAIUsage{PromptTokens: 100, CompletionTokens: 20},
+			expected: Usage{InputTokens: 100, OutputTokens: 20},
 		},
 		{
-			name: "preserves other formats",
-			input: map[string]interface{}{
-				"format": "date-time",
-				"type":   "string",
-			},
-			expected: map[string]interface{}{
-				"format": "date-time",
-				"type":   "string",
+			name: "openai cached tokens",
+			input: OpenAIUsage{
+				PromptTokens:        100,
+				CompletionTokens:    20,
+				PromptTokensDetails: &PromptTokensDetails{CachedTokens: 60},
 			},
+			expected: Usage{InputTokens: 40, OutputTokens: 20, CacheReadInputTokens: 60},
 		},
 		{
-			name: "handles nested maps",
-			input: map[string]interface{}{
-				"properties": map[string]interface{}{
-					"url": map[string]interface{}{
-						"format": "uri",
-						"type":   "string",
-					},
-				},
-			},
-			expected: map[string]interface{}{
-				"properties": map[string]interface{}{
-					"url": map[string]interface{}{
-						"type": "string",
-					},
-				},
-			},
+			name:     "deepseek cache hits",
+			input:    OpenAIUsage{PromptTokens: 100, CompletionTokens: 20, PromptCacheHitTokens: 80},
+			expected: Usage{InputTokens: 20, OutputTokens: 20, CacheReadInputTokens: 80},
 		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := convertUsage(tt.input); got != tt.expected {
+				t.Errorf("convertUsage() = %+v, expected %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenAIToAnthropic_StopSequence(t *testing.T) {
+	resp := map[string]interface{}{
+		"choices": []interface{}{
+			map[string]interface{}{
+				"message": map[string]interface{}{
+					"content": "Partial answer",
+				},
+				"finish_reason": "stop",
+				"stop_reason":   "###",
+			},
+		},
+	}
+
+	result, err := OpenAIToAnthropic(parseOpenAIResponse(t, resp), "test/model", ResponseOptions{})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error: %v", err)
+	}
+
+	if result["stop_reason"] != "stop_sequence" {
+		t.Errorf("Response stop_reason = %v, expected %q", result["stop_reason"], "stop_sequence")
+	}
+	if result["stop_sequence"] != "###" {
+		t.Errorf("Response stop_sequence = %v, expected %q", result["stop_sequence"], "###")
+	}
+}
+
+func TestOpenAIToAnthropic_WithReasoning(t *testing.T) {
+	tests := []struct {
+		name          string
+		message       map[string]interface{}
+		expectedTypes []string
+		expectedText  string
+		expectedSig   string
+	}{
 		{
-			name: "handles arrays",
-			input: []interface{}{
-				map[string]interface{}{
-					"format": "uri",
-					"type":   "string",
+			name: "reasoning details with signature",
+			message: map[string]interface{}{
+				"content":   "The answer is 4",
+				"reasoning": "2 plus 2 is 4",
+				"reasoning_details": []interface{}{
+					map[string]interface{}{
+						"type":      "reasoning.text",
+						"text":      "2 plus 2 is 4",
+						"signature": "sig_abc",
+					},
 				},
 			},
-			expected: []interface{}{
-				map[string]interface{}{
-					"type": "string",
+			expectedTypes: []string{"thinking", "text"},
+			expectedText:  "2 plus 2 is 4",
+			expectedSig:   "sig_abc",
+		},
+		{
+			name: "plain reasoning string",
+			message: map[string]interface{}{
+				"content":   "The answer is 4",
+				"reasoning": "Adding numbers",
+			},
+			expectedTypes: []string{"thinking", "text"},
+			expectedText:  "Adding numbers",
+		},
+		{
+			name: "deepseek reasoning_content",
+			message: map[string]interface{}{
+				"content":           "The answer is 4",
+				"reasoning_content": "Thinking it over",
+			},
+			expectedTypes: []string{"thinking", "text"},
+			expectedText:  "Thinking it over",
+		},
+		{
+			name: "encrypted reasoning",
+			message: map[string]interface{}{
+				"content": "The answer is 4",
+				"reasoning_details": []interface{}{
+					map[string]interface{}{
+						"type": "reasoning.encrypted",
+						"data": "opaque",
+					},
 				},
 			},
+			expectedTypes: []string{"redacted_thinking", "text"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := map[string]interface{}{
+				"choices": []interface{}{
+					map[string]interface{}{
+						"message":       tt.message,
+						"finish_reason": "stop",
+					},
+				},
+			}
+
+			result, err := OpenAIToAnthropic(parseOpenAIResponse(t, resp), "test/model", ResponseOptions{})
+			if err != nil {
+				t.Fatalf("OpenAIToAnthropic() error: %v", err)
+			}
+			content := result["content"].([]map[string]interface{})
+
+			if len(content) != len(tt.expectedTypes) {
+				t.Fatalf("Expected %d content blocks, got %d", len(tt.expectedTypes), len(content))
+			}
+			for i, expected := range tt.expectedTypes {
+				if content[i]["type"] != expected {
+					t.Errorf("Content[%d] type = %v, expected %q", i, content[i]["type"], expected)
+				}
+			}
+
+			if tt.expectedTypes[0] != "thinking" {
+				return
+			}
+			if content[0]["thinking"] != tt.expectedText {
+				t.Errorf("Thinking = %v, expected %q", content[0]["thinking"], tt.expectedText)
+			}
+			if content[0]["signature"] != tt.expectedSig {
+				t.Errorf("Signature = %v, expected %q", content[0]["signature"], tt.expectedSig)
+			}
+		})
+	}
+}
+
+func TestAnthropicToOpenAI_Thinking(t *testing.T) {
+	cfg := &config.Config{Model: "test/model"}
+
+	req := AnthropicRequest{
+		Model: "test-model",
+		Thinking: &ThinkingConfig{
+			Type:         "enabled",
+			BudgetTokens: 2048,
+		},
+		Messages: []Message{
+			{
+				Role:    "user",
+				Content: json.RawMessage(`"What is 2+2?"`),
+			},
+			{
+				Role: "assistant",
+				Content: json.RawMessage(`[
+					{"type":"thinking","thinking":"Simple arithmetic","signature":"sig_1"},
+					{"type":"redacted_thinking","data":"opaque"},
+					{"type":"text","text":"4"}
+				]`),
+			},
+			{
+				Role:    "user",
+				Content: json.RawMessage(`"And 3+3?"`),
+			},
+		},
+	}
+
+	result := AnthropicToOpenAI(req, cfg)
+
+	if result.Reasoning == nil {
+		t.Fatal("Expected Reasoning to be set")
+	}
+	if result.Reasoning.MaxTokens != 2048 {
+		t.Errorf("Reasoning.MaxTokens = %d, expected %d", result.Reasoning.MaxTokens, 2048)
+	}
+
+	assistantMsg := result.Messages[1]
+	if assistantMsg.Content != "4" {
+		t.Errorf("Assistant content = %v, expected %q", assistantMsg.Content, "4")
+	}
+	if assistantMsg.Reasoning != "Simple arithmetic" {
+		t.Errorf("Assistant reasoning = %q, expected %q", assistantMsg.Reasoning, "Simple arithmetic")
+	}
+	if len(assistantMsg.ReasoningDetails) != 2 {
+		t.Fatalf("Expected 2 reasoning details, got %d", len(assistantMsg.ReasoningDetails))
+	}
+	if assistantMsg.ReasoningDetails[0].Signature != "sig_1" {
+		t.Errorf("Reasoning signature = %q, expected %q", assistantMsg.ReasoningDetails[0].Signature, "sig_1")
+	}
+	if assistantMsg.ReasoningDetails[1].Type != "reasoning.encrypted" || assistantMsg.ReasoningDetails[1].Data != "opaque" {
+		t.Errorf("Second reasoning detail = %+v, expected encrypted", assistantMsg.ReasoningDetails[1])
+	}
+
+	// Without thinking config no reasoning parameter is sent
+	req.Thinking = nil
+	if result := AnthropicToOpenAI(req, cfg); result.Reasoning != nil {
+		t.Errorf("Expected Reasoning to be nil, got %+v", result.Reasoning)
+	}
+
+	// Upstreams without OpenRouter's extensions get no reasoning fields on past turns
+	disabled := false
+	cfg.OpenRouterExtensions = &disabled
+	assistantMsg = AnthropicToOpenAI(req, cfg).Messages[1]
+	if assistantMsg.Reasoning != "" || assistantMsg.ReasoningDetails != nil || assistantMsg.Content != "4" {
+		t.Errorf("Assistant message = %+v, expected text without reasoning", assistantMsg)
+	}
+}
+
+func TestOpenAIToAnthropic_MalformedResponses(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		expectError bool
+		stopReason  string
+	}{
+		{
+			name:        "error body with 200 status",
+			body:        `{"error":{"message":"Provider returned error","code":502}}`,
+			expectError: true,
+		},
+		{
+			name:        "choice without message",
+			body:        `{"choices":[{"index":0,"finish_reason":"stop"}]}`,
+			expectError: true,
+		},
+		{
+			name:       "null finish reason",
+			body:       `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"finish_reason":null}]}`,
+			stopReason: "end_turn",
+		},
+		{
+			name:       "null content with tool calls",
+			body:       `{"choices":[{"message":{"content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"ls","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+			stopReason: "tool_use",
+		},
+		{
+			name:       "object arguments and array content",
+			body:       `{"choices":[{"message":{"content":[{"type":"text","text":"Hi"}],"tool_calls":[{"id":"call_1","function":{"name":"ls","arguments":{"dir":"/"}}}]},"finish_reason":"tool_calls"}]}`,
+			stopReason: "tool_use",
+		},
+		{
+			name:       "invalid tool arguments",
+			body:       `{"choices":[{"message":{"tool_calls":[{"id":"call_1","function":{"name":"ls","arguments":"{not json"}}]},"finish_reason":"tool_calls"}]}`,
+			stopReason: "tool_use",
+		},
+		{
+			name:       "no choices",
+			body:       `{"choices":[]}`,
+			stopReason: "end_turn",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp OpenAIResponse
+			if err := json.Unmarshal([]byte(tt.body), &resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+
+			result, err := OpenAIToAnthropic(resp, "test/model", ResponseOptions{})
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got result %v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result["stop_reason"] != tt.stopReason {
+				t.Errorf("stop_reason = %v, expected %q", result["stop_reason"], tt.stopReason)
+			}
+		})
+	}
+}
+
+// parseOpenAIResponse converts a loosely built response fixture into the typed response struct
+func parseOpenAIResponse(t *testing.T, resp map[string]interface{}) OpenAIResponse {
+	t.Helper()
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Failed to marshal response fixture: %v", err)
+	}
+	var parsed OpenAIResponse
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatalf("Failed to decode response fixture: %v", err)
+	}
+	return parsed
+}
+
+func TestTransformMessage_AssistantWithText(t *testing.T) {
+	msg := Message{
+		Role:    "assistant",
+		Content: json.RawMessage(`[{"type":"text","text":"Hello there"}]`),
+	}
+
+	result := transformMessage(msg, messageOptions{})
+
+	if len(result) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(result))
+	}
+
+	if result[0].Role != "assistant" {
+		t.Errorf("Role = %q, expected %q", result[0].Role, "assistant")
+	}
+
+	content, ok := result[0].Content.(string)
+	if !ok {
+		t.Fatalf("Content is not a string")
+	}
+
+	if content != "Hello there" {
+		t.Errorf("Content = %q, expected %q", content, "Hello there")
+	}
+}
+
+func TestTransformMessage_AssistantBlockOrder(t *testing.T) {
+	msg := Message{
+		Role: "assistant",
+		Content: json.RawMessage(`[
+			{"type":"text","text":"Reading a.go"},
+			{"type":"tool_use","id":"call_a","name":"read","input":{"path":"a.go"}},
+			{"type":"text","text":"and b.go"},
+			{"type":"tool_use","id":"call_b","name":"read","input":{"path":"b.go"}}
+		]`),
+	}
+
+	result := transformMessage(msg, messageOptions{})
+
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 assistant messages, got %d: %+v", len(result), result)
+	}
+	for i, expected := range []struct{ text, callID string }{{"Reading a.go", "call_a"}, {"and b.go", "call_b"}} {
+		if result[i].Content != expected.text {
+			t.Errorf("Message %d content = %v, expected %q", i, result[i].Content, expected.text)
+		}
+		if len(result[i].ToolCalls) != 1 || result[i].ToolCalls[0].ID != expected.callID {
+			t.Errorf("Message %d tool calls = %+v, expected %s", i, result[i].ToolCalls, expected.callID)
+		}
+	}
+}
+
+func TestTransformMessage_UserBlockOrder(t *testing.T) {
+	msg := Message{
+		Role: "user",
+		Content: json.RawMessage(`[
+			{"type":"tool_result","tool_use_id":"call_a","content":"A"},
+			{"type":"text","text":"Also consider"},
+			{"type":"tool_result","tool_use_id":"call_b","content":"B"},
+			{"type":"text","text":"Then continue"}
+		]`),
+	}
+
+	result := transformMessage(msg, messageOptions{})
+
+	expected := []struct{ role, content string }{
+		{"tool", "A"},
+		{"user", "Also consider"},
+		{"tool", "B"},
+		{"user", "Then continue"},
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %d messages, got %d: %+v", len(expected), len(result), result)
+	}
+	for i, e := range expected {
+		if result[i].Role != e.role || result[i].Content != e.content {
+			t.Errorf("Message %d = %s %v, expected %s %q", i, result[i].Role, result[i].Content, e.role, e.content)
+		}
+	}
+}
+
+func TestAnthropicToOpenAI_ToolResultsFollowCalls(t *testing.T) {
+	req := AnthropicRequest{
+		Model: "claude-3-5-sonnet",
+		System: json.RawMessage(`[
+			{"type":"text","text":"You are Claude Code."},
+			{"type":"text","text":"Project instructions"}
+		]`),
+		Messages: []Message{
+			{Role: "user", Content: json.RawMessage(`"Read both files"`)},
+			{Role: "assistant", Content: json.RawMessage(`[
+				{"type":"tool_use","id":"call_a","name":"read","input":{"path":"a.go"}},
+				{"type":"text","text":"and b.go"},
+				{"type":"tool_use","id":"call_b","name":"read","input":{"path":"b.go"}}
+			]`)},
+			{Role: "user", Content: json.RawMessage(`[
+				{"type":"text","text":"Here you go"},
+				{"type":"tool_result","tool_use_id":"call_a","content":"A"},
+				{"type":"tool_result","tool_use_id":"call_b","content":"B"}
+			]`)},
+		},
+	}
+
+	result := AnthropicToOpenAI(req, &config.Config{})
+
+	var roles []string
+	for _, msg := range result.Messages {
+		roles = append(roles, msg.Role)
+	}
+	if got := strings.Join(roles, ","); got != "system,user,assistant,tool,assistant,tool,user" {
+		t.Fatalf("Roles = %s, expected each tool result directly after its call", got)
+	}
+
+	system, ok := result.Messages[0].Content.([]map[string]interface{})
+	if !ok || len(system) != 2 || system[1]["text"] != "Project instructions" {
+		t.Errorf("System content = %v, expected both blocks as parts of one message", result.Messages[0].Content)
+	}
+	if result.Messages[3].ToolCallID != "call_a" || result.Messages[5].ToolCallID != "call_b" {
+		t.Errorf("Tool results = %s, %s, expected call_a, call_b", result.Messages[3].ToolCallID, result.Messages[5].ToolCallID)
+	}
+	if result.Messages[6].Content != "Here you go" {
+		t.Errorf("Final user content = %v, expected %q", result.Messages[6].Content, "Here you go")
+	}
+}
+
+func TestTransformMessage_UserWithToolResult(t *testing.T) {
+	msg := Message{
+		Role: "user",
+		Content: json.RawMessage(`[
+			{"type":"text","text":"Here's the result:"},
+			{"type":"tool_result","tool_use_id":"` + testToolCallID + `","content":"Result data"}
+		]`),
+	}
+
+	result := transformMessage(msg, messageOptions{})
+
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 messages (user + tool), got %d", len(result))
+	}
+
+	// Check user message
+	if result[0].Role != "user" {
+		t.Errorf("First message role = %q, expected %q", result[0].Role, "user")
+	}
+
+	// Check tool message
+	if result[1].Role != "tool" {
+		t.Errorf("Second message role = %q, expected %q", result[1].Role, "tool")
+	}
+
+	if result[1].ToolCallID != testToolCallID {
+		t.Errorf("Tool call ID = %q, expected %q", result[1].ToolCallID, testToolCallID)
+	}
+
+	content, ok := result[1].Content.(string)
+	if !ok {
+		t.Fatalf("Tool message content is not a string")
+	}
+
+	if content != "Result data" {
+		t.Errorf("Tool content = %q, expected %q", content, "Result data")
+	}
+}
+
+func TestTransformMessage_UserWithImages(t *testing.T) {
+	msg := Message{
+		Role: "user",
+		Content: json.RawMessage(`[
+			{"type":"text","text":"What is in these images?"},
+			{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw0KGgo="}},
+			{"type":"image","source":{"type":"url","url":"https://example.com/cat.jpg"}}
+		]`),
+	}
+
+	result := transformMessage(msg, messageOptions{})
+
+	if len(result) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(result))
+	}
+
+	parts, ok := result[0].Content.([]map[string]interface{})
+	if !ok {
+		t.Fatalf("Content is not an array of parts")
+	}
+
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 content parts, got %d", len(parts))
+	}
+
+	if parts[0]["type"] != testContentType || parts[0]["text"] != "What is in these images?" {
+		t.Errorf("First part = %v, expected text part", parts[0])
+	}
+
+	expectedURLs := []string{
+		"data:image/png;base64,iVBORw0KGgo=",
+		"https://example.com/cat.jpg",
+	}
+	for i, expected := range expectedURLs {
+		part := parts[i+1]
+		if part["type"] != "image_url" {
+			t.Errorf("Part %d type = %v, expected %q", i+1, part["type"], "image_url")
+			continue
+		}
+		imageURL := part["image_url"].(map[string]interface{})
+		if imageURL["url"] != expected {
+			t.Errorf("Part %d url = %v, expected %q", i+1, imageURL["url"], expected)
+		}
+	}
+}
+
+func TestTransformMessage_ToolResultWithImage(t *testing.T) {
+	msg := Message{
+		Role: "user",
+		Content: json.RawMessage(`[
+			{"type":"tool_result","tool_use_id":"` + testToolCallID + `","content":[
+				{"type":"text","text":"Screenshot taken"},
+				{"type":"image","source":{"type":"base64","media_type":"image/jpeg","data":"/9j/4AAQ"}}
+			]}
+		]`),
+	}
+
+	result := transformMessage(msg, messageOptions{})
+
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 messages (tool + user image), got %d", len(result))
+	}
+
+	if result[0].Role != "tool" {
+		t.Errorf("First message role = %q, expected %q", result[0].Role, "tool")
+	}
+
+	if result[0].Content != "Screenshot taken" {
+		t.Errorf("Tool content = %v, expected %q", result[0].Content, "Screenshot taken")
+	}
+
+	if result[1].Role != "user" {
+		t.Errorf("Second message role = %q, expected %q", result[1].Role, "user")
+	}
+
+	parts, ok := result[1].Content.([]map[string]interface{})
+	if !ok || len(parts) != 2 {
+		t.Fatalf("Expected label and image parts, got %v", result[1].Content)
+	}
+
+	if parts[0]["text"] != "Images returned by tool call "+testToolCallID+":" {
+		t.Errorf("Label part = %v, expected tool call reference", parts[0]["text"])
+	}
+
+	imageURL := parts[1]["image_url"].(map[string]interface{})
+	if imageURL["url"] != "data:image/jpeg;base64,/9j/4AAQ" {
+		t.Errorf("Image url = %v, expected data URL", imageURL["url"])
+	}
+}
+
+func TestTransformMessage_ToolResultImagesInToolMessage(t *testing.T) {
+	msg := Message{
+		Role: "user",
+		Content: json.RawMessage(`[
+			{"type":"tool_result","tool_use_id":"` + testToolCallID + `","content":[
+				{"type":"text","text":"Screenshot taken"},
+				{"type":"image","source":{"type":"url","url":"https://example.com/shot.png"}}
+			]}
+		]`),
+	}
+
+	result := transformMessage(msg, messageOptions{imagesInToolResults: true})
+
+	if len(result) != 1 {
+		t.Fatalf("Expected only the tool message, got %d messages", len(result))
+	}
+
+	parts, ok := result[0].Content.([]map[string]interface{})
+	if !ok || len(parts) != 2 {
+		t.Fatalf("Expected text and image parts in tool message, got %v", result[0].Content)
+	}
+	if parts[0]["text"] != "Screenshot taken" || parts[1]["type"] != "image_url" {
+		t.Errorf("Tool message parts = %v, expected text then image_url", parts)
+	}
+}
+
+func TestAnthropicToOpenAI_ToolResultImageModels(t *testing.T) {
+	cfg := &config.Config{
+		Model:                 "google/gemini-2.5-pro",
+		ToolResultImageModels: []string{"gemini"},
+	}
+
+	req := AnthropicRequest{
+		Model: "test-model",
+		Messages: []Message{
+			{
+				Role:    "assistant",
+				Content: json.RawMessage(`[{"type":"tool_use","id":"call_1","name":"screenshot","input":{}}]`),
+			},
+			{
+				Role: "user",
+				Content: json.RawMessage(`[{"type":"tool_result","tool_use_id":"call_1","content":[
+					{"type":"image","source":{"type":"url","url":"https://example.com/shot.png"}}
+				]}]`),
+			},
+		},
+	}
+
+	result := AnthropicToOpenAI(req, cfg)
+	if len(result.Messages) != 2 {
+		t.Fatalf("Expected assistant and tool messages only, got %d", len(result.Messages))
+	}
+	if _, ok := result.Messages[1].Content.([]map[string]interface{}); !ok {
+		t.Errorf("Tool message content = %v, expected image parts", result.Messages[1].Content)
+	}
+
+	cfg.Model = "moonshotai/kimi-k2-0905"
+	result = AnthropicToOpenAI(req, cfg)
+	if len(result.Messages) != 3 || result.Messages[2].Role != "user" {
+		t.Errorf("Expected follow-up user image message for non-matching model, got %d messages", len(result.Messages))
+	}
+}
+
+func TestTransformMessage_ToolResultContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		block    string
+		expected string
+	}{
+		{
+			name:     "string content",
+			block:    `{"type":"tool_result","tool_use_id":"call_1","content":"plain output"}`,
+			expected: "plain output",
+		},
+		{
+			name:     "multiple text parts are joined",
+			block:    `{"type":"tool_result","tool_use_id":"call_1","content":[{"type":"text","text":"line one"},{"type":"text","text":"line two"}]}`,
+			expected: "line one\nline two",
+		},
+		{
+			name:     "error result",
+			block:    `{"type":"tool_result","tool_use_id":"call_1","is_error":true,"content":"file not found"}`,
+			expected: "Error: file not found",
+		},
+		{
+			name:     "error result without content",
+			block:    `{"type":"tool_result","tool_use_id":"call_1","is_error":true}`,
+			expected: "Error: tool execution failed",
 		},
 		{
-			name:     "preserves primitives",
-			input:    "plain string",
-			expected: "plain string",
+			name:     "missing content",
+			block:    `{"type":"tool_result","tool_use_id":"call_1"}`,
+			expected: "",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := removeUriFormatFromInterface(tt.input)
+			msg := Message{
+				Role:    "user",
+				Content: json.RawMessage(`[` + tt.block + `]`),
+			}
 
-			resultJSON, _ := json.Marshal(result)
-			expectedJSON, _ := json.Marshal(tt.expected)
+			result := transformMessage(msg, messageOptions{})
 
-			if string(resultJSON) != string(expectedJSON) {
-				t.Errorf("removeUriFormatFromInterface() = %s, expected %s", resultJSON, expectedJSON)
+			if len(result) != 1 {
+				t.Fatalf("Expected 1 tool message, got %d", len(result))
+			}
+			if result[0].Content != tt.expected {
+				t.Errorf("Tool content = %q, expected %q", result[0].Content, tt.expected)
 			}
 		})
 	}
@@ -704,6 +1699,14 @@ func TestHandleNonStreaming(t *testing.T) {
 			responseBody:   map[string]interface{}{"error": "Server error"},
 			expectedStatus: 500,
 		},
+		{
+			name:       "error body with 200 status",
+			statusCode: 200,
+			responseBody: map[string]interface{}{
+				"error": map[string]interface{}{"message": "Provider returned error", "code": 502},
+			},
+			expectedStatus: 502,
+		},
 	}
 
 	for _, tt := range tests {
@@ -725,7 +1728,7 @@ func TestHandleNonStreaming(t *testing.T) {
 			}
 
 			w := httptest.NewRecorder()
-			HandleNonStreaming(w, resp, "test/model")
+			HandleNonStreaming(w, resp, "test/model", ResponseOptions{})
 
 			result := w.Result()
 			defer result.Body.Close()
@@ -754,7 +1757,7 @@ data: [DONE]
 	}
 
 	w := httptest.NewRecorder()
-	HandleStreaming(w, resp, "test/model")
+	HandleStreaming(w, resp, "test/model", ResponseOptions{})
 
 	result := w.Result()
 	defer result.Body.Close()
@@ -796,7 +1799,7 @@ func TestHandleStreaming_Error(t *testing.T) {
 	}
 
 	w := httptest.NewRecorder()
-	HandleStreaming(w, resp, "test/model")
+	HandleStreaming(w, resp, "test/model", ResponseOptions{})
 
 	result := w.Result()
 	defer result.Body.Close()
@@ -806,6 +1809,98 @@ func TestHandleStreaming_Error(t *testing.T) {
 	}
 }
 
+func TestHandleStreaming_MidStreamError(t *testing.T) {
+	partial := `data: {"choices":[{"index":0,"delta":{"content":"Partial"},"finish_reason":null}]}` + "\n\n"
+
+	tests := []struct {
+		name          string
+		body          io.Reader
+		opts          ResponseOptions
+		expectedType  string
+		expectedInErr string
+	}{
+		{
+			name:          "error chunk",
+			body:          strings.NewReader(partial + `data: {"error":{"message":"Provider overloaded","code":503}}` + "\n\n"),
+			expectedType:  "overloaded_error",
+			expectedInErr: "Provider overloaded",
+		},
+		{
+			name:          "read error",
+			body:          io.MultiReader(strings.NewReader(partial), iotest.ErrReader(errors.New("connection reset"))),
+			expectedType:  "api_error",
+			expectedInErr: "connection reset",
+		},
+		{
+			name:          "truncated stream",
+			body:          strings.NewReader(partial),
+			expectedType:  "api_error",
+			expectedInErr: "ended unexpectedly",
+		},
+		{
+			name:          "line over the configured cap",
+			body:          strings.NewReader(partial + `data: {"choices":[{"index":0,"delta":{"content":"` + strings.Repeat("x", 200) + `"}}]}` + "\n\n"),
+			opts:          ResponseOptions{MaxSSELineSize: 150},
+			expectedType:  "api_error",
+			expectedInErr: "line too long",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(tt.body),
+				Header:     make(http.Header),
+			}
+
+			w := httptest.NewRecorder()
+			HandleStreaming(w, resp, "test/model", tt.opts)
+
+			body, _ := io.ReadAll(w.Result().Body)
+			bodyStr := string(body)
+
+			if !strings.Contains(bodyStr, `"delta":{"text":"Partial","type":"text_delta"}`) {
+				t.Errorf("Expected partial text before the error, got:\n%s", bodyStr)
+			}
+			if !strings.Contains(bodyStr, "event: error\n") {
+				t.Fatalf("Expected error event, got:\n%s", bodyStr)
+			}
+			if !strings.Contains(bodyStr, `"type":"`+tt.expectedType+`"`) || !strings.Contains(bodyStr, tt.expectedInErr) {
+				t.Errorf("Expected %s containing %q, got:\n%s", tt.expectedType, tt.expectedInErr, bodyStr)
+			}
+			if strings.Contains(bodyStr, "message_stop") || strings.Contains(bodyStr, "message_delta") {
+				t.Errorf("Expected no message_delta or message_stop after an error, got:\n%s", bodyStr)
+			}
+		})
+	}
+}
+
+func TestHandleStreaming_ErrorBeforeContent(t *testing.T) {
+	streamData := `data: {"error":{"message":"Rate limited","code":429}}` + "\n\n"
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(streamData)),
+		Header:     make(http.Header),
+	}
+
+	w := httptest.NewRecorder()
+	HandleStreaming(w, resp, "test/model", ResponseOptions{})
+
+	result := w.Result()
+	defer result.Body.Close()
+
+	if result.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Status code = %d, expected %d", result.StatusCode, http.StatusTooManyRequests)
+	}
+
+	body, _ := io.ReadAll(result.Body)
+	if strings.Contains(string(body), "message_start") || !strings.Contains(string(body), `"type":"rate_limit_error"`) {
+		t.Errorf("Expected a plain rate_limit_error response, got:\n%s", body)
+	}
+}
+
 func TestHandleStreaming_WithToolCalls(t *testing.T) {
 	// Create a mock streaming response with tool calls
 	streamData := `data: {"choices":[{"index":0,"delta":{"tool_calls":[{"id":"` + testToolCallID + `","type":"function","function":{"name":"` + testToolName + `"}}]},"finish_reason":null}]}
@@ -827,7 +1922,7 @@ data: [DONE]
 	}
 
 	w := httptest.NewRecorder()
-	HandleStreaming(w, resp, "test/model")
+	HandleStreaming(w, resp, "test/model", ResponseOptions{})
 
 	result := w.Result()
 	defer result.Body.Close()
@@ -870,7 +1965,7 @@ data: [DONE]
 	}
 
 	w := httptest.NewRecorder()
-	HandleStreaming(w, resp, "test/model")
+	HandleStreaming(w, resp, "test/model", ResponseOptions{})
 
 	result := w.Result()
 	defer result.Body.Close()
@@ -894,6 +1989,325 @@ data: [DONE]
 	}
 }
 
+func TestHandleStreaming_TextAndToolInOneDelta(t *testing.T) {
+	streamData := `data: {"choices":[{"index":0,"delta":{"content":"Let me check.","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]},"finish_reason":null}]}
+
+data: {"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}
+
+data: [DONE]
+
+`
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(streamData)),
+		Header:     make(http.Header),
+	}
+
+	w := httptest.NewRecorder()
+	HandleStreaming(w, resp, "test/model", ResponseOptions{})
+
+	body := w.Body.String()
+	textAt := strings.Index(body, `"text":"Let me check."`)
+	toolAt := strings.Index(body, `"type":"tool_use"`)
+	if textAt < 0 || toolAt < 0 || textAt > toolAt {
+		t.Errorf("Stream = %s, expected the text before the tool call", body)
+	}
+}
+
+func TestHandleStreaming_ParallelToolCalls(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []string
+		expected []string // reassembled input JSON per tool_use block, in order
+	}{
+		{
+			name: "openai sequential parallel calls",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"function":{"arguments":"{\"city\":\"Rome\"}"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+			},
+			expected: []string{`{"city":"Paris"}`, `{"city":"Rome"}`},
+		},
+		{
+			name: "interleaved argument chunks",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"read","arguments":""}},{"index":1,"id":"call_b","type":"function","function":{"name":"read","arguments":""}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"function":{"arguments":"{\"path\":"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"path\":"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"a.go\"}"}},{"index":1,"function":{"arguments":"\"b.go\"}"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+			},
+			expected: []string{`{"path":"a.go"}`, `{"path":"b.go"}`},
+		},
+		{
+			name: "complete calls without index",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"id":"call_a","type":"function","function":{"name":"ls","arguments":"{\"dir\":\"/\"}"}},{"id":"call_b","type":"function","function":{"name":"ls","arguments":"{\"dir\":\"/tmp\"}"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+			},
+			expected: []string{`{"dir":"/"}`, `{"dir":"/tmp"}`},
+		},
+		{
+			name: "distinct calls reusing index zero",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"ls","arguments":"{\"dir\":"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"/\"}"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_b","type":"function","function":{"name":"ls","arguments":"{\"dir\":"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"/tmp\"}"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+			},
+			expected: []string{`{"dir":"/"}`, `{"dir":"/tmp"}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamData := ""
+			for _, chunk := range tt.chunks {
+				streamData += "data: " + chunk + "\n\n"
+			}
+			streamData += "data: [DONE]\n\n"
+
+			resp := &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(streamData)),
+				Header:     make(http.Header),
+			}
+
+			w := httptest.NewRecorder()
+			HandleStreaming(w, resp, "test/model", ResponseOptions{})
+
+			body, _ := io.ReadAll(w.Result().Body)
+			inputs := collectToolInputs(t, string(body))
+
+			if len(inputs) != len(tt.expected) {
+				t.Fatalf("Expected %d tool_use blocks, got %d: %v", len(tt.expected), len(inputs), inputs)
+			}
+			for i, expected := range tt.expected {
+				if inputs[i] != expected {
+					t.Errorf("Tool %d input = %s, expected %s", i, inputs[i], expected)
+				}
+			}
+
+			if !strings.Contains(string(body), `"stop_reason":"tool_use"`) {
+				t.Error("Response should have tool_use stop reason")
+			}
+		})
+	}
+}
+
+// collectToolInputs reassembles tool_use inputs from an Anthropic SSE stream in block order,
+// checking that every delta targets a block that is started and not yet stopped and that
+// tool_use IDs are unique and Anthropic-style
+func collectToolInputs(t *testing.T, body string) []string {
+	t.Helper()
+
+	idsByIndex := map[int]string{}
+	open := map[int]bool{}
+	toolBlocks := map[int]int{}
+	inputs := []string{}
+
+	for _, line := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event struct {
+			Type         string `json:"type"`
+			Index        int    `json:"index"`
+			ContentBlock struct {
+				Type string `json:"type"`
+				ID   string `json:"id"`
+			} `json:"content_block"`
+			Delta struct {
+				Type        string `json:"type"`
+				PartialJSON string `json:"partial_json"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+			t.Fatalf("Invalid event JSON %q: %v", line, err)
+		}
+
+		switch event.Type {
+		case "content_block_start":
+			if _, exists := idsByIndex[event.Index]; exists {
+				t.Errorf("Block index %d started twice", event.Index)
+			}
+			idsByIndex[event.Index] = event.ContentBlock.ID
+			open[event.Index] = true
+			if event.ContentBlock.Type == "tool_use" {
+				if !strings.HasPrefix(event.ContentBlock.ID, "toolu_") {
+					t.Errorf("Tool use ID %q should start with toolu_", event.ContentBlock.ID)
+				}
+				for index, id := range idsByIndex {
+					if index != event.Index && id == event.ContentBlock.ID {
+						t.Errorf("Tool use ID %q reused by block %d", id, event.Index)
+					}
+				}
+				toolBlocks[event.Index] = len(inputs)
+				inputs = append(inputs, "")
+			}
+		case "content_block_delta":
+			if !open[event.Index] {
+				t.Errorf("Delta for block %d which is not open", event.Index)
+			}
+			if event.Delta.Type == "input_json_delta" {
+				inputs[toolBlocks[event.Index]] += event.Delta.PartialJSON
+			}
+		case "content_block_stop":
+			if !open[event.Index] {
+				t.Errorf("Stop for block %d which is not open", event.Index)
+			}
+			open[event.Index] = false
+		}
+	}
+
+	for index, isOpen := range open {
+		if isOpen {
+			t.Errorf("Block %d was never stopped", index)
+		}
+	}
+	return inputs
+}
+
+func TestHandleStreaming_FinishReason(t *testing.T) {
+	tests := []struct {
+		name         string
+		finishChunk  string
+		expectedStop string
+	}{
+		{
+			name:         "length maps to max_tokens",
+			finishChunk:  `{"choices":[{"index":0,"delta":{},"finish_reason":"length"}]}`,
+			expectedStop: `"stop_reason":"max_tokens"`,
+		},
+		{
+			name:         "content filter maps to refusal",
+			finishChunk:  `{"choices":[{"index":0,"delta":{},"finish_reason":"content_filter"}]}`,
+			expectedStop: `"stop_reason":"refusal"`,
+		},
+		{
+			name:         "matched stop sequence",
+			finishChunk:  `{"choices":[{"index":0,"delta":{},"finish_reason":"stop","stop_reason":"###"}]}`,
+			expectedStop: `"stop_reason":"stop_sequence","stop_sequence":"###"`,
+		},
+		{
+			name:         "stop maps to end_turn",
+			finishChunk:  `{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			expectedStop: `"stop_reason":"end_turn"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamData := "data: " + `{"choices":[{"index":0,"delta":{"content":"Partial"},"finish_reason":null}]}` +
+				"\n\ndata: " + tt.finishChunk + "\n\ndata: [DONE]\n\n"
+
+			resp := &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(streamData)),
+				Header:     make(http.Header),
+			}
+
+			w := httptest.NewRecorder()
+			HandleStreaming(w, resp, "test/model", ResponseOptions{})
+
+			body, _ := io.ReadAll(w.Result().Body)
+			if !strings.Contains(string(body), tt.expectedStop) {
+				t.Errorf("Expected %s in stream:\n%s", tt.expectedStop, body)
+			}
+		})
+	}
+}
+
+func TestHandleStreaming_Usage(t *testing.T) {
+	streamData := `data: {"choices":[{"index":0,"delta":{"content":"Hello"},"finish_reason":null}]}
+
+data: {"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}
+
+data: {"choices":[],"usage":{"prompt_tokens":500,"completion_tokens":12,"prompt_tokens_details":{"cached_tokens":400}}}
+
+data: [DONE]
+
+`
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(streamData)),
+		Header:     make(http.Header),
+	}
+
+	w := httptest.NewRecorder()
+	HandleStreaming(w, resp, "test/model", ResponseOptions{})
+
+	body, _ := io.ReadAll(w.Result().Body)
+	bodyStr := string(body)
+
+	if strings.Count(bodyStr, "event: message_start") != 1 {
+		t.Errorf("Expected exactly one message_start event:\n%s", bodyStr)
+	}
+
+	expectedUsage := `"usage":{"input_tokens":100,"output_tokens":12,"cache_creation_input_tokens":0,"cache_read_input_tokens":400}`
+	deltaIdx := strings.Index(bodyStr, "event: message_delta")
+	if deltaIdx < 0 || !strings.Contains(bodyStr[deltaIdx:], expectedUsage) {
+		t.Errorf("message_delta should contain %s:\n%s", expectedUsage, bodyStr)
+	}
+
+	if strings.Contains(bodyStr, `"output_tokens":150`) {
+		t.Error("Response should not contain placeholder usage")
+	}
+}
+
+func TestHandleStreaming_WithReasoning(t *testing.T) {
+	streamData := `data: {"choices":[{"index":0,"delta":{"reasoning":"Let me","reasoning_details":[{"type":"reasoning.text","text":"Let me"}]},"finish_reason":null}]}
+
+data: {"choices":[{"index":0,"delta":{"reasoning":" think","reasoning_details":[{"type":"reasoning.text","text":" think"}]},"finish_reason":null}]}
+
+data: {"choices":[{"index":0,"delta":{"reasoning_details":[{"type":"reasoning.text","signature":"sig_xyz"}]},"finish_reason":null}]}
+
+data: {"choices":[{"index":0,"delta":{"content":"Done"},"finish_reason":null}]}
+
+data: [DONE]
+
+`
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(streamData)),
+		Header:     make(http.Header),
+	}
+
+	w := httptest.NewRecorder()
+	HandleStreaming(w, resp, "test/model", ResponseOptions{})
+
+	body, _ := io.ReadAll(w.Result().Body)
+	bodyStr := string(body)
+
+	expectedInOrder := []string{
+		`"content_block":{"thinking":"","type":"thinking"},"index":0`,
+		`"delta":{"thinking":"Let me","type":"thinking_delta"},"index":0`,
+		`"delta":{"thinking":" think","type":"thinking_delta"},"index":0`,
+		`"delta":{"signature":"sig_xyz","type":"signature_delta"},"index":0`,
+		`{"index":0,"type":"content_block_stop"}`,
+		`"content_block":{"text":"","type":"text"},"index":1`,
+		`"delta":{"text":"Done","type":"text_delta"},"index":1`,
+		`{"index":1,"type":"content_block_stop"}`,
+	}
+
+	pos := 0
+	for _, expected := range expectedInOrder {
+		idx := strings.Index(bodyStr[pos:], expected)
+		if idx < 0 {
+			t.Fatalf("Expected %s after position %d in stream:\n%s", expected, pos, bodyStr)
+		}
+		pos += idx + len(expected)
+	}
+}
+
 func TestAnthropicToOpenAI_ProviderRouting(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -1070,3 +2484,97 @@ func TestGetProviderForModel(t *testing.T) {
 		})
 	}
 }
+
+func TestGetUpstreamForModel(t *testing.T) {
+	cfg := &config.Config{
+		Model:           "moonshotai/kimi-k2-0905",
+		OpusModel:       "claude-opus-4-1",
+		HaikuModel:      "qwen3:8b",
+		DefaultUpstream: "openrouter",
+		OpusUpstream:    "anthropic",
+		SonnetUpstream:  "vllm",
+		HaikuUpstream:   "ollama",
+		ModelUpstreams:  map[string]string{"internal": "vllm", "claude-3-opus-fast": "openrouter"},
+	}
+
+	tests := []struct {
+		model    string
+		expected string
+	}{
+		{model: "claude-opus-4-1", expected: "anthropic"},
+		{model: "claude-3-5-haiku", expected: "ollama"},
+		{model: "claude-sonnet-4", expected: "vllm"}, // Routed by family even without a sonnet model
+		{model: "internal", expected: "vllm"},
+		{model: "claude-3-opus-fast", expected: "openrouter"}, // Exact entry beats the family
+		{model: "openai/gpt-4o", expected: "openrouter"},
+	}
+	for _, tt := range tests {
+		if got := GetUpstreamForModel(tt.model, cfg); got != tt.expected {
+			t.Errorf("GetUpstreamForModel(%q) = %q, expected %q", tt.model, got, tt.expected)
+		}
+	}
+
+	if got := GetUpstreamForModel("claude-opus-4-1", &config.Config{}); got != "" {
+		t.Errorf("Without upstreams = %q, expected the top-level base_url", got)
+	}
+}
+
+func TestAliasedModelIgnoresFamilySettings(t *testing.T) {
+	cfg := &config.Config{
+		Model:           "moonshotai/kimi-k2-0905",
+		SonnetModel:     "anthropic/claude-sonnet-4",
+		ModelAliases:    map[string]string{"claude-sonnet-fast": "openai/gpt-4o-mini"},
+		DefaultProvider: &config.ProviderConfig{Order: []string{"openai"}},
+		SonnetProvider:  &config.ProviderConfig{Order: []string{"fireworks"}},
+		DefaultUpstream: "openrouter",
+		SonnetUpstream:  "anthropic",
+	}
+
+	if got := MapModel("claude-sonnet-fast", cfg); got != "openai/gpt-4o-mini" {
+		t.Errorf("MapModel() = %q, expected the alias target", got)
+	}
+	if provider := GetProviderForModel("claude-sonnet-fast", cfg); provider == nil || provider.Order[0] != "openai" {
+		t.Errorf("GetProviderForModel() = %+v, expected the default provider", provider)
+	}
+	if got := GetUpstreamForModel("claude-sonnet-fast", cfg); got != "openrouter" {
+		t.Errorf("GetUpstreamForModel() = %q, expected the default upstream", got)
+	}
+
+	// An alias with its own model_upstreams entry still uses it
+	cfg.ModelUpstreams = map[string]string{"claude-sonnet-fast": "vllm"}
+	if got := GetUpstreamForModel("claude-sonnet-fast", cfg); got != "vllm" {
+		t.Errorf("GetUpstreamForModel() = %q, expected the alias's model_upstreams entry", got)
+	}
+}
+
+func TestAnthropicToOpenAI_OpenRouterExtensions(t *testing.T) {
+	topK := 40
+	cfg := &config.Config{
+		Model:           "moonshotai/kimi-k2-0905",
+		HaikuModel:      "qwen3:8b",
+		DefaultProvider: &config.ProviderConfig{Order: []string{"fireworks"}},
+		HaikuUpstream:   "ollama",
+		Upstreams: map[string]config.Upstream{
+			"ollama": {BaseURL: "http://localhost:11434"},
+		},
+	}
+	req := AnthropicRequest{
+		Messages:  []Message{{Role: "user", Content: json.RawMessage(`"Hi"`)}},
+		MaxTokens: 100,
+		TopK:      &topK,
+		Thinking:  &ThinkingConfig{Type: "enabled", BudgetTokens: 1024},
+		Tools:     []Tool{{Type: "web_search_20250305", Name: "web_search"}},
+	}
+
+	req.Model = "claude-sonnet-4"
+	result := AnthropicToOpenAI(req, cfg)
+	if result.Usage == nil || result.Provider == nil || result.Reasoning == nil || result.TopK == nil || len(result.Plugins) != 1 {
+		t.Errorf("Top-level upstream request = %+v, expected OpenRouter extensions", result)
+	}
+
+	req.Model = "claude-3-5-haiku"
+	result = AnthropicToOpenAI(req, cfg)
+	if result.Usage != nil || result.Provider != nil || result.Reasoning != nil || result.TopK != nil || len(result.Plugins) != 0 {
+		t.Errorf("Ollama upstream request = %+v, expected no OpenRouter extensions", result)
+	}
+}
@@ -11,17 +11,52 @@ const (
 	RoleAssistant = "assistant"
 	RoleTool      = "tool"
 	TypeToolUse   = "tool_use"
+	TypeThinking  = "thinking"
+	TypeRedacted  = "redacted_thinking"
 )
 
-// AnthropicRequest represents the Anthropic Messages API request format
+// OpenRouter reasoning detail types
+const (
+	reasoningTypeText      = "reasoning.text"
+	reasoningTypeEncrypted = "reasoning.encrypted"
+	reasoningTypeSummary   = "reasoning.summary"
+)
+
+// AnthropicRequest represents the Anthropic Messages API request format. RequestID is
+// set by the server for log correlation and is not part of the wire format.
 type AnthropicRequest struct {
-	Model       string          `json:"model"`
-	Messages    []Message       `json:"messages"`
-	System      json.RawMessage `json:"system,omitempty"`
-	Temperature *float64        `json:"temperature,omitempty"`
-	MaxTokens   int             `json:"max_tokens,omitempty"`
-	Stream      bool            `json:"stream,omitempty"`
-	Tools       []Tool          `json:"tools,omitempty"`
+	Model         string          `json:"model"`
+	Messages      []Message       `json:"messages"`
+	System        json.RawMessage `json:"system,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	TopP          *float64        `json:"top_p,omitempty"`
+	TopK          *int            `json:"top_k,omitempty"`
+	MaxTokens     int             `json:"max_tokens,omitempty"`
+	StopSequences []string        `json:"stop_sequences,omitempty"`
+	Stream        bool            `json:"stream,omitempty"`
+	Tools         []Tool          `json:"tools,omitempty"`
+	Thinking      *ThinkingConfig `json:"thinking,omitempty"`
+	ToolChoice    *ToolChoice     `json:"tool_choice,omitempty"`
+	Metadata      *Metadata       `json:"metadata,omitempty"`
+	RequestID     string          `json:"-"`
+}
+
+// Metadata represents the Anthropic request metadata
+type Metadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+// ToolChoice represents how the model should use the provided tools
+type ToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// ThinkingConfig represents the Anthropic extended thinking configuration
+type ThinkingConfig struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
 }
 
 // Message represents a message in the conversation
@@ -30,29 +65,264 @@ type Message struct {
 	Content json.RawMessage `json:"content"`
 }
 
-// Tool represents a tool definition
+// Tool represents a tool definition. Server tools such as web_search_20250305 and client
+// tools such as bash_20250124 set Type and their own options instead of an input schema.
 type Tool struct {
-	Name        string          `json:"name"`
-	Description string          `json:"description,omitempty"`
-	InputSchema json.RawMessage `json:"input_schema"`
+	Type           string          `json:"type,omitempty"`
+	Name           string          `json:"name"`
+	Description    string          `json:"description,omitempty"`
+	InputSchema    json.RawMessage `json:"input_schema,omitempty"`
+	CacheControl   *CacheControl   `json:"cache_control,omitempty"`
+	AllowedDomains []string        `json:"allowed_domains,omitempty"`
+	BlockedDomains []string        `json:"blocked_domains,omitempty"`
+	MaxUses        int             `json:"max_uses,omitempty"`
+	DisplayWidth   int             `json:"display_width_px,omitempty"`
+	DisplayHeight  int             `json:"display_height_px,omitempty"`
+	DisplayNumber  *int            `json:"display_number,omitempty"`
+	MaxCharacters  int             `json:"max_characters,omitempty"`
+}
+
+// CacheControl represents an Anthropic prompt caching breakpoint
+type CacheControl struct {
+	Type string `json:"type"`
+	TTL  string `json:"ttl,omitempty"`
 }
 
 // OpenAIRequest represents the OpenAI/OpenRouter chat completions request format
 type OpenAIRequest struct {
-	Model       string                 `json:"model"`
-	Messages    []OpenAIMessage        `json:"messages"`
-	Temperature *float64               `json:"temperature,omitempty"`
-	Stream      bool                   `json:"stream,omitempty"`
-	Tools       []OpenAITool           `json:"tools,omitempty"`
-	Provider    *config.ProviderConfig `json:"provider,omitempty"`
+	Model               string                     `json:"model"`
+	Messages            []OpenAIMessage            `json:"messages"`
+	Temperature         *float64                   `json:"temperature,omitempty"`
+	TopP                *float64                   `json:"top_p,omitempty"`
+	TopK                *int                       `json:"top_k,omitempty"`
+	MaxTokens           int                        `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int                        `json:"max_completion_tokens,omitempty"`
+	Stop                []string                   `json:"stop,omitempty"`
+	User                string                     `json:"user,omitempty"`
+	Stream              bool                       `json:"stream,omitempty"`
+	Tools               []OpenAITool               `json:"tools,omitempty"`
+	Provider            *config.ProviderConfig     `json:"provider,omitempty"`
+	Reasoning           *ReasoningConfig           `json:"reasoning,omitempty"`
+	ToolChoice          interface{}                `json:"tool_choice,omitempty"`
+	ParallelToolCalls   *bool                      `json:"parallel_tool_calls,omitempty"`
+	StreamOptions       *StreamOptions             `json:"stream_options,omitempty"`
+	Usage               *UsageConfig               `json:"usage,omitempty"`
+	Plugins             []Plugin                   `json:"plugins,omitempty"`
+	ToolNames           ToolNameMap                `json:"-"`
+	StrictToolSchemas   map[string]json.RawMessage `json:"-"`
+	WebSearchDomains    *DomainFilter              `json:"-"`
+}
+
+// ResponseOptions carries the request details needed to translate a response.
+// EstimateInputTokens returns a local estimate of the input tokens, and is only called
+// when the upstream gives no usage. StrictToolSchemas holds the original schemas of
+// tools sent in strict mode, by upstream name, so nulls filled in for their optional
+// parameters can be removed. WebSearchDomains drops citations outside the web search
+// tool's domain filters. MaxSSELineSize caps a streamed line, with 0 meaning
+// DefaultMaxSSELineSize.
+type ResponseOptions struct {
+	ToolNames           ToolNameMap
+	EstimateInputTokens func() int
+	StrictToolSchemas   map[string]json.RawMessage
+	WebSearchDomains    *DomainFilter
+	MaxSSELineSize      int
+}
+
+// strictSchema returns the original schema of a tool sent in strict mode, by upstream name
+func (o ResponseOptions) strictSchema(name string) map[string]interface{} {
+	raw, ok := o.StrictToolSchemas[name]
+	if !ok {
+		return nil
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil
+	}
+	return schema
+}
+
+// stripOptionalNulls removes the nulls a strict-mode tool call filled in for optional parameters
+func (o ResponseOptions) stripOptionalNulls(name string, input map[string]interface{}) {
+	if schema := o.strictSchema(name); schema != nil {
+		stripOptionalNulls(input, schema)
+	}
+}
+
+// estimateInputTokens returns the local input token estimate, or 0 without an estimator
+func (o ResponseOptions) estimateInputTokens() int {
+	if o.EstimateInputTokens == nil {
+		return 0
+	}
+	return o.EstimateInputTokens()
+}
+
+// Plugin represents an OpenRouter plugin, such as the web search plugin
+type Plugin struct {
+	ID           string `json:"id"`
+	MaxResults   int    `json:"max_results,omitempty"`
+	SearchPrompt string `json:"search_prompt,omitempty"`
+}
+
+// StreamOptions represents the OpenAI stream_options request parameter
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// UsageConfig represents the OpenRouter usage accounting request parameter
+type UsageConfig struct {
+	Include bool `json:"include"`
+}
+
+// OpenAIResponse represents an OpenAI chat completion response. Streaming chunks
+// share the same shape, with Delta set on each choice instead of Message.
+type OpenAIResponse struct {
+	ID      string         `json:"id,omitempty"`
+	Model   string         `json:"model,omitempty"`
+	Choices []OpenAIChoice `json:"choices"`
+	Usage   *OpenAIUsage   `json:"usage,omitempty"`
+	Error   *OpenAIError   `json:"error,omitempty"`
+}
+
+// OpenAIChoice represents a single completion choice or stream chunk choice.
+// vLLM-compatible servers set stop_reason to the matched stop string or token ID.
+type OpenAIChoice struct {
+	Index        int                    `json:"index"`
+	Message      *OpenAIResponseMessage `json:"message,omitempty"`
+	Delta        *OpenAIResponseMessage `json:"delta,omitempty"`
+	FinishReason string                 `json:"finish_reason"`
+	StopReason   json.RawMessage        `json:"stop_reason,omitempty"`
+}
+
+// OpenAIResponseMessage represents an assistant message or stream delta
+type OpenAIResponseMessage struct {
+	Role             string               `json:"role,omitempty"`
+	Content          ResponseContent      `json:"content"`
+	ToolCalls        []OpenAIToolCallPart `json:"tool_calls,omitempty"`
+	Reasoning        string               `json:"reasoning,omitempty"`
+	ReasoningContent string               `json:"reasoning_content,omitempty"`
+	ReasoningDetails []ReasoningDetail    `json:"reasoning_details,omitempty"`
+	Annotations      []Annotation         `json:"annotations,omitempty"`
+}
+
+// Annotation represents a response annotation, such as a web search URL citation
+type Annotation struct {
+	Type        string       `json:"type"`
+	URLCitation *URLCitation `json:"url_citation,omitempty"`
+}
+
+// URLCitation represents a cited web page. StartIndex and EndIndex locate the cited
+// span of the message content.
+type URLCitation struct {
+	URL        string `json:"url"`
+	Title      string `json:"title,omitempty"`
+	Content    string `json:"content,omitempty"`
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+}
+
+// ResponseContent is response message text. Most upstreams send a string or null,
+// but some send an array of content parts, whose text parts are concatenated.
+type ResponseContent string
+
+// UnmarshalJSON accepts a string, null, or an array of content parts
+func (c *ResponseContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = ResponseContent(text)
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	text = ""
+	for _, part := range parts {
+		if part.Type == "text" {
+			text += part.Text
+		}
+	}
+	*c = ResponseContent(text)
+	return nil
+}
+
+// OpenAIToolCallPart represents a tool call in a response, or a fragment of one in a stream.
+// Arguments are normally a JSON-encoded string, but some providers send a raw object.
+type OpenAIToolCallPart struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string          `json:"name,omitempty"`
+		Arguments json.RawMessage `json:"arguments,omitempty"`
+	} `json:"function"`
+}
+
+// OpenAIError represents an error object returned by OpenAI-compatible upstreams
+type OpenAIError struct {
+	Message  string                 `json:"message"`
+	Type     string                 `json:"type,omitempty"`
+	Code     interface{}            `json:"code,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// OpenAIUsage represents token usage reported by OpenAI-compatible upstreams.
+// DeepSeek reports cache hits in prompt_cache_hit_tokens instead of prompt_tokens_details.
+type OpenAIUsage struct {
+	PromptTokens         int                  `json:"prompt_tokens"`
+	CompletionTokens     int                  `json:"completion_tokens"`
+	PromptTokensDetails  *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+	PromptCacheHitTokens int                  `json:"prompt_cache_hit_tokens,omitempty"`
+}
+
+// PromptTokensDetails represents the cached-token breakdown of prompt tokens
+type PromptTokensDetails struct {
+	CachedTokens     int `json:"cached_tokens"`
+	CacheWriteTokens int `json:"cache_write_tokens,omitempty"`
+}
+
+// Usage represents token usage in Anthropic format
+type Usage struct {
+	InputTokens              int              `json:"input_tokens"`
+	OutputTokens             int              `json:"output_tokens"`
+	CacheCreationInputTokens int              `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int              `json:"cache_read_input_tokens"`
+	ServerToolUse            *ServerToolUsage `json:"server_tool_use,omitempty"`
+}
+
+// ServerToolUsage counts server tool requests in Anthropic usage
+type ServerToolUsage struct {
+	WebSearchRequests int `json:"web_search_requests"`
+}
+
+// ReasoningConfig represents the OpenRouter reasoning request parameter
+type ReasoningConfig struct {
+	MaxTokens int   `json:"max_tokens,omitempty"`
+	Enabled   *bool `json:"enabled,omitempty"`
+}
+
+// ReasoningDetail represents a structured reasoning entry returned by OpenRouter
+type ReasoningDetail struct {
+	Type      string `json:"type"`
+	Text      string `json:"text,omitempty"`
+	Summary   string `json:"summary,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Data      string `json:"data,omitempty"`
+	Format    string `json:"format,omitempty"`
+	Index     int    `json:"index,omitempty"`
 }
 
 // OpenAIMessage represents a message in OpenAI format
 type OpenAIMessage struct {
-	Role       string      `json:"role"`
-	Content    interface{} `json:"content"`
-	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
-	ToolCallID string      `json:"tool_call_id,omitempty"`
+	Role             string            `json:"role"`
+	Content          interface{}       `json:"content"`
+	ToolCalls        []ToolCall        `json:"tool_calls,omitempty"`
+	ToolCallID       string            `json:"tool_call_id,omitempty"`
+	Reasoning        string            `json:"reasoning,omitempty"`
+	ReasoningDetails []ReasoningDetail `json:"reasoning_details,omitempty"`
 }
 
 // ToolCall represents a tool call in OpenAI format
@@ -72,16 +342,32 @@ type OpenAITool struct {
 		Name        string          `json:"name"`
 		Description string          `json:"description,omitempty"`
 		Parameters  json.RawMessage `json:"parameters"`
+		Strict      bool            `json:"strict,omitempty"`
 	} `json:"function"`
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
 }
 
 // ContentBlock represents a content block in Anthropic format
 type ContentBlock struct {
-	Type      string          `json:"type"`
-	Text      string          `json:"text,omitempty"`
-	ID        string          `json:"id,omitempty"`
-	Name      string          `json:"name,omitempty"`
-	Input     json.RawMessage `json:"input,omitempty"`
-	ToolUseID string          `json:"tool_use_id,omitempty"`
-	Content   json.RawMessage `json:"content,omitempty"`
+	Type         string          `json:"type"`
+	Text         string          `json:"text,omitempty"`
+	ID           string          `json:"id,omitempty"`
+	Name         string          `json:"name,omitempty"`
+	Input        json.RawMessage `json:"input,omitempty"`
+	ToolUseID    string          `json:"tool_use_id,omitempty"`
+	Content      json.RawMessage `json:"content,omitempty"`
+	IsError      bool            `json:"is_error,omitempty"`
+	Source       *ImageSource    `json:"source,omitempty"`
+	Thinking     string          `json:"thinking,omitempty"`
+	Signature    string          `json:"signature,omitempty"`
+	Data         string          `json:"data,omitempty"`
+	CacheControl *CacheControl   `json:"cache_control,omitempty"`
+}
+
+// ImageSource represents the source of an Anthropic image block
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
 }
@@ -0,0 +1,292 @@
+package transform
+
+import (
+	"log/slog"
+	"net/url"
+	"sort"
+	"strings"
+
+	"athena/internal/config"
+)
+
+// Anthropic server tool and web search block types
+const (
+	TypeServerToolUse       = "server_tool_use"
+	TypeWebSearchToolResult = "web_search_tool_result"
+	webSearchToolName       = "web_search"
+	webSearchResultType     = "web_search_result"
+	webSearchCitationType   = "web_search_result_location"
+	annotationURLCitation   = "url_citation"
+	onlineModelSuffix       = ":online"
+	maxCitedTextLength      = 150
+)
+
+// serverToolPrefixes identify Anthropic server tool types, which run on the provider and have no input schema
+var serverToolPrefixes = []string{"web_search_", "web_fetch_", "code_execution_"}
+
+// isServerTool reports whether a tool definition is an Anthropic server tool
+func isServerTool(tool Tool) bool {
+	for _, prefix := range serverToolPrefixes {
+		if strings.HasPrefix(tool.Type, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyServerTool maps an Anthropic server tool onto the OpenRouter request. web_search
+// becomes the web plugin, or the :online model variant; other server tools are dropped,
+// as is web_search when the upstream does not take OpenRouter's extensions.
+func applyServerTool(result *OpenAIRequest, tool Tool, cfg *config.Config, extensions bool) {
+	if !strings.HasPrefix(tool.Type, "web_search_") {
+		slog.Warn("dropping unsupported server tool", "type", tool.Type, "name", tool.Name)
+		return
+	}
+	if !extensions {
+		slog.Warn("dropping web search, the upstream does not support OpenRouter plugins", "type", tool.Type)
+		return
+	}
+
+	switch cfg.WebSearchMode {
+	case config.WebSearchOff:
+		slog.Debug("web search disabled, dropping server tool", "type", tool.Type)
+		return
+	case config.WebSearchOnline:
+		if !strings.HasSuffix(result.Model, onlineModelSuffix) {
+			result.Model += onlineModelSuffix
+		}
+	default:
+		result.Plugins = append(result.Plugins, Plugin{
+			ID:           "web",
+			MaxResults:   cfg.WebSearchMaxResults,
+			SearchPrompt: webSearchPrompt(tool.AllowedDomains, tool.BlockedDomains),
+		})
+	}
+
+	// Both modes run a single search per request, so a higher max_uses can't be honored
+	if tool.MaxUses > 1 {
+		slog.Warn("web search runs once per request, fewer searches than max_uses allows", "max_uses", tool.MaxUses)
+	}
+	if len(tool.AllowedDomains) > 0 || len(tool.BlockedDomains) > 0 {
+		slog.Warn("web search domain filters only apply to citations, the search itself is unrestricted",
+			"allowed_domains", tool.AllowedDomains,
+			"blocked_domains", tool.BlockedDomains,
+		)
+		result.WebSearchDomains = &DomainFilter{Allowed: tool.AllowedDomains, Blocked: tool.BlockedDomains}
+	}
+}
+
+// DomainFilter holds a web search tool's allowed and blocked domains. The upstream
+// search can't be restricted to them, so citations outside them are dropped instead.
+type DomainFilter struct {
+	Allowed []string
+	Blocked []string
+}
+
+// allows reports whether a URL's host passes the filter. Domains match their subdomains.
+func (f *DomainFilter) allows(rawURL string) bool {
+	if f == nil {
+		return true
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if matchesDomain(host, f.Blocked) {
+		return false
+	}
+	return len(f.Allowed) == 0 || matchesDomain(host, f.Allowed)
+}
+
+// matchesDomain reports whether host is one of the domains or a subdomain of one
+func matchesDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.TrimPrefix(strings.ToLower(domain), "www.")
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// webSearchPrompt returns a search prompt carrying the tool's domain filters, or an empty
+// string to keep OpenRouter's default prompt. The plugin has no domain filter of its own.
+func webSearchPrompt(allowed, blocked []string) string {
+	if len(allowed) == 0 && len(blocked) == 0 {
+		return ""
+	}
+	prompt := "A web search was conducted. Incorporate the following web search results into your response, citing them with markdown links."
+	if len(allowed) > 0 {
+		prompt += " Only use results from these domains: " + strings.Join(allowed, ", ") + "."
+	}
+	if len(blocked) > 0 {
+		prompt += " Never use results from these domains: " + strings.Join(blocked, ", ") + "."
+	}
+	return prompt
+}
+
+// urlCitations returns the URL citations among response annotations that pass the
+// web search domain filter
+func urlCitations(annotations []Annotation, domains *DomainFilter) []URLCitation {
+	citations := []URLCitation{}
+	for _, annotation := range annotations {
+		if annotation.Type != annotationURLCitation || annotation.URLCitation == nil || annotation.URLCitation.URL == "" {
+			continue
+		}
+		if !domains.allows(annotation.URLCitation.URL) {
+			slog.Debug("dropping citation outside the web search domain filters", "url", annotation.URLCitation.URL)
+			continue
+		}
+		citations = append(citations, *annotation.URLCitation)
+	}
+	return citations
+}
+
+// webSearchToolID returns the server_tool_use ID for a message's web search
+func webSearchToolID(messageID string) string {
+	return "srvtoolu_" + hashToolID(messageID+"/web_search", anthropicToolIDLength)
+}
+
+// webSearchBlocks returns the server_tool_use and web_search_tool_result blocks that
+// represent the search behind a set of citations
+func webSearchBlocks(messageID string, citations []URLCitation) []map[string]interface{} {
+	id := webSearchToolID(messageID)
+
+	results := []map[string]interface{}{}
+	seen := map[string]bool{}
+	for _, citation := range citations {
+		if seen[citation.URL] {
+			continue
+		}
+		seen[citation.URL] = true
+		// encrypted_content is opaque to clients and only meaningful to Anthropic, so the
+		// page text stays in the citations rather than being passed off as encrypted
+		results = append(results, map[string]interface{}{
+			"type":              webSearchResultType,
+			"url":               citation.URL,
+			"title":             citation.Title,
+			"encrypted_content": "",
+			"page_age":          nil,
+		})
+	}
+
+	return []map[string]interface{}{
+		{
+			"type":  TypeServerToolUse,
+			"id":    id,
+			"name":  webSearchToolName,
+			"input": map[string]interface{}{},
+		},
+		{
+			"type":        TypeWebSearchToolResult,
+			"tool_use_id": id,
+			"content":     results,
+		},
+	}
+}
+
+// webSearchCitation converts a URL citation to an Anthropic text citation
+func webSearchCitation(citation URLCitation, citedText string) map[string]interface{} {
+	if citedText == "" {
+		citedText = citation.Content
+	}
+	if runes := []rune(citedText); len(runes) > maxCitedTextLength {
+		citedText = string(runes[:maxCitedTextLength])
+	}
+	return map[string]interface{}{
+		"type":            webSearchCitationType,
+		"url":             citation.URL,
+		"title":           citation.Title,
+		"encrypted_index": "",
+		"cited_text":      citedText,
+	}
+}
+
+// citedTextBlocks splits response text into text blocks, attaching each citation to the
+// span it covers. Citations without a usable span are attached to the whole text.
+func citedTextBlocks(text string, citations []URLCitation) []map[string]interface{} {
+	runes := []rune(text)
+	spans := []URLCitation{}
+	for _, citation := range citations {
+		if citation.StartIndex >= 0 && citation.StartIndex < citation.EndIndex && citation.EndIndex <= len(runes) {
+			spans = append(spans, citation)
+		}
+	}
+
+	if len(spans) < len(citations) {
+		block := map[string]interface{}{"type": contentTypeText, "text": text}
+		blockCitations := []map[string]interface{}{}
+		for _, citation := range citations {
+			blockCitations = append(blockCitations, webSearchCitation(citation, ""))
+		}
+		block["citations"] = blockCitations
+		return []map[string]interface{}{block}
+	}
+
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].StartIndex < spans[j].StartIndex })
+
+	blocks := []map[string]interface{}{}
+	pos := 0
+	for i := 0; i < len(spans); {
+		start, end := spans[i].StartIndex, spans[i].EndIndex
+		if start < pos {
+			// Overlapping spans are merged into the previous block's citations
+			last := blocks[len(blocks)-1]
+			last["citations"] = append(last["citations"].([]map[string]interface{}), webSearchCitation(spans[i], ""))
+			i++
+			continue
+		}
+		if start > pos {
+			blocks = append(blocks, map[string]interface{}{"type": contentTypeText, "text": string(runes[pos:start])})
+		}
+
+		cited := string(runes[start:end])
+		blockCitations := []map[string]interface{}{}
+		for ; i < len(spans) && spans[i].StartIndex == start && spans[i].EndIndex == end; i++ {
+			blockCitations = append(blockCitations, webSearchCitation(spans[i], cited))
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type":      contentTypeText,
+			"text":      cited,
+			"citations": blockCitations,
+		})
+		pos = end
+	}
+	if pos < len(runes) {
+		blocks = append(blocks, map[string]interface{}{"type": contentTypeText, "text": string(runes[pos:])})
+	}
+	return blocks
+}
+
+// processAnnotations emits web search citations during a stream. Citations attach to the
+// open text block, and the search itself is reported once as server tool blocks.
+func processAnnotations(state *streamState, annotations []Annotation) {
+	citations := urlCitations(annotations, state.webSearchDomains)
+	if len(citations) == 0 {
+		return
+	}
+
+	if state.openBlockType == contentTypeText {
+		for _, citation := range citations {
+			state.send("content_block_delta", map[string]interface{}{
+				"type":  "content_block_delta",
+				"index": state.openBlockIndex,
+				"delta": map[string]interface{}{
+					"type":     "citations_delta",
+					"citation": webSearchCitation(citation, ""),
+				},
+			})
+		}
+	}
+
+	if state.webSearchReported {
+		return
+	}
+	state.webSearchReported = true
+
+	state.closeTextOrThinkingBlock()
+	for _, block := range webSearchBlocks(state.messageID, citations) {
+		state.stopBlock(state.startBlock(block))
+	}
+}
@@ -0,0 +1,247 @@
+package transform
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"athena/internal/config"
+)
+
+func webSearchRequest(tool string) AnthropicRequest {
+	return AnthropicRequest{
+		Model:    "claude-3-5-sonnet",
+		Messages: []Message{{Role: "user", Content: json.RawMessage(`"What's new in Go?"`)}},
+		Tools: []Tool{
+			{Name: "read", InputSchema: json.RawMessage(`{"type":"object"}`)},
+		},
+		ToolChoice: &ToolChoice{Type: "tool", Name: "web_search"},
+	}.withTool(tool)
+}
+
+func (r AnthropicRequest) withTool(raw string) AnthropicRequest {
+	var tool Tool
+	_ = json.Unmarshal([]byte(raw), &tool)
+	r.Tools = append(r.Tools, tool)
+	return r
+}
+
+func TestAnthropicToOpenAI_WebSearch(t *testing.T) {
+	webSearch := `{"type":"web_search_20250305","name":"web_search","max_uses":5,"allowed_domains":["go.dev"],"blocked_domains":["example.com"]}`
+
+	t.Run("plugin", func(t *testing.T) {
+		result := AnthropicToOpenAI(webSearchRequest(webSearch), &config.Config{Model: "moonshotai/kimi-k2", WebSearchMaxResults: 3})
+
+		if len(result.Tools) != 1 || result.Tools[0].Function.Name != "read" {
+			t.Errorf("Tools = %+v, expected only the read function", result.Tools)
+		}
+		if len(result.Plugins) != 1 || result.Plugins[0].ID != "web" || result.Plugins[0].MaxResults != 3 {
+			t.Fatalf("Plugins = %+v, expected the web plugin", result.Plugins)
+		}
+		prompt := result.Plugins[0].SearchPrompt
+		if !strings.Contains(prompt, "go.dev") || !strings.Contains(prompt, "example.com") {
+			t.Errorf("Search prompt = %q, expected domain filters", prompt)
+		}
+		if result.ToolChoice != "auto" {
+			t.Errorf("Tool choice = %v, expected auto for a server tool", result.ToolChoice)
+		}
+		if result.Model != "moonshotai/kimi-k2" {
+			t.Errorf("Model = %q, expected unchanged", result.Model)
+		}
+		if result.WebSearchDomains == nil || result.WebSearchDomains.Allowed[0] != "go.dev" || result.WebSearchDomains.Blocked[0] != "example.com" {
+			t.Errorf("Domain filter = %+v, expected the tool's domains", result.WebSearchDomains)
+		}
+	})
+
+	t.Run("online variant", func(t *testing.T) {
+		result := AnthropicToOpenAI(webSearchRequest(webSearch), &config.Config{Model: "moonshotai/kimi-k2", WebSearchMode: config.WebSearchOnline})
+
+		if result.Model != "moonshotai/kimi-k2:online" || len(result.Plugins) != 0 {
+			t.Errorf("Model = %q, plugins = %+v, expected the :online variant", result.Model, result.Plugins)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		result := AnthropicToOpenAI(webSearchRequest(webSearch), &config.Config{Model: "moonshotai/kimi-k2", WebSearchMode: config.WebSearchOff})
+
+		if len(result.Plugins) != 0 || len(result.Tools) != 1 {
+			t.Errorf("Plugins = %+v, tools = %d, expected web search dropped", result.Plugins, len(result.Tools))
+		}
+	})
+
+	t.Run("unsupported server tool", func(t *testing.T) {
+		result := AnthropicToOpenAI(webSearchRequest(`{"type":"code_execution_20250522","name":"code_execution"}`), &config.Config{Model: "moonshotai/kimi-k2"})
+
+		if len(result.Plugins) != 0 || len(result.Tools) != 1 {
+			t.Errorf("Plugins = %+v, tools = %d, expected server tool dropped", result.Plugins, len(result.Tools))
+		}
+	})
+}
+
+func TestCitedTextBlocks(t *testing.T) {
+	text := "Go 1.24 is out. It adds generic type aliases."
+	citations := []URLCitation{
+		{URL: "https://go.dev/blog/go1.24", Title: "Go 1.24", StartIndex: 0, EndIndex: 15},
+		{URL: "https://go.dev/doc/go1.24", Title: "Release notes", StartIndex: 16, EndIndex: 45},
+	}
+
+	blocks := citedTextBlocks(text, citations)
+
+	if len(blocks) != 3 {
+		t.Fatalf("Expected 3 blocks, got %d: %v", len(blocks), blocks)
+	}
+	var joined string
+	for _, block := range blocks {
+		joined += block["text"].(string)
+	}
+	if joined != text {
+		t.Errorf("Blocks text = %q, expected %q", joined, text)
+	}
+	first := blocks[0]["citations"].([]map[string]interface{})
+	if first[0]["url"] != "https://go.dev/blog/go1.24" || first[0]["cited_text"] != "Go 1.24 is out." {
+		t.Errorf("First citation = %v", first[0])
+	}
+	if _, ok := blocks[1]["citations"]; ok {
+		t.Errorf("Uncited span should have no citations: %v", blocks[1])
+	}
+
+	// Citations without a usable span attach to the whole text
+	blocks = citedTextBlocks(text, []URLCitation{{URL: "https://go.dev", Content: "Go homepage", StartIndex: 0, EndIndex: 500}})
+	if len(blocks) != 1 || blocks[0]["text"] != text {
+		t.Fatalf("Expected a single block, got %v", blocks)
+	}
+	if cited := blocks[0]["citations"].([]map[string]interface{})[0]["cited_text"]; cited != "Go homepage" {
+		t.Errorf("Cited text = %v, expected the citation content", cited)
+	}
+}
+
+func TestDomainFilter(t *testing.T) {
+	filter := &DomainFilter{Allowed: []string{"go.dev", "www.python.org"}, Blocked: []string{"pkg.go.dev"}}
+	tests := []struct {
+		url      string
+		expected bool
+	}{
+		{url: "https://go.dev/blog", expected: true},
+		{url: "https://tip.GO.dev/doc", expected: true},
+		{url: "https://docs.python.org/3/", expected: true},
+		{url: "https://pkg.go.dev/net/http", expected: false},
+		{url: "https://notgo.dev/", expected: false},
+		{url: "https://example.com/", expected: false},
+		{url: "not a url", expected: false},
+	}
+	for _, tt := range tests {
+		if got := filter.allows(tt.url); got != tt.expected {
+			t.Errorf("allows(%q) = %v, expected %v", tt.url, got, tt.expected)
+		}
+	}
+
+	var none *DomainFilter
+	if !none.allows("https://example.com/") {
+		t.Error("Expected no filter to allow every URL")
+	}
+	if blocked := (&DomainFilter{Blocked: []string{"example.com"}}); !blocked.allows("https://go.dev/") || blocked.allows("https://www.example.com/") {
+		t.Error("Expected a blocklist alone to allow other domains")
+	}
+}
+
+func TestOpenAIToAnthropic_WebSearchDomainFilter(t *testing.T) {
+	resp := OpenAIResponse{}
+	if err := json.Unmarshal([]byte(`{"choices":[{"message":{"role":"assistant","content":"Go 1.24 is out.","annotations":[
+		{"type":"url_citation","url_citation":{"url":"https://example.com/go","title":"Mirror","start_index":0,"end_index":15}}
+	]},"finish_reason":"stop"}]}`), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	result, err := OpenAIToAnthropic(resp, "test/model", ResponseOptions{WebSearchDomains: &DomainFilter{Blocked: []string{"example.com"}}})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error: %v", err)
+	}
+	content := result["content"].([]map[string]interface{})
+	if len(content) != 1 || content[0]["type"] != "text" {
+		t.Fatalf("Content = %v, expected only the text with the blocked citation dropped", content)
+	}
+	if _, ok := content[0]["citations"]; ok {
+		t.Errorf("Text block = %v, expected no citations", content[0])
+	}
+}
+
+func TestOpenAIToAnthropic_WebSearch(t *testing.T) {
+	resp := OpenAIResponse{}
+	if err := json.Unmarshal([]byte(`{"choices":[{"message":{"role":"assistant","content":"Go 1.24 is out.","annotations":[
+		{"type":"url_citation","url_citation":{"url":"https://go.dev/blog/go1.24","title":"Go 1.24","content":"Go 1.24 released","start_index":0,"end_index":15}}
+	]},"finish_reason":"stop"}]}`), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	result, err := OpenAIToAnthropic(resp, "test/model", ResponseOptions{})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error: %v", err)
+	}
+
+	content := result["content"].([]map[string]interface{})
+	if len(content) != 3 {
+		t.Fatalf("Expected server_tool_use, web_search_tool_result and text, got %v", content)
+	}
+	if content[0]["type"] != TypeServerToolUse || content[0]["name"] != "web_search" {
+		t.Errorf("First block = %v, expected server_tool_use", content[0])
+	}
+	if content[1]["type"] != TypeWebSearchToolResult || content[1]["tool_use_id"] != content[0]["id"] {
+		t.Errorf("Second block = %v, expected web_search_tool_result for %v", content[1], content[0]["id"])
+	}
+	if results := content[1]["content"].([]map[string]interface{}); len(results) != 1 || results[0]["encrypted_content"] != "" {
+		t.Errorf("Search results = %v, expected no page text in encrypted_content", results)
+	}
+	if _, ok := content[2]["citations"]; !ok {
+		t.Errorf("Text block = %v, expected citations", content[2])
+	}
+	if usage := result["usage"].(Usage); usage.ServerToolUse == nil || usage.ServerToolUse.WebSearchRequests != 1 {
+		t.Errorf("Usage = %+v, expected one web search request", usage)
+	}
+}
+
+func TestHandleStreaming_WebSearch(t *testing.T) {
+	streamData := `data: {"choices":[{"index":0,"delta":{"content":"Go 1.24 is out."},"finish_reason":null}]}
+
+data: {"choices":[{"index":0,"delta":{"content":"","annotations":[{"type":"url_citation","url_citation":{"url":"https://go.dev/blog/go1.24","title":"Go 1.24","start_index":0,"end_index":15}}]},"finish_reason":"stop"}]}
+
+data: [DONE]
+
+`
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(streamData)),
+		Header:     make(http.Header),
+	}
+
+	w := httptest.NewRecorder()
+	HandleStreaming(w, resp, "test/model", ResponseOptions{})
+
+	body, _ := io.ReadAll(w.Result().Body)
+	bodyStr := string(body)
+
+	expectedInOrder := []string{
+		`"delta":{"text":"Go 1.24 is out.","type":"text_delta"},"index":0`,
+		`"delta":{"citation":{"cited_text":"","encrypted_index":"","title":"Go 1.24","type":"web_search_result_location","url":"https://go.dev/blog/go1.24"},"type":"citations_delta"},"index":0`,
+		`{"index":0,"type":"content_block_stop"}`,
+		`"content_block":{"id":"srvtoolu_`,
+		`"type":"server_tool_use"},"index":1`,
+		`{"index":1,"type":"content_block_stop"}`,
+		`"type":"web_search_tool_result"},"index":2`,
+		`{"index":2,"type":"content_block_stop"}`,
+		`"server_tool_use":{"web_search_requests":1}`,
+		`event: message_stop`,
+	}
+
+	pos := 0
+	for _, expected := range expectedInOrder {
+		idx := strings.Index(bodyStr[pos:], expected)
+		if idx < 0 {
+			t.Fatalf("Expected %s after position %d in stream:\n%s", expected, pos, bodyStr)
+		}
+		pos += idx + len(expected)
+	}
+}